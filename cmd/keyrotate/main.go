@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/repo"
+)
+
+// keyrotate maintains the JWT signing key file shared by gophermart replicas.
+// It is meant to be run on a schedule (cron, Kubernetes CronJob): every run
+// adds a new key when the newest one is old enough, which is published for
+// verification first and signs once every replica and JWKS cache has had
+// time to pick it up, and retires superseded keys once tokens signed with
+// them have expired.
+func main() {
+	var (
+		path          string
+		algorithm     string
+		rotateAfter   time.Duration
+		activateAfter time.Duration
+		retireAfter   time.Duration
+		removeAfter   time.Duration
+		force         bool
+	)
+	flag.StringVar(&path, "k", os.Getenv("JWT_KEYS_FILE"), "JWT signing keys file")
+	flag.StringVar(&algorithm, "alg", envOrDefault("JWT_SIGNING_ALG", entities.SigningAlgorithmHS256),
+		"signing algorithm for new keys: HS256, RS256 or EdDSA")
+	flag.DurationVar(&rotateAfter, "rotate-after", 30*24*time.Hour, "add a new key when the active one is older")
+	flag.DurationVar(&activateAfter, "activate-after", defaultActivateAfter(),
+		"start signing with a new key this long after adding it; must exceed the replicas' key reload "+
+			"interval plus the JWKS cache max-age")
+	flag.DurationVar(&retireAfter, "retire-after", 2*time.Hour, "retire keys superseded longer ago than this")
+	flag.DurationVar(&removeAfter, "remove-after", 7*24*time.Hour, "drop keys retired longer ago than this")
+	flag.BoolVar(&force, "force", false, "add a new key regardless of the active key age")
+	flag.Parse()
+
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "keys file is required: use -k or JWT_KEYS_FILE")
+		os.Exit(2)
+	}
+
+	keys, err := repo.ReadKeySet(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(os.Stderr, "read keys failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	rotated, err := repo.RotateKeySet(
+		keys, time.Now(), algorithm, rotateAfter, activateAfter, retireAfter, removeAfter, force,
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rotate keys failed: %v\n", err)
+		os.Exit(1)
+	}
+	if err = repo.WriteKeySet(path, rotated); err != nil {
+		fmt.Fprintf(os.Stderr, "write keys failed: %v\n", err)
+		os.Exit(1)
+	}
+	printKeys(rotated)
+}
+
+func envOrDefault(name, value string) string {
+	if env, ok := os.LookupEnv(name); ok {
+		return env
+	}
+	return value
+}
+
+// defaultActivateAfter is the key reload interval from JWT_KEYS_RELOAD_INTERVAL,
+// as the replicas are configured, plus how long clients cache the JWKS.
+func defaultActivateAfter() time.Duration {
+	reloadInterval, err := time.ParseDuration(os.Getenv("JWT_KEYS_RELOAD_INTERVAL"))
+	if err != nil {
+		reloadInterval = 0
+	}
+	return reloadInterval + entities.JWKSMaxAge
+}
+
+func printKeys(keys entities.SigningKeySet) {
+	now := time.Now()
+	for _, key := range keys.Keys {
+		state := "valid"
+		switch {
+		case key.RetiredAt != nil:
+			state = "retired " + key.RetiredAt.Format(time.RFC3339)
+		case key.ActivateAfter != nil && key.ActivateAfter.After(now):
+			state = "verifies only, signs from " + key.ActivateAfter.Format(time.RFC3339)
+		}
+		algorithm := key.Algorithm
+		if algorithm == "" {
+			algorithm = entities.SigningAlgorithmHS256
+		}
+		fmt.Printf("%s\t%s\tcreated %s\t%s\n", key.ID, algorithm, key.CreatedAt.Format(time.RFC3339), state)
+	}
+}
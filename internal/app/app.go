@@ -3,12 +3,16 @@ package app
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/Albitko/loyalty-program/internal/config"
 	"github.com/Albitko/loyalty-program/internal/controller"
+	"github.com/Albitko/loyalty-program/internal/entities"
 	"github.com/Albitko/loyalty-program/internal/middleware"
+	"github.com/Albitko/loyalty-program/internal/notifier"
+	"github.com/Albitko/loyalty-program/internal/oidc"
 	"github.com/Albitko/loyalty-program/internal/repo"
 	"github.com/Albitko/loyalty-program/internal/usecase"
 	"github.com/Albitko/loyalty-program/internal/utils"
@@ -20,6 +24,30 @@ func init() {
 	utils.InitializeRestyClient()
 }
 
+type notificationSender interface {
+	Send(ctx context.Context, notification entities.Notification) error
+}
+
+// loginAttemptsStore counts login and password reset attempts, in memory or
+// in Postgres.
+type loginAttemptsStore interface {
+	AddLoginAttempt(ctx context.Context, key string, now, resetBefore time.Time) (entities.LoginAttempts, error)
+	ForgiveLoginAttempt(ctx context.Context, key string) error
+	ResetLoginAttempts(ctx context.Context, key string) error
+	DeleteExpiredLoginAttempts(ctx context.Context, before time.Time) error
+}
+
+func newNotifier(cfg entities.Config) notificationSender {
+	if cfg.Notifier == "smtp" {
+		smtpNotifier, err := notifier.NewSMTPNotifier(cfg.SMTPAddress, cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPFrom)
+		if err != nil {
+			panic(fmt.Errorf("create SMTP notifier failed: %w", err))
+		}
+		return smtpNotifier
+	}
+	return notifier.NewFileNotifier(cfg.NotifierFile)
+}
+
 func Run() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -36,31 +64,135 @@ func Run() {
 	}
 	defer storage.Close()
 
-	queue := workers.New(ctx, storage, cfg.AccrualSystemAddress)
+	queue, err := workers.New(ctx, storage, cfg)
+	if err != nil {
+		panic(fmt.Errorf("create accrual queue failed: %w", err))
+	}
 
-	secret := utils.GenerateSecret()
-	userAuthenticator := usecase.NewAuthenticator(storage, secret)
+	keyStore, err := repo.NewKeyStore(cfg.JwtKeysFile, cfg.JwtKeys, cfg.JwtSigningAlgorithm)
+	if err != nil {
+		panic(fmt.Errorf("create key store failed: %w", err))
+	}
+	go keyStore.ReloadEvery(ctx, cfg.JwtKeysReloadInterval)
+
+	userAuthenticator, err := usecase.NewAuthenticator(storage, keyStore, cfg.RefreshTokenTTL)
+	if err != nil {
+		panic(fmt.Errorf("create authenticator failed: %w", err))
+	}
+	if cfg.BootstrapAdminLogin != "" {
+		if err = userAuthenticator.BootstrapAdmin(ctx, cfg.BootstrapAdminLogin); err != nil {
+			panic(fmt.Errorf("bootstrap admin failed: %w", err))
+		}
+	}
+	var attempts loginAttemptsStore = repo.NewMemoryLoginAttempts()
+	if cfg.LoginGuardBackend == "postgres" {
+		attempts = storage
+	}
+	loginGuard := usecase.NewLoginGuard(attempts)
+	go loginGuard.ExpireEvery(ctx, time.Minute)
+	sender := newNotifier(cfg)
+	passwordManager := usecase.NewPasswordManager(
+		storage, sender, attempts, cfg.PasswordResetTTL, cfg.PasswordResetURL,
+	)
+	apiKeyManager := usecase.NewAPIKeyManager(storage)
+	sessionManager := usecase.NewSessionManager(storage)
+	mfaManager, err := usecase.NewMFAManager(storage, cfg.MFAEncryptionKey, cfg.MFAIssuer)
+	if err != nil {
+		panic(fmt.Errorf("create MFA manager failed: %w", err))
+	}
+	accountManager := usecase.NewAccountManager(storage, mfaManager, sender)
+	auditor, err := usecase.NewAuditor(storage, cfg.AuditPseudonymKey)
+	if err != nil {
+		panic(fmt.Errorf("create auditor failed: %w", err))
+	}
 	ordersProcessor := usecase.NewOrdersProcessor(storage, queue)
 	balanceProcessor := usecase.NewBalanceProcessor(storage)
 
-	userHandler := controller.NewUserAuthHandler(userAuthenticator)
-	ordersHandler := controller.NewOrdersHandler(ordersProcessor)
-	balanceHandler := controller.NewBalanceHandler(balanceProcessor)
+	userHandler := controller.NewUserAuthHandler(userAuthenticator, loginGuard, mfaManager, auditor)
+	ordersHandler := controller.NewOrdersHandler(ordersProcessor, auditor)
+	balanceHandler := controller.NewBalanceHandler(balanceProcessor, auditor)
+	jwksHandler := controller.NewJwksHandler(keyStore)
+	adminHandler := controller.NewAdminHandler(loginGuard, userAuthenticator, ordersProcessor, auditor)
+	passwordHandler := controller.NewPasswordHandler(passwordManager, loginGuard)
+	apiKeyHandler := controller.NewAPIKeyHandler(apiKeyManager)
+	mfaHandler := controller.NewMFAHandler(mfaManager, loginGuard)
+	sessionHandler := controller.NewSessionHandler(sessionManager)
+	accountHandler := controller.NewAccountHandler(accountManager, loginGuard)
 
 	r := gin.New()
+	// Client IPs feed the login throttling, so forwarding headers are only
+	// honoured from known proxies.
+	err = r.SetTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		panic(fmt.Errorf("set trusted proxies failed: %w", err))
+	}
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
+	r.Use(middleware.RequestID())
 
+	r.GET("/.well-known/jwks.json", jwksHandler.GetKeys)
 	r.POST("/api/user/register", userHandler.Register)
 	r.POST("/api/user/login", userHandler.Login)
+	r.POST("/api/user/login/2fa", userHandler.LoginMFA)
+	r.POST("/api/user/token/refresh", userHandler.Refresh)
+	r.POST("/api/user/password/reset/request", passwordHandler.RequestReset)
+	r.POST("/api/user/password/reset", passwordHandler.ResetPassword)
+
+	// Single sign-on is only offered when a provider is configured.
+	if cfg.OIDCIssuer != "" {
+		provider, err := oidc.NewProvider(
+			ctx, cfg.OIDCIssuer, cfg.OIDCClientID, cfg.OIDCClientSecret, cfg.OIDCRedirectURL,
+		)
+		if err != nil {
+			panic(fmt.Errorf("create OIDC provider failed: %w", err))
+		}
+		oidcHandler := controller.NewOIDCHandler(
+			usecase.NewOIDCLogin(provider, storage), userAuthenticator, auditor,
+		)
+		r.GET("/api/user/oidc/login", oidcHandler.Login)
+		r.GET("/api/user/oidc/callback", oidcHandler.Callback)
+	}
+
+	jwtAuth := middleware.JwtAuthMiddleware(keyStore, storage, storage)
+
+	// Routes that integrations may call with an API key in place of a user token.
+	integration := r.Group("/api/user/")
+	integration.Use(middleware.APIKeyOrJwtMiddleware(apiKeyManager, jwtAuth))
+	integration.POST("orders", middleware.RequireScope(entities.ScopeOrdersWrite), ordersHandler.CreateOrder)
+	integration.POST(
+		"orders/batch", middleware.RequireScope(entities.ScopeOrdersWrite), ordersHandler.CreateOrdersBatch,
+	)
+	integration.GET("orders", middleware.RequireScope(entities.ScopeOrdersRead), ordersHandler.GetOrders)
+	integration.GET("orders/:number", middleware.RequireScope(entities.ScopeOrdersRead), ordersHandler.GetOrder)
+	integration.GET("balance", middleware.RequireScope(entities.ScopeBalanceRead), balanceHandler.GetBalance)
 
 	authorized := r.Group("/api/user/")
-	authorized.Use(middleware.JwtAuthMiddleware(secret))
-	authorized.POST("orders", ordersHandler.CreateOrder)
-	authorized.GET("orders", ordersHandler.GetOrders)
-	authorized.GET("balance", balanceHandler.GetBalance)
+	authorized.Use(jwtAuth)
+	authorized.POST("logout", userHandler.Logout)
+	authorized.GET("sessions", sessionHandler.ListSessions)
+	authorized.DELETE("sessions/:id", sessionHandler.TerminateSession)
+	authorized.GET("export", accountHandler.Export)
+	authorized.POST("deletion-token", accountHandler.RequestDeletion)
+	authorized.POST("password", passwordHandler.ChangePassword)
+	authorized.POST("2fa/enroll", mfaHandler.Enroll)
+	authorized.POST("2fa/verify", mfaHandler.Confirm)
+	authorized.DELETE("2fa", mfaHandler.Disable)
+	authorized.POST("api-keys", apiKeyHandler.CreateKey)
+	authorized.GET("api-keys", apiKeyHandler.ListKeys)
+	authorized.DELETE("api-keys/:id", apiKeyHandler.RevokeKey)
 	authorized.POST("balance/withdraw", balanceHandler.Withdraw)
 	authorized.GET("withdrawals", balanceHandler.GetWithdrawn)
+	// The group path ends with a slash, so the account itself is registered
+	// on its own.
+	r.DELETE("/api/user", jwtAuth, accountHandler.Delete)
+
+	admin := r.Group("/api/admin/")
+	admin.Use(jwtAuth, middleware.RequireRoles(entities.RoleSupport, entities.RoleAdmin))
+	admin.POST("logins/:login/unlock", adminHandler.UnlockLogin)
+	admin.PUT("users/:id/role", middleware.RequireRoles(entities.RoleAdmin), adminHandler.SetRole)
+	admin.GET("audit", middleware.RequireRoles(entities.RoleAdmin), adminHandler.ListAuditEvents)
+	admin.GET("orders/dead-letters", adminHandler.ListDeadLetteredOrders)
+	admin.POST("orders/:number/requeue", adminHandler.RequeueOrder)
 
 	err = r.Run(cfg.RunAddress)
 	if err != nil {
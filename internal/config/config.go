@@ -2,6 +2,7 @@ package config
 
 import (
 	"flag"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 
@@ -14,6 +15,8 @@ func New() (entities.Config, error) {
 	flag.StringVar(&cfg.RunAddress, "a", "localhost:8080", "host and port to listen on")
 	flag.StringVar(&cfg.DatabaseURI, "d", "postgresql://localhost:5432/postgres", "database DSN")
 	flag.StringVar(&cfg.AccrualSystemAddress, "r", "", "accrual system address")
+	flag.StringVar(&cfg.JwtKeysFile, "k", "", "JWT signing keys file")
+	flag.DurationVar(&cfg.JwtKeysReloadInterval, "key-reload", time.Minute, "JWT signing keys file reload interval")
 	flag.Parse()
 
 	err := env.Parse(&cfg)
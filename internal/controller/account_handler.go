@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+type accountManager interface {
+	Export(ctx context.Context, userID string) ([]byte, error)
+	RequestDeletion(ctx context.Context, userID string) error
+	Delete(ctx context.Context, claims entities.JwtCustomClaims, request entities.DeleteAccountRequest) error
+}
+
+type accountHandler struct {
+	manager accountManager
+	guard   userGuard
+}
+
+func (a *accountHandler) Export(c *gin.Context) {
+	userID, isExtract := c.Get("x-user-id")
+	if !isExtract {
+		utils.Logger.Error("accountHandler:Export - extract userID", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-user-id"})
+		return
+	}
+
+	archive, err := a.manager.Export(c, fmt.Sprintf("%v", userID))
+	if errors.Is(err, entities.ErrUserNotFound) {
+		utils.Logger.Error("accountHandler:Export - user not found", zap.Error(err))
+		c.JSON(http.StatusNotFound, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("accountHandler:Export - Export", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="gophermart-export.zip"`)
+	c.Data(http.StatusOK, "application/zip", archive)
+}
+
+// RequestDeletion mails a token that confirms the deletion of the account,
+// for users who don't know their password.
+func (a *accountHandler) RequestDeletion(c *gin.Context) {
+	userID, isExtract := c.Get("x-user-id")
+	if !isExtract {
+		utils.Logger.Error("accountHandler:RequestDeletion - extract userID", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-user-id"})
+		return
+	}
+	// Every mail counts, so the mailbox of a user can't be flooded.
+	if !allowUserAttempt(c, a.guard, "accountHandler:RequestDeletion", fmt.Sprintf("%v", userID)) {
+		return
+	}
+
+	err := a.manager.RequestDeletion(c, fmt.Sprintf("%v", userID))
+	if errors.Is(err, entities.ErrNoEmail) {
+		utils.Logger.Error("accountHandler:RequestDeletion - no email", zap.Error(err))
+		c.JSON(http.StatusConflict, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if errors.Is(err, entities.ErrUserNotFound) {
+		utils.Logger.Error("accountHandler:RequestDeletion - user not found", zap.Error(err))
+		c.JSON(http.StatusNotFound, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("accountHandler:RequestDeletion - RequestDeletion", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, entities.ErrorResponse{Message: "Deletion token sent"})
+}
+
+func (a *accountHandler) Delete(c *gin.Context) {
+	claims, isExtract := c.Get("x-claims")
+	if !isExtract {
+		utils.Logger.Error("accountHandler:Delete - extract claims", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-claims"})
+		return
+	}
+
+	var request entities.DeleteAccountRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		utils.Logger.Error("accountHandler:Delete - request bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	userClaims := claims.(entities.JwtCustomClaims)
+	if !allowUserAttempt(c, a.guard, "accountHandler:Delete", userClaims.ID) {
+		return
+	}
+	err = a.manager.Delete(c, userClaims, request)
+	if errors.Is(err, entities.ErrInvalidCredentials) || errors.Is(err, entities.ErrInvalidMFACode) ||
+		errors.Is(err, entities.ErrInvalidDeletionToken) {
+		utils.Logger.Error("accountHandler:Delete - not confirmed", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, entities.ErrorResponse{Message: "Invalid password, token or code"})
+		return
+	}
+	if errors.Is(err, entities.ErrMFAUnavailable) {
+		utils.Logger.Error("accountHandler:Delete - MFA unavailable", zap.Error(err))
+		c.JSON(http.StatusServiceUnavailable, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if errors.Is(err, entities.ErrUserNotFound) {
+		utils.Logger.Error("accountHandler:Delete - user not found", zap.Error(err))
+		c.JSON(http.StatusNotFound, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("accountHandler:Delete - Delete", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entities.ErrorResponse{Message: "Account deleted"})
+}
+
+func NewAccountHandler(manager accountManager, guard userGuard) *accountHandler {
+	return &accountHandler{
+		manager: manager,
+		guard:   guard,
+	}
+}
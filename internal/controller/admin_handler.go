@@ -0,0 +1,180 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+type loginUnlocker interface {
+	Unlock(ctx context.Context, login string) error
+}
+
+type roleManager interface {
+	SetRole(ctx context.Context, userID string, role entities.Role) error
+}
+
+type deadLetters interface {
+	ListDeadLettered(ctx context.Context, limit int) ([]entities.DeadLetteredOrder, error)
+	Requeue(ctx context.Context, number entities.OrderNumber) error
+}
+
+type auditLog interface {
+	auditRecorder
+	List(ctx context.Context, query entities.AuditQuery) ([]entities.AuditEvent, error)
+}
+
+type adminHandler struct {
+	unlocker    loginUnlocker
+	roles       roleManager
+	deadLetters deadLetters
+	audit       auditLog
+}
+
+func (a *adminHandler) UnlockLogin(c *gin.Context) {
+	login := c.Param("login")
+	err := a.unlocker.Unlock(c, login)
+	if err != nil {
+		utils.Logger.Error("adminHandler:UnlockLogin - Unlock", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	recordLoginAudit(c, a.audit, entities.AuditLoginUnlocked, adminID(c), login, "")
+	c.JSON(http.StatusOK, entities.ErrorResponse{Message: "Login unlocked"})
+}
+
+func (a *adminHandler) SetRole(c *gin.Context) {
+	var request entities.RoleRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		utils.Logger.Error("adminHandler:SetRole - request bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	err = a.roles.SetRole(c, c.Param("id"), request.Role)
+	if errors.Is(err, entities.ErrInvalidRole) {
+		utils.Logger.Error("adminHandler:SetRole - invalid role", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: "Invalid role"})
+		return
+	}
+	if errors.Is(err, entities.ErrUserNotFound) {
+		utils.Logger.Error("adminHandler:SetRole - user not found", zap.Error(err))
+		c.JSON(http.StatusNotFound, entities.ErrorResponse{Message: "User not found"})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("adminHandler:SetRole - SetRole", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	recordAudit(c, a.audit, entities.AuditRoleChanged, adminID(c),
+		map[string]string{"user_id": c.Param("id"), "role": string(request.Role)})
+	c.JSON(http.StatusOK, entities.ErrorResponse{Message: "Role updated"})
+}
+
+// ListAuditEvents queries the audit log. user_id narrows it to one actor and
+// login to events about one login, from and to are RFC 3339 times and limit
+// caps the number of events.
+func (a *adminHandler) ListAuditEvents(c *gin.Context) {
+	query := entities.AuditQuery{UserID: c.Query("user_id"), Login: c.Query("login")}
+	var err error
+	if from := c.Query("from"); from != "" {
+		query.From, err = time.Parse(time.RFC3339, from)
+	}
+	if to := c.Query("to"); to != "" && err == nil {
+		query.To, err = time.Parse(time.RFC3339, to)
+	}
+	if limit := c.Query("limit"); limit != "" && err == nil {
+		query.Limit, err = strconv.Atoi(limit)
+	}
+	if err != nil {
+		utils.Logger.Error("adminHandler:ListAuditEvents - parse query", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	events, err := a.audit.List(c, query)
+	if errors.Is(err, entities.ErrInvalidAuditQuery) {
+		utils.Logger.Error("adminHandler:ListAuditEvents - invalid query", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("adminHandler:ListAuditEvents - List", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+// ListDeadLetteredOrders shows the orders the accrual checks gave up on,
+// with the reason. limit caps the number of orders.
+func (a *adminHandler) ListDeadLetteredOrders(c *gin.Context) {
+	var limit int
+	var err error
+	if value := c.Query("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil {
+			utils.Logger.Error("adminHandler:ListDeadLetteredOrders - parse limit", zap.Error(err))
+			c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+			return
+		}
+	}
+
+	orders, err := a.deadLetters.ListDeadLettered(c, limit)
+	if errors.Is(err, entities.ErrInvalidOrderQuery) {
+		utils.Logger.Error("adminHandler:ListDeadLetteredOrders - invalid limit", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("adminHandler:ListDeadLetteredOrders - ListDeadLettered", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, orders)
+}
+
+// RequeueOrder puts a dead-lettered order back on the accrual queue.
+func (a *adminHandler) RequeueOrder(c *gin.Context) {
+	number := entities.OrderNumber(c.Param("number"))
+	err := a.deadLetters.Requeue(c, number)
+	if errors.Is(err, entities.ErrOrderNotDeadLettered) {
+		utils.Logger.Error("adminHandler:RequeueOrder - not dead-lettered", zap.Error(err))
+		c.JSON(http.StatusNotFound, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("adminHandler:RequeueOrder - Requeue", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	recordAudit(c, a.audit, entities.AuditOrderRequeued, adminID(c), map[string]string{"order": string(number)})
+	c.JSON(http.StatusOK, entities.ErrorResponse{Message: "Order requeued"})
+}
+
+func adminID(c *gin.Context) string {
+	userID, _ := c.Get("x-user-id")
+	return fmt.Sprintf("%v", userID)
+}
+
+func NewAdminHandler(
+	unlocker loginUnlocker, roles roleManager, deadLetters deadLetters, audit auditLog,
+) *adminHandler {
+	return &adminHandler{
+		unlocker:    unlocker,
+		roles:       roles,
+		deadLetters: deadLetters,
+		audit:       audit,
+	}
+}
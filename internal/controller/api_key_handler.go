@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+type apiKeyManager interface {
+	Create(ctx context.Context, userID string, request entities.CreateAPIKeyRequest) (entities.CreatedAPIKey, error)
+	List(ctx context.Context, userID string) ([]entities.APIKey, error)
+	Revoke(ctx context.Context, userID, keyID string) error
+}
+
+type apiKeyHandler struct {
+	manager apiKeyManager
+}
+
+func (a *apiKeyHandler) CreateKey(c *gin.Context) {
+	var request entities.CreateAPIKeyRequest
+	userID, isExtract := c.Get("x-user-id")
+	if !isExtract {
+		utils.Logger.Error("apiKeyHandler:CreateKey - extract userID", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-user-id"})
+		return
+	}
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		utils.Logger.Error("apiKeyHandler:CreateKey - request bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	key, err := a.manager.Create(c, fmt.Sprintf("%v", userID), request)
+	if errors.Is(err, entities.ErrInvalidScope) {
+		utils.Logger.Error("apiKeyHandler:CreateKey - invalid scope", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("apiKeyHandler:CreateKey - Create", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, key)
+}
+
+func (a *apiKeyHandler) ListKeys(c *gin.Context) {
+	userID, isExtract := c.Get("x-user-id")
+	if !isExtract {
+		utils.Logger.Error("apiKeyHandler:ListKeys - extract userID", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-user-id"})
+		return
+	}
+	keys, err := a.manager.List(c, fmt.Sprintf("%v", userID))
+	if err != nil {
+		utils.Logger.Error("apiKeyHandler:ListKeys - List", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+func (a *apiKeyHandler) RevokeKey(c *gin.Context) {
+	userID, isExtract := c.Get("x-user-id")
+	if !isExtract {
+		utils.Logger.Error("apiKeyHandler:RevokeKey - extract userID", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-user-id"})
+		return
+	}
+	err := a.manager.Revoke(c, fmt.Sprintf("%v", userID), c.Param("id"))
+	if errors.Is(err, entities.ErrAPIKeyNotFound) {
+		utils.Logger.Error("apiKeyHandler:RevokeKey - key not found", zap.Error(err))
+		c.JSON(http.StatusNotFound, entities.ErrorResponse{Message: "API key not found"})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("apiKeyHandler:RevokeKey - Revoke", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entities.ErrorResponse{Message: "API key revoked"})
+}
+
+func NewAPIKeyHandler(manager apiKeyManager) *apiKeyHandler {
+	return &apiKeyHandler{
+		manager: manager,
+	}
+}
@@ -0,0 +1,40 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+type auditRecorder interface {
+	Record(ctx context.Context, event entities.AuditEvent, payload interface{}) error
+}
+
+// recordAudit appends an event for the current request to the audit log. A
+// failure to record is logged but never fails the request itself.
+func recordAudit(c *gin.Context, audit auditRecorder, eventType, actorID string, payload interface{}) {
+	record(c, audit, entities.AuditEvent{Type: eventType, ActorID: actorID}, payload)
+}
+
+// recordLoginAudit records an event about a login, which need not belong to
+// an account, e.g. whatever was typed into a failed login. The auditor only
+// stores a pseudonym of it.
+func recordLoginAudit(c *gin.Context, audit auditRecorder, eventType, actorID, login, detail string) {
+	var payload interface{}
+	if detail != "" {
+		payload = map[string]string{"detail": detail}
+	}
+	record(c, audit, entities.AuditEvent{Type: eventType, ActorID: actorID, Login: login}, payload)
+}
+
+func record(c *gin.Context, audit auditRecorder, event entities.AuditEvent, payload interface{}) {
+	event.IP = c.ClientIP()
+	event.RequestID = c.GetString("x-request-id")
+	if err := audit.Record(c, event, payload); err != nil {
+		utils.Logger.Error("recordAudit - Record", zap.String("type", event.Type), zap.Error(err))
+	}
+}
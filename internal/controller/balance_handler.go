@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
@@ -21,6 +20,7 @@ type balanceProcessor interface {
 }
 type balanceHandler struct {
 	processor balanceProcessor
+	audit     auditRecorder
 }
 
 func (b *balanceHandler) GetBalance(c *gin.Context) {
@@ -53,19 +53,18 @@ func (b *balanceHandler) Withdraw(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
 		return
 	}
-	orderNumber, err := strconv.Atoi(request.Order)
-	if err != nil {
-		utils.Logger.Error("balanceHandler:Withdraw - convert order from string to int", zap.Error(err))
-		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+	orderNumber, err := utils.ParseOrderNumber(string(request.Order))
+	if errors.Is(err, entities.ErrInvalidOrderNumber) {
+		utils.Logger.Error("balanceHandler:Withdraw - Luhn check failed", zap.String("order", string(request.Order)))
+		c.JSON(http.StatusUnprocessableEntity, entities.ErrorResponse{Message: "Wrong order number"})
 		return
 	}
-	if !utils.LuhnValid(orderNumber) {
-		utils.Logger.Error(
-			"balanceHandler:Withdraw - Luhn check failed", zap.Int("orderNumber", orderNumber),
-		)
-		c.JSON(http.StatusUnprocessableEntity, entities.ErrorResponse{Message: "Wrong order number"})
+	if err != nil {
+		utils.Logger.Error("balanceHandler:Withdraw - parse order number", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
 		return
 	}
+	request.Order = orderNumber
 
 	err = b.processor.Withdraw(c, fmt.Sprintf("%v", userID), request)
 	if errors.Is(err, entities.ErrInsufficientFunds) {
@@ -78,6 +77,7 @@ func (b *balanceHandler) Withdraw(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
 		return
 	}
+	recordAudit(c, b.audit, entities.AuditBalanceWithdrawn, fmt.Sprintf("%v", userID), request)
 }
 
 func (b *balanceHandler) GetWithdrawn(c *gin.Context) {
@@ -101,8 +101,9 @@ func (b *balanceHandler) GetWithdrawn(c *gin.Context) {
 	c.JSON(http.StatusOK, withdrawals)
 }
 
-func NewBalanceHandler(processor balanceProcessor) *balanceHandler {
+func NewBalanceHandler(processor balanceProcessor, audit auditRecorder) *balanceHandler {
 	return &balanceHandler{
 		processor: processor,
+		audit:     audit,
 	}
 }
@@ -0,0 +1,37 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+type publicKeys interface {
+	JSONWebKeySet() (entities.JSONWebKeySet, error)
+}
+
+type jwksHandler struct {
+	keys publicKeys
+}
+
+func (j *jwksHandler) GetKeys(c *gin.Context) {
+	keySet, err := j.keys.JSONWebKeySet()
+	if err != nil {
+		utils.Logger.Error("jwksHandler:GetKeys - JSONWebKeySet", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(entities.JWKSMaxAge.Seconds())))
+	c.JSON(http.StatusOK, keySet)
+}
+
+func NewJwksHandler(keys publicKeys) *jwksHandler {
+	return &jwksHandler{
+		keys: keys,
+	}
+}
@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+type mfaManager interface {
+	Enroll(ctx context.Context, userID, login string) (entities.TOTPEnrollment, error)
+	Confirm(ctx context.Context, userID, code string) ([]string, error)
+	Verify(ctx context.Context, userID string, request entities.MFACodeRequest) error
+	Disable(ctx context.Context, userID string, request entities.MFACodeRequest) error
+}
+
+type mfaHandler struct {
+	manager mfaManager
+	guard   userGuard
+}
+
+func (m *mfaHandler) Enroll(c *gin.Context) {
+	claims, isExtract := c.Get("x-claims")
+	if !isExtract {
+		utils.Logger.Error("mfaHandler:Enroll - extract claims", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-claims"})
+		return
+	}
+	userClaims := claims.(entities.JwtCustomClaims)
+
+	enrollment, err := m.manager.Enroll(c, userClaims.ID, userClaims.Name)
+	if errors.Is(err, entities.ErrMFAAlreadyEnabled) {
+		utils.Logger.Error("mfaHandler:Enroll - already enabled", zap.Error(err))
+		c.JSON(http.StatusConflict, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if errors.Is(err, entities.ErrMFAUnavailable) {
+		utils.Logger.Error("mfaHandler:Enroll - MFA unavailable", zap.Error(err))
+		c.JSON(http.StatusServiceUnavailable, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("mfaHandler:Enroll - Enroll", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, enrollment)
+}
+
+func (m *mfaHandler) Confirm(c *gin.Context) {
+	var request entities.MFACodeRequest
+	userID, isExtract := c.Get("x-user-id")
+	if !isExtract {
+		utils.Logger.Error("mfaHandler:Confirm - extract userID", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-user-id"})
+		return
+	}
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		utils.Logger.Error("mfaHandler:Confirm - request bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	if !allowUserAttempt(c, m.guard, "mfaHandler:Confirm", fmt.Sprintf("%v", userID)) {
+		return
+	}
+	recoveryCodes, err := m.manager.Confirm(c, fmt.Sprintf("%v", userID), request.Code)
+	if err != nil {
+		respondMFAError(c, "mfaHandler:Confirm", err)
+		return
+	}
+	registerUserSuccess(c, m.guard, "mfaHandler:Confirm", fmt.Sprintf("%v", userID))
+	c.JSON(http.StatusOK, entities.RecoveryCodesResponse{RecoveryCodes: recoveryCodes})
+}
+
+func (m *mfaHandler) Disable(c *gin.Context) {
+	var request entities.MFACodeRequest
+	userID, isExtract := c.Get("x-user-id")
+	if !isExtract {
+		utils.Logger.Error("mfaHandler:Disable - extract userID", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-user-id"})
+		return
+	}
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		utils.Logger.Error("mfaHandler:Disable - request bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	if !allowUserAttempt(c, m.guard, "mfaHandler:Disable", fmt.Sprintf("%v", userID)) {
+		return
+	}
+	err = m.manager.Disable(c, fmt.Sprintf("%v", userID), request)
+	if err != nil {
+		respondMFAError(c, "mfaHandler:Disable", err)
+		return
+	}
+	registerUserSuccess(c, m.guard, "mfaHandler:Disable", fmt.Sprintf("%v", userID))
+	c.JSON(http.StatusOK, entities.ErrorResponse{Message: "Two-factor authentication disabled"})
+}
+
+// respondMFAError maps errors of code checks shared by the MFA endpoints.
+func respondMFAError(c *gin.Context, method string, err error) {
+	switch {
+	case errors.Is(err, entities.ErrInvalidMFACode):
+		utils.Logger.Error(method+" - invalid code", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, entities.ErrorResponse{Message: err.Error()})
+	case errors.Is(err, entities.ErrMFANotEnrolled):
+		utils.Logger.Error(method+" - not enrolled", zap.Error(err))
+		c.JSON(http.StatusConflict, entities.ErrorResponse{Message: err.Error()})
+	case errors.Is(err, entities.ErrMFAAlreadyEnabled):
+		utils.Logger.Error(method+" - already enabled", zap.Error(err))
+		c.JSON(http.StatusConflict, entities.ErrorResponse{Message: err.Error()})
+	case errors.Is(err, entities.ErrMFAUnavailable):
+		utils.Logger.Error(method+" - MFA unavailable", zap.Error(err))
+		c.JSON(http.StatusServiceUnavailable, entities.ErrorResponse{Message: err.Error()})
+	default:
+		utils.Logger.Error(method+" - check code", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+	}
+}
+
+func NewMFAHandler(manager mfaManager, guard userGuard) *mfaHandler {
+	return &mfaHandler{
+		manager: manager,
+		guard:   guard,
+	}
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+type oidcLogin interface {
+	Begin(ctx context.Context) (entities.OIDCAuthorization, error)
+	Complete(ctx context.Context, state, browserState, code string) (entities.User, error)
+}
+
+const (
+	// oidcStateCookie binds a login to the browser that started it.
+	oidcStateCookie     = "oidc_state"
+	oidcStateCookiePath = "/api/user/oidc"
+)
+
+type oidcHandler struct {
+	login oidcLogin
+	auth  userAuthenticator
+	audit auditRecorder
+}
+
+func (o *oidcHandler) Login(c *gin.Context) {
+	authorization, err := o.login.Begin(c)
+	if err != nil {
+		utils.Logger.Error("oidcHandler:Login - Begin", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	// Lax, since the provider sends the browser back with a top-level GET.
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(
+		oidcStateCookie, authorization.State, int(time.Until(authorization.ExpiresAt).Seconds()),
+		oidcStateCookiePath, "", isHTTPS(c), true,
+	)
+	c.Redirect(http.StatusFound, authorization.RedirectURL)
+}
+
+// isHTTPS reports whether the client reached us over TLS, directly or
+// through a proxy.
+func isHTTPS(c *gin.Context) bool {
+	return c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+}
+
+// Callback is where the provider sends the user back to. It answers like
+// the password login: the access token in the Authorization header and the
+// refresh token in the body, or an MFA token for users with two-factor
+// authentication.
+func (o *oidcHandler) Callback(c *gin.Context) {
+	if providerErr := c.Query("error"); providerErr != "" {
+		utils.Logger.Error("oidcHandler:Callback - provider error", zap.String("error", providerErr))
+		c.JSON(http.StatusUnauthorized, entities.ErrorResponse{Message: "Login at the identity provider failed"})
+		return
+	}
+
+	browserState, _ := c.Cookie(oidcStateCookie)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, "", -1, oidcStateCookiePath, "", isHTTPS(c), true)
+
+	user, err := o.login.Complete(c, c.Query("state"), browserState, c.Query("code"))
+	if errors.Is(err, entities.ErrInvalidOIDCState) {
+		utils.Logger.Error("oidcHandler:Callback - invalid state", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if errors.Is(err, entities.ErrOIDCLoginFailed) {
+		utils.Logger.Error("oidcHandler:Callback - login failed", zap.Error(err))
+		recordAudit(c, o.audit, entities.AuditLoginFailed, "", map[string]string{"detail": "oidc"})
+		c.JSON(http.StatusUnauthorized, entities.ErrorResponse{Message: entities.ErrOIDCLoginFailed.Error()})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("oidcHandler:Callback - Complete", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	// The provider only stands in for the password; the second factor is
+	// still asked for, exactly as after a password login.
+	if user.TOTPEnabled {
+		mfaToken, err := o.auth.CreateMFAToken(user)
+		if err != nil {
+			utils.Logger.Error("oidcHandler:Callback - CreateMFAToken", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, entities.MFAChallengeResponse{Message: "Second factor required", MFAToken: mfaToken})
+		return
+	}
+
+	sessionID, err := o.auth.StartSession(c, user, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		utils.Logger.Error("oidcHandler:Callback - StartSession", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	accessToken, err := o.auth.CreateAccessToken(user, sessionID)
+	if err != nil {
+		utils.Logger.Error("oidcHandler:Callback - CreateAccessToken", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	refreshToken, err := o.auth.CreateRefreshToken(c, user, sessionID)
+	if err != nil {
+		utils.Logger.Error("oidcHandler:Callback - CreateRefreshToken", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	recordLoginAudit(c, o.audit, entities.AuditLoginSucceeded, user.ID, user.Login, "oidc")
+	c.Header("Authorization", accessToken)
+	c.JSON(http.StatusOK, entities.TokenResponse{Message: "User logged in", RefreshToken: refreshToken})
+}
+
+func NewOIDCHandler(login oidcLogin, auth userAuthenticator, audit auditRecorder) *oidcHandler {
+	return &oidcHandler{
+		login: login,
+		auth:  auth,
+		audit: audit,
+	}
+}
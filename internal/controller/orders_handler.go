@@ -7,6 +7,8 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
@@ -16,13 +18,30 @@ import (
 )
 
 type ordersProcessor interface {
-	CheckOrderExist(ctx context.Context, order int, userFromRequest string) error
-	RegisterOrder(ctx context.Context, order int, userID string) error
-	GetUserOrder(ctx context.Context, userID string) ([]entities.OrderWithTime, error)
+	RegisterOrder(ctx context.Context, order entities.OrderNumber, userID string) error
+	RegisterBatch(ctx context.Context, userID string, items []entities.BatchOrderItem) (entities.BatchOrderReport, error)
+	ListOrders(
+		ctx context.Context, userID string, query entities.OrderListQuery, cursor string,
+	) (entities.OrderPage, error)
+	GetOrder(ctx context.Context, userID string, number entities.OrderNumber) (entities.OrderDetail, error)
+}
+
+const (
+	maxBatchBodySize = 10 << 20
+	maxBatchItems    = 10000
+)
+
+// batchFormats maps the accepted bulk upload content types to formats.
+var batchFormats = map[string]string{
+	"application/json":     utils.BatchFormatJSON,
+	"text/csv":             utils.BatchFormatCSV,
+	"application/x-ndjson": utils.BatchFormatNDJSON,
+	"application/ndjson":   utils.BatchFormatNDJSON,
 }
 
 type ordersHandler struct {
 	processor ordersProcessor
+	audit     auditRecorder
 }
 
 func (o *ordersHandler) CreateOrder(c *gin.Context) {
@@ -32,15 +51,15 @@ func (o *ordersHandler) CreateOrder(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
 		return
 	}
-	order, err := strconv.Atoi(string(orderNumber))
-	if err != nil {
-		utils.Logger.Error("ordersHandler:CreateOrder - convert order to int", zap.Error(err))
-		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+	order, err := utils.ParseOrderNumber(string(orderNumber))
+	if errors.Is(err, entities.ErrInvalidOrderNumber) {
+		utils.Logger.Error("ordersHandler:CreateOrder - Luhn validation", zap.String("order", string(orderNumber)))
+		c.JSON(http.StatusUnprocessableEntity, entities.ErrorResponse{Message: "Invalid orders number"})
 		return
 	}
-	if !utils.LuhnValid(order) {
-		utils.Logger.Error("ordersHandler:CreateOrder - Luhn validation", zap.Int("order", order))
-		c.JSON(http.StatusUnprocessableEntity, entities.ErrorResponse{Message: "Invalid orders number"})
+	if err != nil {
+		utils.Logger.Error("ordersHandler:CreateOrder - parse order number", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
 		return
 	}
 	userID, isExtract := c.Get("x-user-id")
@@ -49,15 +68,11 @@ func (o *ordersHandler) CreateOrder(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-user-id"})
 		return
 	}
-	err = o.processor.CheckOrderExist(c, order, fmt.Sprintf("%v", userID))
+	err = o.processor.RegisterOrder(c, order, fmt.Sprintf("%v", userID))
 	switch err {
-	case entities.ErrNoOrderForUser:
-		err = o.processor.RegisterOrder(c, order, fmt.Sprintf("%v", userID))
-		if err != nil {
-			utils.Logger.Error("ordersHandler:CreateOrder - register order", zap.Error(err))
-			c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
-			return
-		}
+	case nil:
+		recordAudit(c, o.audit, entities.AuditOrderUploaded, fmt.Sprintf("%v", userID),
+			map[string]string{"order": string(order)})
 		c.JSON(http.StatusAccepted, entities.ErrorResponse{Message: "Order added"})
 		return
 	case entities.ErrOrderAlreadyCreatedByThisUser:
@@ -69,13 +84,60 @@ func (o *ordersHandler) CreateOrder(c *gin.Context) {
 		c.JSON(http.StatusConflict, entities.ErrorResponse{Message: "Order already registered by another user"})
 		return
 	default:
-		utils.Logger.Error("ordersHandler:CreateOrder - check order exist", zap.Error(err))
+		utils.Logger.Error("ordersHandler:CreateOrder - register order", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
 		return
 	}
+}
+
+// CreateOrdersBatch registers a bulk upload. The format follows the content
+// type; the response reports the outcome of every line.
+func (o *ordersHandler) CreateOrdersBatch(c *gin.Context) {
+	format, ok := batchFormats[c.ContentType()]
+	if !ok {
+		utils.Logger.Error("ordersHandler:CreateOrdersBatch - unsupported content type",
+			zap.String("contentType", c.ContentType()))
+		c.JSON(http.StatusUnsupportedMediaType, entities.ErrorResponse{
+			Message: "Content type must be application/json, text/csv or application/x-ndjson",
+		})
+		return
+	}
+	userID, isExtract := c.Get("x-user-id")
+	if !isExtract {
+		utils.Logger.Error("ordersHandler:CreateOrdersBatch - extract userID", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-user-id"})
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBodySize)
+	items, err := utils.ParseOrderBatch(format, body, maxBatchItems)
+	if errors.Is(err, entities.ErrBatchTooLarge) {
+		utils.Logger.Error("ordersHandler:CreateOrdersBatch - batch too large", zap.Error(err))
+		c.JSON(http.StatusRequestEntityTooLarge, entities.ErrorResponse{Message: entities.ErrBatchTooLarge.Error()})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("ordersHandler:CreateOrdersBatch - parse batch", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
 
+	report, err := o.processor.RegisterBatch(c, fmt.Sprintf("%v", userID), items)
+	if err != nil {
+		utils.Logger.Error("ordersHandler:CreateOrdersBatch - RegisterBatch", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if report.Accepted > 0 {
+		recordAudit(c, o.audit, entities.AuditOrderUploaded, fmt.Sprintf("%v", userID),
+			map[string]int{"batch_lines": len(items), "accepted": report.Accepted})
+	}
+	c.JSON(http.StatusOK, report)
 }
 
+// GetOrders lists the user's orders a page at a time. It takes status (one
+// or more, comma separated), from and to as RFC 3339 times, sort (asc or
+// desc), limit and cursor. The next page is linked in the Link header.
 func (o *ordersHandler) GetOrders(c *gin.Context) {
 	userID, isExtract := c.Get("x-user-id")
 	if !isExtract {
@@ -83,22 +145,107 @@ func (o *ordersHandler) GetOrders(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-user-id"})
 		return
 	}
-	orders, err := o.processor.GetUserOrder(c, fmt.Sprintf("%v", userID))
+	query, err := parseOrderListQuery(c)
+	if err != nil {
+		utils.Logger.Error("ordersHandler:GetOrders - parse query", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	page, err := o.processor.ListOrders(c, fmt.Sprintf("%v", userID), query, c.Query("cursor"))
+	if errors.Is(err, entities.ErrInvalidOrderQuery) {
+		utils.Logger.Error("ordersHandler:GetOrders - invalid query", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
 	if errors.Is(err, entities.ErrNoOrderForUser) {
 		utils.Logger.Error("ordersHandler:GetOrders - no orders for user", zap.Error(err))
 		c.JSON(http.StatusNoContent, entities.ErrorResponse{Message: "No orders for this user"})
 		return
 	}
 	if err != nil {
-		utils.Logger.Error("ordersHandler:GetOrders - GetUserOrder", zap.Error(err))
+		utils.Logger.Error("ordersHandler:GetOrders - ListOrders", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if page.NextCursor != "" {
+		next := *c.Request.URL
+		values := next.Query()
+		values.Set("cursor", page.NextCursor)
+		next.RawQuery = values.Encode()
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+	c.JSON(http.StatusOK, page.Orders)
+}
+
+// GetOrder returns the current state of one order and its status timeline.
+func (o *ordersHandler) GetOrder(c *gin.Context) {
+	userID, isExtract := c.Get("x-user-id")
+	if !isExtract {
+		utils.Logger.Error("ordersHandler:GetOrder - extract userID", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-user-id"})
+		return
+	}
+	number, err := utils.ParseOrderNumber(c.Param("number"))
+	if err != nil {
+		utils.Logger.Error("ordersHandler:GetOrder - parse order number", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	order, err := o.processor.GetOrder(c, fmt.Sprintf("%v", userID), number)
+	if errors.Is(err, entities.ErrOrderNotFound) {
+		utils.Logger.Error("ordersHandler:GetOrder - order not found", zap.Error(err))
+		c.JSON(http.StatusNotFound, entities.ErrorResponse{Message: "Order not found"})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("ordersHandler:GetOrder - GetOrder", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, orders)
+	c.JSON(http.StatusOK, order)
+}
+
+func parseOrderListQuery(c *gin.Context) (entities.OrderListQuery, error) {
+	var query entities.OrderListQuery
+	var err error
+
+	for _, statuses := range c.QueryArray("status") {
+		for _, status := range strings.Split(statuses, ",") {
+			if status = strings.ToUpper(strings.TrimSpace(status)); status != "" {
+				query.Statuses = append(query.Statuses, entities.OrderStatus(status))
+			}
+		}
+	}
+	if from := c.Query("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return query, err
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return query, err
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return query, err
+		}
+	}
+	switch c.DefaultQuery("sort", "asc") {
+	case "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, fmt.Errorf("%w: sort must be asc or desc", entities.ErrInvalidOrderQuery)
+	}
+	return query, nil
 }
 
-func NewOrdersHandler(processor ordersProcessor) *ordersHandler {
+func NewOrdersHandler(processor ordersProcessor, audit auditRecorder) *ordersHandler {
 	return &ordersHandler{
 		processor: processor,
+		audit:     audit,
 	}
 }
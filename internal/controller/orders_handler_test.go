@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+func TestCreateOrdersBatchLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	utils.Logger = zap.NewNop()
+	// The body is refused before anything reaches the processor.
+	handler := NewOrdersHandler(nil, nil)
+
+	// Enough lines to go past maxBatchBodySize, each on its own a valid
+	// order number.
+	lines := maxBatchBodySize/len("12345678903\n") + 1
+	tests := []struct {
+		name         string
+		contentType  string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "CreateOrdersBatch: JSON over 10 MiB",
+			contentType:  "application/json",
+			body:         "[" + strings.Repeat(`"12345678903",`, lines) + `"12345678903"]`,
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:         "CreateOrdersBatch: CSV over 10 MiB",
+			contentType:  "text/csv",
+			body:         strings.Repeat("12345678903\n", lines),
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:         "CreateOrdersBatch: NDJSON over 10 MiB",
+			contentType:  "application/x-ndjson",
+			body:         strings.Repeat("12345678903\n", lines),
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:         "CreateOrdersBatch: too many items",
+			contentType:  "text/csv",
+			body:         strings.Repeat("12345678903\n", maxBatchItems+1),
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:         "CreateOrdersBatch: malformed JSON",
+			contentType:  "application/json",
+			body:         `["12345678903"`,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/user/orders/batch", bytes.NewBufferString(tt.body))
+			c.Request.Header.Set("Content-Type", tt.contentType)
+			c.Set("x-user-id", "123456")
+
+			handler.CreateOrdersBatch(c)
+			assert.Equal(t, tt.expectedCode, recorder.Code)
+		})
+	}
+}
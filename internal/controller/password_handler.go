@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+type passwordManager interface {
+	ChangePassword(ctx context.Context, userID, oldPassword, newPassword string) error
+	RequestReset(ctx context.Context, login, ip string) (time.Duration, error)
+	ResetPassword(ctx context.Context, token, newPassword string) error
+}
+
+type passwordHandler struct {
+	manager passwordManager
+	guard   userGuard
+}
+
+func (p *passwordHandler) ChangePassword(c *gin.Context) {
+	var request entities.ChangePasswordRequest
+	userID, isExtract := c.Get("x-user-id")
+	if !isExtract {
+		utils.Logger.Error("passwordHandler:ChangePassword - extract userID", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-user-id"})
+		return
+	}
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		utils.Logger.Error("passwordHandler:ChangePassword - request bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	// A stolen session must not be a way around the login throttling for
+	// guessing the password.
+	if !allowUserAttempt(c, p.guard, "passwordHandler:ChangePassword", fmt.Sprintf("%v", userID)) {
+		return
+	}
+	err = p.manager.ChangePassword(c, fmt.Sprintf("%v", userID), request.OldPassword, request.NewPassword)
+	if errors.Is(err, entities.ErrInvalidPassword) {
+		utils.Logger.Error("passwordHandler:ChangePassword - invalid new password", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if errors.Is(err, entities.ErrInvalidCredentials) {
+		utils.Logger.Error("passwordHandler:ChangePassword - wrong old password", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, entities.ErrorResponse{Message: "Invalid password"})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("passwordHandler:ChangePassword - ChangePassword", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	registerUserSuccess(c, p.guard, "passwordHandler:ChangePassword", fmt.Sprintf("%v", userID))
+	c.JSON(http.StatusOK, entities.ErrorResponse{Message: "Password changed, please log in again"})
+}
+
+func (p *passwordHandler) RequestReset(c *gin.Context) {
+	var request entities.PasswordResetRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		utils.Logger.Error("passwordHandler:RequestReset - request bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	retryAfter, err := p.manager.RequestReset(c, request.Login, c.ClientIP())
+	if errors.Is(err, entities.ErrTooManyResetRequests) {
+		utils.Logger.Error("passwordHandler:RequestReset - throttled", zap.Error(err))
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, entities.ErrorResponse{Message: "Too many password reset requests"})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("passwordHandler:RequestReset - RequestReset", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	// Same answer whether the login exists or not.
+	c.JSON(http.StatusAccepted, entities.ErrorResponse{Message: "If the account exists, a reset token has been sent"})
+}
+
+func (p *passwordHandler) ResetPassword(c *gin.Context) {
+	var request entities.SetPasswordRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		utils.Logger.Error("passwordHandler:ResetPassword - request bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	err = p.manager.ResetPassword(c, request.Token, request.NewPassword)
+	if errors.Is(err, entities.ErrInvalidPassword) {
+		utils.Logger.Error("passwordHandler:ResetPassword - invalid new password", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	if errors.Is(err, entities.ErrInvalidResetToken) {
+		utils.Logger.Error("passwordHandler:ResetPassword - invalid token", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, entities.ErrorResponse{Message: "Invalid or expired reset token"})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("passwordHandler:ResetPassword - ResetPassword", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entities.ErrorResponse{Message: "Password changed"})
+}
+
+func NewPasswordHandler(manager passwordManager, guard userGuard) *passwordHandler {
+	return &passwordHandler{
+		manager: manager,
+		guard:   guard,
+	}
+}
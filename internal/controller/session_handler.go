@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+type sessionManager interface {
+	List(ctx context.Context, userID, currentSessionID string) ([]entities.Session, error)
+	Terminate(ctx context.Context, userID, sessionID string) error
+}
+
+type sessionHandler struct {
+	manager sessionManager
+}
+
+func (s *sessionHandler) ListSessions(c *gin.Context) {
+	claims, isExtract := c.Get("x-claims")
+	if !isExtract {
+		utils.Logger.Error("sessionHandler:ListSessions - extract claims", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-claims"})
+		return
+	}
+	userClaims := claims.(entities.JwtCustomClaims)
+
+	sessions, err := s.manager.List(c, userClaims.ID, userClaims.SessionID)
+	if err != nil {
+		utils.Logger.Error("sessionHandler:ListSessions - List", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sessions)
+}
+
+func (s *sessionHandler) TerminateSession(c *gin.Context) {
+	claims, isExtract := c.Get("x-claims")
+	if !isExtract {
+		utils.Logger.Error("sessionHandler:TerminateSession - extract claims", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-claims"})
+		return
+	}
+	userClaims := claims.(entities.JwtCustomClaims)
+
+	err := s.manager.Terminate(c, userClaims.ID, c.Param("id"))
+	if errors.Is(err, entities.ErrSessionNotFound) {
+		utils.Logger.Error("sessionHandler:TerminateSession - session not found", zap.Error(err))
+		c.JSON(http.StatusNotFound, entities.ErrorResponse{Message: "Session not found"})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("sessionHandler:TerminateSession - Terminate", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entities.ErrorResponse{Message: "Session terminated"})
+}
+
+func NewSessionHandler(manager sessionManager) *sessionHandler {
+	return &sessionHandler{
+		manager: manager,
+	}
+}
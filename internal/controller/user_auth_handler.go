@@ -3,7 +3,10 @@ package controller
 import (
 	"context"
 	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -16,11 +19,36 @@ import (
 type userAuthenticator interface {
 	Register(ctx context.Context, user entities.User) error
 	Auth(ctx context.Context, login, password string) (entities.User, error)
-	CreateAccessToken(user entities.User) (string, error)
+	StartSession(ctx context.Context, user entities.User, userAgent, ip string) (string, error)
+	CreateAccessToken(user entities.User, sessionID string) (string, error)
+	CreateMFAToken(user entities.User) (string, error)
+	ParseMFAToken(token string) (entities.MFAToken, error)
+	ConsumeMFAToken(ctx context.Context, token entities.MFAToken) error
+	CreateRefreshToken(ctx context.Context, user entities.User, sessionID string) (string, error)
+	Refresh(ctx context.Context, refreshToken string) (entities.User, string, string, error)
+	Logout(ctx context.Context, claims entities.JwtCustomClaims, refreshToken string) error
+}
+
+type userGuard interface {
+	CheckUser(ctx context.Context, userID string) (time.Duration, error)
+	RegisterUserSuccess(ctx context.Context, userID string) error
+}
+
+type loginGuard interface {
+	userGuard
+	Check(ctx context.Context, login, ip string) (time.Duration, error)
+	RegisterSuccess(ctx context.Context, login, ip string) error
+}
+
+type mfaVerifier interface {
+	Verify(ctx context.Context, userID string, request entities.MFACodeRequest) error
 }
 
 type userAuthHandler struct {
-	auth userAuthenticator
+	auth  userAuthenticator
+	guard loginGuard
+	mfa   mfaVerifier
+	audit auditRecorder
 }
 
 func (u *userAuthHandler) Register(c *gin.Context) {
@@ -36,9 +64,15 @@ func (u *userAuthHandler) Register(c *gin.Context) {
 		ID:       uuid.New().String(),
 		Login:    request.Login,
 		Password: request.Password,
+		Email:    request.Email,
 	}
 
 	err = u.auth.Register(c, user)
+	if errors.Is(err, entities.ErrInvalidLogin) {
+		utils.Logger.Error("userAuthHandler:Register - invalid login", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
 	if errors.Is(err, entities.ErrLoginAlreadyInUse) {
 		utils.Logger.Error("userAuthHandler:Register - login already in use", zap.Error(err))
 		c.JSON(http.StatusConflict, entities.ErrorResponse{Message: "User already exists with the given login"})
@@ -50,14 +84,27 @@ func (u *userAuthHandler) Register(c *gin.Context) {
 		return
 	}
 
-	accessToken, err := u.auth.CreateAccessToken(user)
+	sessionID, err := u.auth.StartSession(c, user, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:Register - StartSession", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	accessToken, err := u.auth.CreateAccessToken(user, sessionID)
 	if err != nil {
 		utils.Logger.Error("userAuthHandler:Register - CreateAccessToken ", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
 		return
 	}
+	refreshToken, err := u.auth.CreateRefreshToken(c, user, sessionID)
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:Register - CreateRefreshToken ", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	recordLoginAudit(c, u.audit, entities.AuditUserRegistered, user.ID, user.Login, "")
 	c.Header("Authorization", accessToken)
-	c.JSON(http.StatusOK, entities.ErrorResponse{Message: "User registered"})
+	c.JSON(http.StatusOK, entities.TokenResponse{Message: "User registered", RefreshToken: refreshToken})
 }
 
 func (u *userAuthHandler) Login(c *gin.Context) {
@@ -69,9 +116,24 @@ func (u *userAuthHandler) Login(c *gin.Context) {
 		return
 	}
 
+	retryAfter, err := u.guard.Check(c, request.Login, c.ClientIP())
+	if errors.Is(err, entities.ErrTooManyLoginAttempts) {
+		utils.Logger.Error("userAuthHandler:Login - login throttled", zap.Error(err))
+		recordLoginAudit(c, u.audit, entities.AuditLoginFailed, "", request.Login, "throttled")
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, entities.ErrorResponse{Message: "Too many failed login attempts"})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:Login - check login attempts", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
 	user, err := u.auth.Auth(c, request.Login, request.Password)
 	if errors.Is(err, entities.ErrInvalidCredentials) {
 		utils.Logger.Error("userAuthHandler:Login - wrong credentials", zap.Error(err))
+		recordLoginAudit(c, u.audit, entities.AuditLoginFailed, "", request.Login, "invalid_credentials")
 		c.JSON(http.StatusUnauthorized, entities.ErrorResponse{Message: "Invalid login or password"})
 		return
 	}
@@ -80,19 +142,226 @@ func (u *userAuthHandler) Login(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
 		return
 	}
+	// Check has counted the attempt already. With a second factor the
+	// failed attempts are kept until the code is checked too; LoginMFA
+	// counts the codes per user without counting the IP a second time.
+	if user.TOTPEnabled {
+		mfaToken, err := u.auth.CreateMFAToken(user)
+		if err != nil {
+			utils.Logger.Error("userAuthHandler:Login - CreateMFAToken", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, entities.MFAChallengeResponse{Message: "Second factor required", MFAToken: mfaToken})
+		return
+	}
+	if err = u.guard.RegisterSuccess(c, request.Login, c.ClientIP()); err != nil {
+		utils.Logger.Error("userAuthHandler:Login - reset failed attempts", zap.Error(err))
+	}
 
-	accessToken, err := u.auth.CreateAccessToken(user)
+	sessionID, err := u.auth.StartSession(c, user, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:Login - StartSession", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	accessToken, err := u.auth.CreateAccessToken(user, sessionID)
 	if err != nil {
 		utils.Logger.Error("userAuthHandler:Login - CreateAccessToken", zap.Error(err))
 		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
 		return
 	}
+	refreshToken, err := u.auth.CreateRefreshToken(c, user, sessionID)
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:Login - CreateRefreshToken", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	recordLoginAudit(c, u.audit, entities.AuditLoginSucceeded, user.ID, user.Login, "password")
 	c.Header("Authorization", accessToken)
-	c.JSON(http.StatusOK, entities.ErrorResponse{Message: "User registered"})
+	c.JSON(http.StatusOK, entities.TokenResponse{Message: "User registered", RefreshToken: refreshToken})
+}
+
+// LoginMFA is the second login step for users with two-factor
+// authentication. It exchanges the MFA token from Login and a valid code for
+// access and refresh tokens.
+func (u *userAuthHandler) LoginMFA(c *gin.Context) {
+	var request entities.MFALoginRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:LoginMFA - request bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	mfaToken, err := u.auth.ParseMFAToken(request.MFAToken)
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:LoginMFA - invalid MFA token", zap.Error(err))
+		c.JSON(http.StatusUnauthorized, entities.ErrorResponse{Message: "Invalid or expired MFA token"})
+		return
+	}
+	user := mfaToken.User
+
+	retryAfter, err := u.guard.CheckUser(c, user.ID)
+	if errors.Is(err, entities.ErrTooManyLoginAttempts) {
+		utils.Logger.Error("userAuthHandler:LoginMFA - login throttled", zap.Error(err))
+		recordLoginAudit(c, u.audit, entities.AuditLoginFailed, user.ID, user.Login, "throttled")
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, entities.ErrorResponse{Message: "Too many failed login attempts"})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:LoginMFA - check login attempts", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	err = u.mfa.Verify(c, user.ID, request.MFACodeRequest)
+	if errors.Is(err, entities.ErrInvalidMFACode) {
+		utils.Logger.Error("userAuthHandler:LoginMFA - wrong code", zap.Error(err))
+		recordLoginAudit(c, u.audit, entities.AuditLoginFailed, user.ID, user.Login, "invalid_mfa_code")
+		c.JSON(http.StatusUnauthorized, entities.ErrorResponse{Message: "Invalid code"})
+		return
+	}
+	if err != nil {
+		respondMFAError(c, "userAuthHandler:LoginMFA", err)
+		return
+	}
+	err = u.auth.ConsumeMFAToken(c, mfaToken)
+	if errors.Is(err, entities.ErrInvalidMFAToken) {
+		utils.Logger.Error("userAuthHandler:LoginMFA - MFA token reused", zap.Error(err))
+		recordLoginAudit(c, u.audit, entities.AuditLoginFailed, user.ID, user.Login, "mfa_token_reused")
+		c.JSON(http.StatusUnauthorized, entities.ErrorResponse{Message: "Invalid or expired MFA token"})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:LoginMFA - ConsumeMFAToken", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	// The password step counted the login and the IP once; both are
+	// settled here, together with the codes.
+	registerUserSuccess(c, u.guard, "userAuthHandler:LoginMFA", user.ID)
+	if err = u.guard.RegisterSuccess(c, user.Login, c.ClientIP()); err != nil {
+		utils.Logger.Error("userAuthHandler:LoginMFA - reset failed attempts", zap.Error(err))
+	}
+
+	sessionID, err := u.auth.StartSession(c, user, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:LoginMFA - StartSession", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	accessToken, err := u.auth.CreateAccessToken(user, sessionID)
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:LoginMFA - CreateAccessToken", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	refreshToken, err := u.auth.CreateRefreshToken(c, user, sessionID)
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:LoginMFA - CreateRefreshToken", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	recordLoginAudit(c, u.audit, entities.AuditLoginSucceeded, user.ID, user.Login, "mfa")
+	c.Header("Authorization", accessToken)
+	c.JSON(http.StatusOK, entities.TokenResponse{Message: "User logged in", RefreshToken: refreshToken})
+}
+
+func (u *userAuthHandler) Refresh(c *gin.Context) {
+	var request entities.RefreshRequest
+	err := c.ShouldBindJSON(&request)
+	if err != nil || request.RefreshToken == "" {
+		utils.Logger.Error("userAuthHandler:Refresh - request bind JSON", zap.Error(err))
+		c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: "refresh_token is required"})
+		return
+	}
+
+	user, sessionID, refreshToken, err := u.auth.Refresh(c, request.RefreshToken)
+	if errors.Is(err, entities.ErrInvalidRefreshToken) || errors.Is(err, entities.ErrRefreshTokenReused) {
+		utils.Logger.Error("userAuthHandler:Refresh - invalid refresh token", zap.Error(err))
+		recordAudit(c, u.audit, entities.AuditRefreshFailed, "", map[string]string{"reason": err.Error()})
+		c.JSON(http.StatusUnauthorized, entities.ErrorResponse{Message: "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:Refresh - Refresh", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+
+	accessToken, err := u.auth.CreateAccessToken(user, sessionID)
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:Refresh - CreateAccessToken", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	recordAudit(c, u.audit, entities.AuditTokenRefreshed, user.ID, map[string]string{"session_id": sessionID})
+	c.Header("Authorization", accessToken)
+	c.JSON(http.StatusOK, entities.TokenResponse{Message: "Token refreshed", RefreshToken: refreshToken})
+}
+
+func (u *userAuthHandler) Logout(c *gin.Context) {
+	var request entities.RefreshRequest
+	claims, isExtract := c.Get("x-claims")
+	if !isExtract {
+		utils.Logger.Error("userAuthHandler:Logout - extract claims", zap.Bool("isExtract", isExtract))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: "Invalid x-claims"})
+		return
+	}
+	// The refresh token is optional: without it only the access token is revoked.
+	if c.Request.ContentLength > 0 {
+		err := c.ShouldBindJSON(&request)
+		if err != nil {
+			utils.Logger.Error("userAuthHandler:Logout - request bind JSON", zap.Error(err))
+			c.JSON(http.StatusBadRequest, entities.ErrorResponse{Message: err.Error()})
+			return
+		}
+	}
+
+	err := u.auth.Logout(c, claims.(entities.JwtCustomClaims), request.RefreshToken)
+	if err != nil {
+		utils.Logger.Error("userAuthHandler:Logout - Logout", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entities.ErrorResponse{Message: "Logged out"})
+}
+
+// allowUserAttempt counts an attempt of a signed-in user to prove it is them
+// and responds with 429 when the user is throttled. It returns false if the
+// request has been answered.
+func allowUserAttempt(c *gin.Context, guard userGuard, method, userID string) bool {
+	retryAfter, err := guard.CheckUser(c, userID)
+	if errors.Is(err, entities.ErrTooManyLoginAttempts) {
+		utils.Logger.Error(method+" - user throttled", zap.Error(err))
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, entities.ErrorResponse{Message: "Too many failed attempts"})
+		return false
+	}
+	if err != nil {
+		utils.Logger.Error(method+" - check user attempts", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, entities.ErrorResponse{Message: err.Error()})
+		return false
+	}
+	return true
+}
+
+// registerUserSuccess clears the attempts counted by allowUserAttempt.
+func registerUserSuccess(c *gin.Context, guard userGuard, method, userID string) {
+	if err := guard.RegisterUserSuccess(c, userID); err != nil {
+		utils.Logger.Error(method+" - reset failed attempts", zap.Error(err))
+	}
 }
 
-func NewUserAuthHandler(auth userAuthenticator) *userAuthHandler {
+func NewUserAuthHandler(
+	auth userAuthenticator, guard loginGuard, mfa mfaVerifier, audit auditRecorder,
+) *userAuthHandler {
 	return &userAuthHandler{
-		auth: auth,
+		auth:  auth,
+		guard: guard,
+		mfa:   mfa,
+		audit: audit,
 	}
 }
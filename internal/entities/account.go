@@ -0,0 +1,37 @@
+package entities
+
+import "time"
+
+// Profile is the part of a user included in the data export. It leaves out
+// credentials and second-factor secrets.
+type Profile struct {
+	ID    string `json:"id"`
+	Login string `json:"login"`
+	Email string `json:"email,omitempty"`
+	Role  Role   `json:"role"`
+}
+
+// DeleteAccountRequest confirms the deletion with the current password or a
+// mailed deletion token, or with a second-factor code for users with
+// two-factor authentication.
+type DeleteAccountRequest struct {
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	MFACodeRequest
+}
+
+// DeletionToken is a mailed single-use token that confirms the deletion of
+// an account in place of the password, which users signed up through single
+// sign-on don't know.
+type DeletionToken struct {
+	Hash      string
+	UserID    string
+	ExpiresAt time.Time
+}
+
+type AccountExport struct {
+	Profile     Profile            `json:"profile"`
+	Orders      []OrderWithTime    `json:"orders"`
+	Withdrawals []WithdrawWithTime `json:"withdrawals"`
+	Sessions    []Session          `json:"sessions"`
+}
@@ -0,0 +1,45 @@
+package entities
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	AuditUserRegistered   = "user.registered"
+	AuditLoginSucceeded   = "login.succeeded"
+	AuditLoginFailed      = "login.failed"
+	AuditTokenRefreshed   = "token.refreshed"
+	AuditRefreshFailed    = "token.refresh_failed"
+	AuditOrderUploaded    = "order.uploaded"
+	AuditBalanceWithdrawn = "balance.withdrawn"
+	AuditLoginUnlocked    = "admin.login_unlocked"
+	AuditRoleChanged      = "admin.role_changed"
+	AuditOrderRequeued    = "admin.order_requeued"
+)
+
+// AuditEvent is one entry of the append-only security log. ActorID is empty
+// when the actor is unknown, e.g. for a failed login. A login the event is
+// about is never stored as such: Login is only set when recording and is
+// kept as the keyed LoginHash.
+type AuditEvent struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	ActorID   string          `json:"actor_id,omitempty"`
+	Login     string          `json:"-"`
+	LoginHash string          `json:"login_hash,omitempty"`
+	IP        string          `json:"ip"`
+	RequestID string          `json:"request_id"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// AuditQuery selects audit events. Login is looked up by its LoginHash.
+type AuditQuery struct {
+	UserID    string
+	Login     string
+	LoginHash string
+	From      time.Time
+	To        time.Time
+	Limit     int
+}
@@ -1,22 +1,75 @@
 package entities
 
 import (
+	"time"
+
 	"github.com/golang-jwt/jwt/v4"
 )
 
 type AuthRequest struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+}
+
+type Role string
+
+const (
+	RoleUser    Role = "user"
+	RoleSupport Role = "support"
+	RoleAdmin   Role = "admin"
+)
+
+func (r Role) Valid() bool {
+	switch r {
+	case RoleUser, RoleSupport, RoleAdmin:
+		return true
+	default:
+		return false
+	}
 }
 
 type User struct {
-	ID       string
-	Login    string
-	Password string
+	ID          string
+	Login       string
+	Password    string
+	Role        Role
+	Email       string
+	TOTPEnabled bool
 }
 
+// AccessTokenType is the typ header of access tokens.
+const AccessTokenType = "JWT"
+
+// JwtCustomClaims with a non-empty Purpose belong to intermediate tokens,
+// such as the one issued between password and second factor, and are not
+// accepted as access tokens.
 type JwtCustomClaims struct {
-	Name string `json:"name"`
-	ID   string `json:"id"`
+	Name    string `json:"name"`
+	ID      string `json:"id"`
+	Role    Role   `json:"role"`
+	Purpose string `json:"purpose,omitempty"`
+	// SessionID is empty in tokens issued before sessions were tracked.
+	SessionID string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
+
+type RoleRequest struct {
+	Role Role `json:"role"`
+}
+
+type RefreshToken struct {
+	Hash      string
+	UserID    string
+	FamilyID  string
+	ExpiresAt time.Time
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type TokenResponse struct {
+	Message      string `json:"message"`
+	RefreshToken string `json:"refresh_token"`
+}
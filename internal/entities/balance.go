@@ -6,8 +6,8 @@ type Balance struct {
 }
 
 type Withdraw struct {
-	Order string  `json:"order"`
-	Sum   float64 `json:"sum"`
+	Order OrderNumber `json:"order"`
+	Sum   float64     `json:"sum"`
 }
 
 type WithdrawWithTime struct {
@@ -1,7 +1,48 @@
 package entities
 
+import (
+	"time"
+)
+
+// What the accrual queue does with a new order when its intake is full.
+// Either way the order is stored and the next poll picks it up.
+const (
+	QueueOverflowDropNewest = "drop-newest"
+	QueueOverflowDropOldest = "drop-oldest"
+)
+
 type Config struct {
-	RunAddress           string `env:"RUN_ADDRESS"`
-	DatabaseURI          string `env:"DATABASE_URI"`
-	AccrualSystemAddress string `env:"ACCRUAL_SYSTEM_ADDRESS"`
+	RunAddress                  string        `env:"RUN_ADDRESS"`
+	DatabaseURI                 string        `env:"DATABASE_URI"`
+	AccrualSystemAddress        string        `env:"ACCRUAL_SYSTEM_ADDRESS"`
+	JwtKeysFile                 string        `env:"JWT_KEYS_FILE"`
+	JwtKeys                     string        `env:"JWT_KEYS"`
+	JwtKeysReloadInterval       time.Duration `env:"JWT_KEYS_RELOAD_INTERVAL"`
+	JwtSigningAlgorithm         string        `env:"JWT_SIGNING_ALG" envDefault:"HS256"`
+	RefreshTokenTTL             time.Duration `env:"REFRESH_TOKEN_TTL" envDefault:"720h"`
+	LoginGuardBackend           string        `env:"LOGIN_GUARD_BACKEND" envDefault:"memory"`
+	TrustedProxies              []string      `env:"TRUSTED_PROXIES" envSeparator:","`
+	Notifier                    string        `env:"NOTIFIER" envDefault:"file"`
+	NotifierFile                string        `env:"NOTIFIER_FILE"`
+	SMTPAddress                 string        `env:"SMTP_ADDRESS"`
+	SMTPUsername                string        `env:"SMTP_USERNAME"`
+	SMTPPassword                string        `env:"SMTP_PASSWORD"`
+	SMTPFrom                    string        `env:"SMTP_FROM"`
+	PasswordResetTTL            time.Duration `env:"PASSWORD_RESET_TTL" envDefault:"1h"`
+	PasswordResetURL            string        `env:"PASSWORD_RESET_URL"`
+	MFAEncryptionKey            string        `env:"MFA_ENCRYPTION_KEY"`
+	MFAIssuer                   string        `env:"MFA_ISSUER" envDefault:"Loyalty Program"`
+	AuditPseudonymKey           string        `env:"AUDIT_PSEUDONYM_KEY"`
+	OIDCIssuer                  string        `env:"OIDC_ISSUER"`
+	OIDCClientID                string        `env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret            string        `env:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL             string        `env:"OIDC_REDIRECT_URL"`
+	AccrualUnregisteredDeadline time.Duration `env:"ACCRUAL_UNREGISTERED_DEADLINE" envDefault:"24h"`
+	AccrualMaxAttempts          int           `env:"ACCRUAL_MAX_ATTEMPTS" envDefault:"100"`
+	AccrualWorkers              int           `env:"ACCRUAL_WORKERS"`
+	AccrualQueueSize            int           `env:"ACCRUAL_QUEUE_SIZE" envDefault:"1000"`
+	AccrualQueueOverflow        string        `env:"ACCRUAL_QUEUE_OVERFLOW" envDefault:"drop-newest"`
+	// BootstrapAdminLogin names a registered user who is made admin on
+	// startup while there is no admin yet.
+	BootstrapAdminLogin string `env:"BOOTSTRAP_ADMIN_LOGIN"`
 }
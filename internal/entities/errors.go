@@ -2,14 +2,60 @@ package entities
 
 import (
 	"errors"
+	"fmt"
 )
 
 var (
 	ErrLoginAlreadyInUse                = errors.New("login already exists")
+	ErrInvalidLogin                     = errors.New("login must not be empty")
 	ErrInvalidCredentials               = errors.New("invalid credentials")
 	ErrOrderAlreadyCreatedByThisUser    = errors.New("user has already created this order")
 	ErrOrderAlreadyCreatedByAnotherUser = errors.New("user has already created another order")
+	ErrMalformedOrderNumber             = errors.New("order number must consist of digits")
+	ErrInvalidOrderNumber               = errors.New("order number fails the Luhn check")
+	ErrMalformedBatch                   = errors.New("malformed order batch")
+	ErrBatchTooLarge                    = errors.New("order batch is too large")
+	ErrOrderNotDeadLettered             = errors.New("order is not dead-lettered")
+	ErrInvalidOrderQuery                = errors.New("invalid orders query")
+	ErrOrderNotFound                    = errors.New("order not found")
+	ErrInvalidOrderTransition           = errors.New("invalid order status transition")
+	ErrUnknownAccrualStatus             = fmt.Errorf("%w: unknown accrual status", ErrMalformedAccrualResponse)
+	ErrAccrualOrderNotRegistered        = errors.New("order is not registered in the accrual service")
+	ErrAccrualUnavailable               = errors.New("accrual service unavailable")
+	ErrUnexpectedAccrualResponse        = errors.New("unexpected accrual service response")
+	ErrMalformedAccrualResponse         = errors.New("malformed accrual service response")
+	ErrInvalidMaxAttempts               = errors.New("accrual max attempts must be positive")
+	ErrInvalidQueueOverflow             = errors.New("invalid accrual queue overflow mode")
+	ErrAccrualRateLimited               = errors.New("accrual service rate limit reached")
 	ErrNoOrderForUser                   = errors.New("there is no order for this user")
 	ErrInsufficientFunds                = errors.New("insufficient funds for this user")
 	ErrNoWithdrawals                    = errors.New("no withdrawals for this user")
+	ErrNoActiveSigningKey               = errors.New("no active signing key")
+	ErrUnknownSigningKey                = errors.New("unknown or retired signing key")
+	ErrSigningAlgorithmMismatch         = errors.New("active signing key does not match JWT_SIGNING_ALG")
+	ErrUnsupportedSigningAlgorithm      = errors.New("unsupported signing algorithm")
+	ErrInvalidRefreshToken              = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused               = errors.New("refresh token has already been used")
+	ErrUserNotFound                     = errors.New("user not found")
+	ErrInvalidPassword                  = errors.New("password must not be empty")
+	ErrInvalidResetToken                = errors.New("invalid or expired password reset token")
+	ErrInvalidDeletionToken             = errors.New("invalid or expired account deletion token")
+	ErrNoEmail                          = errors.New("account has no email")
+	ErrInvalidRole                      = errors.New("invalid role")
+	ErrInvalidAPIKey                    = errors.New("invalid or revoked API key")
+	ErrAPIKeyNotFound                   = errors.New("API key not found")
+	ErrInvalidScope                     = errors.New("invalid API key scope")
+	ErrInvalidMFACode                   = errors.New("invalid two-factor code")
+	ErrUnexpectedTokenType              = errors.New("unexpected token type")
+	ErrInvalidMFAToken                  = errors.New("invalid or expired two-factor token")
+	ErrMFAAlreadyEnabled                = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnrolled                   = errors.New("two-factor authentication is not enrolled")
+	ErrMFAUnavailable                   = errors.New("two-factor authentication is not configured")
+	ErrSessionNotFound                  = errors.New("session not found")
+	ErrInvalidOIDCState                 = errors.New("invalid or expired OIDC state")
+	ErrOIDCLoginFailed                  = errors.New("OIDC login failed")
+	ErrInvalidAuditQuery                = errors.New("invalid audit query")
+	ErrNoAuditPseudonymKey              = errors.New("no audit pseudonym key configured")
+	ErrTooManyResetRequests             = errors.New("too many password reset requests")
+	ErrTooManyLoginAttempts             = errors.New("too many failed login attempts")
 )
@@ -0,0 +1,10 @@
+package entities
+
+import (
+	"time"
+)
+
+type LoginAttempts struct {
+	Failures      int
+	LastFailureAt time.Time
+}
@@ -0,0 +1,49 @@
+package entities
+
+import "time"
+
+const (
+	TokenPurposeMFA = "mfa"
+	// MFATokenType and MFATokenAudience tell MFA tokens apart from access
+	// tokens for anyone who verifies them against the published keys.
+	MFATokenType     = "mfa+jwt"
+	MFATokenAudience = "mfa"
+)
+
+// MFAToken is a verified token from the first login step. It can be
+// exchanged for access tokens once.
+type MFAToken struct {
+	ID        string
+	User      User
+	ExpiresAt time.Time
+}
+
+type MFASettings struct {
+	EncryptedSecret string
+	Enabled         bool
+	LastStep        int64
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type MFACodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	MFACodeRequest
+}
+
+type MFAChallengeResponse struct {
+	Message  string `json:"message"`
+	MFAToken string `json:"mfa_token"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
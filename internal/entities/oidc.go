@@ -0,0 +1,31 @@
+package entities
+
+import (
+	"time"
+)
+
+// OIDCState is kept between redirecting a user to the provider and the
+// callback. Only a hash of the state parameter is stored.
+type OIDCState struct {
+	StateHash    string
+	CodeVerifier string
+	Nonce        string
+	ExpiresAt    time.Time
+}
+
+// OIDCAuthorization is a login started at the provider. The state is also
+// kept in a cookie, so that only the browser that started the login can
+// finish it.
+type OIDCAuthorization struct {
+	RedirectURL string
+	State       string
+	ExpiresAt   time.Time
+}
+
+// ExternalIdentity is a user as asserted by an OIDC provider.
+type ExternalIdentity struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	PreferredUsername string
+}
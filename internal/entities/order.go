@@ -1,14 +1,139 @@
 package entities
 
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// OrderNumber is a Luhn-valid string of decimal digits. It is a string
+// rather than an integer so long numbers and leading zeros survive.
+type OrderNumber string
+
 type Order struct {
-	OrderID string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual,omitempty"`
+	OrderID OrderNumber `json:"order"`
+	Status  OrderStatus `json:"status"`
+	Accrual float64     `json:"accrual,omitempty"`
+}
+
+// AccrualResponse is the accrual service's answer about an order.
+type AccrualResponse struct {
+	Order   OrderNumber   `json:"order"`
+	Status  AccrualStatus `json:"status"`
+	Accrual float64       `json:"accrual,omitempty"`
+}
+
+// OrderFor checks the answer is about the order that was asked for and
+// makes sense, and translates it to our order. Any flaw matches
+// ErrMalformedAccrualResponse.
+func (r AccrualResponse) OrderFor(number OrderNumber) (Order, error) {
+	if r.Order != number {
+		return Order{}, fmt.Errorf("%w: answer is about order %q", ErrMalformedAccrualResponse, r.Order)
+	}
+	status, ok := r.Status.OrderStatus()
+	if !ok {
+		return Order{}, fmt.Errorf("%w %q", ErrUnknownAccrualStatus, r.Status)
+	}
+	if r.Accrual < 0 || math.IsInf(r.Accrual, 0) || math.IsNaN(r.Accrual) {
+		return Order{}, fmt.Errorf("%w: accrual %v", ErrMalformedAccrualResponse, r.Accrual)
+	}
+	if r.Accrual != 0 && status != OrderStatusProcessed {
+		return Order{}, fmt.Errorf("%w: accrual for a %s order", ErrMalformedAccrualResponse, r.Status)
+	}
+	return Order{OrderID: number, Status: status, Accrual: r.Accrual}, nil
+}
+
+// AccrualJob is an order claimed for an accrual check. Attempts counts the
+// checks in a row that brought no news about it, Deferrals those the accrual
+// service put off by throttling or not knowing the order yet.
+type AccrualJob struct {
+	Order
+	UploadedAt time.Time
+	Attempts   int
+	Deferrals  int
+}
+
+// DeadLetteredOrder is an order the accrual checks gave up on, as shown to
+// admins.
+type DeadLetteredOrder struct {
+	OrderID        OrderNumber `json:"number"`
+	UserID         string      `json:"user_id"`
+	Status         OrderStatus `json:"status"`
+	Attempts       int         `json:"check_attempts"`
+	Reason         string      `json:"reason"`
+	DeadLetteredAt time.Time   `json:"dead_lettered_at"`
 }
 
 type OrderWithTime struct {
-	OrderID   string  `json:"number"`
-	Status    string  `json:"status"`
-	Accrual   float64 `json:"accrual,omitempty"`
-	UpdatedAt string  `json:"uploaded_at"`
+	OrderID   OrderNumber `json:"number"`
+	Status    OrderStatus `json:"status"`
+	Accrual   float64     `json:"accrual,omitempty"`
+	UpdatedAt string      `json:"uploaded_at"`
+}
+
+// OrderStatusChange is one step of an order's timeline. AccrualResponse is
+// the accrual service's answer that caused it; the initial NEW has none.
+type OrderStatusChange struct {
+	Status          OrderStatus     `json:"status"`
+	Accrual         float64         `json:"accrual,omitempty"`
+	AccrualResponse json.RawMessage `json:"accrual_response,omitempty"`
+	ChangedAt       time.Time       `json:"changed_at"`
+}
+
+type OrderDetail struct {
+	OrderWithTime
+	History []OrderStatusChange `json:"history"`
+}
+
+// OrderCursor marks the last order of a page. Listing continues after it
+// in the requested direction.
+type OrderCursor struct {
+	UploadedAt time.Time   `json:"t"`
+	Number     OrderNumber `json:"n"`
+}
+
+// OrderListQuery narrows and orders an orders list. Zero values mean no
+// filter; orders are sorted by upload time, oldest first unless Descending.
+type OrderListQuery struct {
+	Statuses   []OrderStatus
+	From       time.Time
+	To         time.Time
+	Descending bool
+	Limit      int
+	After      *OrderCursor
+}
+
+type OrderPage struct {
+	Orders     []OrderWithTime
+	NextCursor string
+}
+
+const (
+	BatchOrderAccepted  = "accepted"
+	BatchOrderDuplicate = "duplicate"
+	BatchOrderConflict  = "conflict"
+	BatchOrderInvalid   = "invalid"
+)
+
+// BatchOrderItem is one order number of a bulk upload as sent. Line is the
+// 1-based line of a CSV or NDJSON upload or the position in a JSON array.
+type BatchOrderItem struct {
+	Line int
+	Raw  string
+}
+
+type BatchOrderResult struct {
+	Line   int    `json:"line"`
+	Number string `json:"number"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchOrderReport struct {
+	Accepted   int                `json:"accepted"`
+	Duplicates int                `json:"duplicates"`
+	Conflicts  int                `json:"conflicts"`
+	Invalid    int                `json:"invalid"`
+	Results    []BatchOrderResult `json:"results"`
 }
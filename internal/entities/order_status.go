@@ -0,0 +1,103 @@
+package entities
+
+import "fmt"
+
+// OrderStatus is the state of an order in gophermart.
+type OrderStatus string
+
+const (
+	OrderStatusNew        OrderStatus = "NEW"
+	OrderStatusProcessing OrderStatus = "PROCESSING"
+	OrderStatusInvalid    OrderStatus = "INVALID"
+	OrderStatusProcessed  OrderStatus = "PROCESSED"
+)
+
+// orderTransitions lists the statuses each status may move to. INVALID and
+// PROCESSED are final.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderStatusNew:        {OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed},
+	OrderStatusProcessing: {OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed},
+}
+
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case OrderStatusNew, OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Final reports whether the accrual service has nothing more to say about
+// the order.
+func (s OrderStatus) Final() bool {
+	return s == OrderStatusInvalid || s == OrderStatusProcessed
+}
+
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// AccrualStatus is the state of an order as the accrual service reports it.
+type AccrualStatus string
+
+const (
+	AccrualStatusRegistered AccrualStatus = "REGISTERED"
+	AccrualStatusInvalid    AccrualStatus = "INVALID"
+	AccrualStatusProcessing AccrualStatus = "PROCESSING"
+	AccrualStatusProcessed  AccrualStatus = "PROCESSED"
+)
+
+// OrderStatus maps the accrual service's status to ours. A registered order
+// is already being worked on from the user's point of view.
+func (s AccrualStatus) OrderStatus() (OrderStatus, bool) {
+	switch s {
+	case AccrualStatusRegistered, AccrualStatusProcessing:
+		return OrderStatusProcessing, true
+	case AccrualStatusInvalid:
+		return OrderStatusInvalid, true
+	case AccrualStatusProcessed:
+		return OrderStatusProcessed, true
+	default:
+		return "", false
+	}
+}
+
+// OrderTransitionError is returned for an update that would move an order
+// to a status it may not reach from its current one. It matches
+// ErrInvalidOrderTransition.
+type OrderTransitionError struct {
+	Order OrderNumber
+	From  OrderStatus
+	To    OrderStatus
+}
+
+func (e *OrderTransitionError) Error() string {
+	return fmt.Sprintf("order %s: %s from %s to %s", e.Order, ErrInvalidOrderTransition, e.From, e.To)
+}
+
+func (e *OrderTransitionError) Is(target error) bool {
+	return target == ErrInvalidOrderTransition
+}
+
+// AccrualResponseError is returned for an answer of the accrual service
+// that says nothing about the order's status. It matches the error
+// describing the kind of answer, such as ErrAccrualUnavailable.
+type AccrualResponseError struct {
+	Order      OrderNumber
+	StatusCode int
+	Err        error
+}
+
+func (e *AccrualResponseError) Error() string {
+	return fmt.Sprintf("order %s: %s (HTTP %d)", e.Order, e.Err, e.StatusCode)
+}
+
+func (e *AccrualResponseError) Unwrap() error {
+	return e.Err
+}
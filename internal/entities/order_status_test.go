@@ -0,0 +1,79 @@
+package entities
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderStatus(t *testing.T) {
+	transitionTests := []struct {
+		name     string
+		from     OrderStatus
+		to       OrderStatus
+		expected bool
+	}{
+		{name: "CanTransitionTo: NEW to PROCESSING", from: OrderStatusNew, to: OrderStatusProcessing, expected: true},
+		{name: "CanTransitionTo: NEW to PROCESSED", from: OrderStatusNew, to: OrderStatusProcessed, expected: true},
+		{
+			name:     "CanTransitionTo: PROCESSING stays PROCESSING",
+			from:     OrderStatusProcessing,
+			to:       OrderStatusProcessing,
+			expected: true,
+		},
+		{
+			name:     "CanTransitionTo: PROCESSING to INVALID",
+			from:     OrderStatusProcessing,
+			to:       OrderStatusInvalid,
+			expected: true,
+		},
+		{
+			name:     "CanTransitionTo: PROCESSED back to PROCESSING",
+			from:     OrderStatusProcessed,
+			to:       OrderStatusProcessing,
+			expected: false,
+		},
+		{name: "CanTransitionTo: INVALID to PROCESSED", from: OrderStatusInvalid, to: OrderStatusProcessed, expected: false},
+		{name: "CanTransitionTo: PROCESSING back to NEW", from: OrderStatusProcessing, to: OrderStatusNew, expected: false},
+	}
+	for _, tt := range transitionTests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.from.CanTransitionTo(tt.to))
+		})
+	}
+
+	mappingTests := []struct {
+		name           string
+		accrual        AccrualStatus
+		expectedStatus OrderStatus
+		expectedOK     bool
+	}{
+		{
+			name:           "OrderStatus: REGISTERED",
+			accrual:        AccrualStatusRegistered,
+			expectedStatus: OrderStatusProcessing,
+			expectedOK:     true,
+		},
+		{
+			name:           "OrderStatus: PROCESSED",
+			accrual:        AccrualStatusProcessed,
+			expectedStatus: OrderStatusProcessed,
+			expectedOK:     true,
+		},
+		{name: "OrderStatus: unknown", accrual: "DONE", expectedStatus: "", expectedOK: false},
+	}
+	for _, tt := range mappingTests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, ok := tt.accrual.OrderStatus()
+			assert.Equal(t, tt.expectedStatus, status)
+			assert.Equal(t, tt.expectedOK, ok)
+		})
+	}
+
+	t.Run("OrderTransitionError: matches sentinel", func(t *testing.T) {
+		var err error = &OrderTransitionError{Order: "12345678903", From: OrderStatusProcessed, To: OrderStatusProcessing}
+		assert.True(t, errors.Is(err, ErrInvalidOrderTransition))
+		assert.Equal(t, "order 12345678903: invalid order status transition from PROCESSED to PROCESSING", err.Error())
+	})
+}
@@ -0,0 +1,31 @@
+package entities
+
+import (
+	"time"
+)
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Login string `json:"login"`
+}
+
+type SetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type PasswordResetToken struct {
+	Hash      string
+	UserID    string
+	ExpiresAt time.Time
+}
+
+type Notification struct {
+	To      string
+	Subject string
+	Body    string
+}
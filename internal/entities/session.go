@@ -0,0 +1,17 @@
+package entities
+
+import (
+	"time"
+)
+
+// Session is one signed-in device. Its ID is shared by the refresh token
+// family of the device and the sid claim of its access tokens.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
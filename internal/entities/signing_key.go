@@ -0,0 +1,52 @@
+package entities
+
+import (
+	"time"
+)
+
+const (
+	SigningAlgorithmHS256 = "HS256"
+	SigningAlgorithmRS256 = "RS256"
+	SigningAlgorithmEdDSA = "EdDSA"
+)
+
+// JWKSMaxAge is how long clients may cache the published keys.
+const JWKSMaxAge = 5 * time.Minute
+
+// SigningKey holds either an HMAC secret (HS256) or a PKCS#8 encoded
+// private key (RS256, EdDSA). An empty Algorithm means HS256.
+type SigningKey struct {
+	ID         string     `json:"kid"`
+	Algorithm  string     `json:"alg,omitempty"`
+	Secret     []byte     `json:"secret,omitempty"`
+	PrivateKey []byte     `json:"private_key,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RetiredAt  *time.Time `json:"retired_at,omitempty"`
+	// ActivateAfter is when the key starts signing. Until then it is only
+	// published for verification, so replicas and JWKS caches know it before
+	// the first token signed with it. Keys without it sign from creation.
+	ActivateAfter *time.Time `json:"activate_after,omitempty"`
+	// Parsed key material, filled in once when the key is loaded so it is
+	// not decoded again for every token.
+	SignMaterial   interface{} `json:"-"`
+	VerifyMaterial interface{} `json:"-"`
+}
+
+type SigningKeySet struct {
+	Keys []SigningKey `json:"keys"`
+}
+
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
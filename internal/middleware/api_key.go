@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+type apiKeyAuthenticator interface {
+	Authenticate(ctx context.Context, key string) (entities.APIKey, error)
+}
+
+// APIKeyOrJwtMiddleware authenticates requests with an X-API-Key header and
+// falls back to jwtAuth otherwise. Routes behind it must declare the scope
+// they need with RequireScope.
+func APIKeyOrJwtMiddleware(apiKeys apiKeyAuthenticator, jwtAuth gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Request.Header.Get("X-API-Key")
+		if key == "" {
+			jwtAuth(c)
+			return
+		}
+
+		apiKey, err := apiKeys.Authenticate(c, key)
+		if errors.Is(err, entities.ErrInvalidAPIKey) {
+			c.JSON(http.StatusUnauthorized, "")
+			c.Abort()
+			return
+		}
+		if err != nil {
+			utils.Logger.Error("APIKeyOrJwtMiddleware - authenticate API key", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, "")
+			c.Abort()
+			return
+		}
+
+		c.Set("x-user-id", apiKey.UserID)
+		c.Set("x-scopes", apiKey.Scopes)
+		c.Next()
+	}
+}
+
+// RequireScope checks the scopes of API key requests. Requests authenticated
+// with a user token are not limited by scopes.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scopes, isAPIKey := c.Get("x-scopes")
+		if !isAPIKey {
+			c.Next()
+			return
+		}
+		for _, granted := range scopes.([]string) {
+			if granted == scope {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, entities.ErrorResponse{Message: "API key lacks scope " + scope})
+		c.Abort()
+	}
+}
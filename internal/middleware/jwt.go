@@ -1,38 +1,75 @@
 package middleware
 
 import (
-	"fmt"
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
 )
 
-func JwtAuthMiddleware(secret string) gin.HandlerFunc {
+type verificationKeys interface {
+	VerificationKey(kid string) (entities.SigningKey, error)
+}
+
+type revokedTokens interface {
+	IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+type activeSessions interface {
+	TouchSession(ctx context.Context, sessionID string, touchAfter time.Duration) (bool, error)
+}
+
+// sessionTouchInterval limits how often the last-seen time of a session is
+// written.
+const sessionTouchInterval = time.Minute
+
+func JwtAuthMiddleware(keys verificationKeys, revoked revokedTokens, sessions activeSessions) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		accessToken := c.Request.Header.Get("Authorization")
 
-		token, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(secret), nil
-		})
-		if err != nil {
+		claims, err := utils.ParseToken(accessToken, entities.AccessTokenType, keys.VerificationKey)
+		// Intermediate tokens, e.g. between password and second factor,
+		// must not grant access.
+		if err != nil || claims.Purpose != "" {
 			c.JSON(http.StatusUnauthorized, "")
 			c.Abort()
 			return
 		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-
-		if !ok && !token.Valid {
+		isRevoked, err := revoked.IsAccessTokenRevoked(c, claims.RegisteredClaims.ID)
+		if err != nil {
+			utils.Logger.Error("JwtAuthMiddleware - check token revocation", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, "")
+			c.Abort()
+			return
+		}
+		if isRevoked {
 			c.JSON(http.StatusUnauthorized, "")
 			c.Abort()
 			return
 		}
-		userID := fmt.Sprintf("%v", claims["id"])
-		c.Set("x-user-id", userID)
+		if claims.SessionID != "" {
+			isActive, err := sessions.TouchSession(c, claims.SessionID, sessionTouchInterval)
+			if err != nil {
+				utils.Logger.Error("JwtAuthMiddleware - check session", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, "")
+				c.Abort()
+				return
+			}
+			if !isActive {
+				c.JSON(http.StatusUnauthorized, "")
+				c.Abort()
+				return
+			}
+		}
+
+		c.Set("x-user-id", claims.ID)
+		c.Set("x-claims", *claims)
 		c.Next()
 	}
 }
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+// RequireRoles lets through only requests whose token carries one of roles.
+// It has to run after JwtAuthMiddleware.
+func RequireRoles(roles ...entities.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, isExtract := c.Get("x-claims")
+		if !isExtract {
+			c.JSON(http.StatusUnauthorized, "")
+			c.Abort()
+			return
+		}
+		role := claims.(entities.JwtCustomClaims).Role
+		for _, allowed := range roles {
+			if role == allowed {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, entities.ErrorResponse{Message: "Insufficient role"})
+		c.Abort()
+	}
+}
@@ -0,0 +1,63 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+// fileNotifier appends notifications as JSON lines to a file, or writes them
+// to the log when no file is set. It is meant for local development and
+// tests, where reset links can be picked up without a mail server.
+type fileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+type fileNotification struct {
+	entities.Notification
+	SentAt time.Time
+}
+
+func (f *fileNotifier) Send(_ context.Context, notification entities.Notification) error {
+	if f.path == "" {
+		utils.Logger.Info(
+			"notification",
+			zap.String("to", notification.To),
+			zap.String("subject", notification.Subject),
+			zap.String("body", notification.Body),
+		)
+		return nil
+	}
+
+	line, err := json.Marshal(fileNotification{Notification: notification, SentAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func NewFileNotifier(path string) *fileNotifier {
+	return &fileNotifier{
+		path: path,
+	}
+}
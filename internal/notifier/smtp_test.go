@@ -0,0 +1,102 @@
+package notifier
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+// newSMTPStub accepts connections and answers them with handle.
+func newSMTPStub(t *testing.T, handle func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	notification := entities.Notification{To: "user@example.com", Subject: "Password reset", Body: "token"}
+
+	t.Run("Send: delivers the message", func(t *testing.T) {
+		received := make(chan string, 1)
+		addr := newSMTPStub(t, func(conn net.Conn) {
+			reader := bufio.NewReader(conn)
+			_, _ = conn.Write([]byte("220 stub\r\n"))
+			var data strings.Builder
+			inData := false
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				switch {
+				case inData && line == ".\r\n":
+					inData = false
+					received <- data.String()
+					_, _ = conn.Write([]byte("250 queued\r\n"))
+				case inData:
+					data.WriteString(line)
+				case strings.HasPrefix(line, "DATA"):
+					inData = true
+					_, _ = conn.Write([]byte("354 go ahead\r\n"))
+				case strings.HasPrefix(line, "QUIT"):
+					_, _ = conn.Write([]byte("221 bye\r\n"))
+					return
+				default:
+					_, _ = conn.Write([]byte("250 ok\r\n"))
+				}
+			}
+		})
+		notifier, err := NewSMTPNotifier(addr, "", "", "noreply@example.com")
+		require.NoError(t, err)
+
+		err = notifier.Send(context.Background(), notification)
+		require.NoError(t, err)
+		message := <-received
+		assert.Contains(t, message, "To: user@example.com\r\n")
+		assert.Contains(t, message, "Subject: Password reset\r\n")
+	})
+
+	t.Run("Send: gives up when ctx is done", func(t *testing.T) {
+		// The stub never greets, like a relay that hangs.
+		addr := newSMTPStub(t, func(conn net.Conn) {
+			_, _ = conn.Read(make([]byte, 1))
+		})
+		notifier, err := NewSMTPNotifier(addr, "", "", "noreply@example.com")
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err = notifier.Send(ctx, notification)
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("Send: recipient with a line break", func(t *testing.T) {
+		notifier, err := NewSMTPNotifier("127.0.0.1:25", "", "", "noreply@example.com")
+		require.NoError(t, err)
+		err = notifier.Send(context.Background(), entities.Notification{To: "user@example.com\r\nBcc: x@example.com"})
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,260 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+const (
+	requestTimeout = 10 * time.Second
+	// keysRefreshInterval stops tokens with made-up kids from making us
+	// fetch the JWKS on every request.
+	keysRefreshInterval = time.Minute
+)
+
+var (
+	ErrDiscovery = errors.New("OIDC discovery failed")
+	// Failures of a single login wrap entities.ErrOIDCLoginFailed so callers
+	// don't depend on this package.
+	ErrTokenRequest = fmt.Errorf("%w: token request failed", entities.ErrOIDCLoginFailed)
+	ErrInvalidToken = fmt.Errorf("%w: invalid ID token", entities.ErrOIDCLoginFailed)
+)
+
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type tokenResponse struct {
+	IDToken string `json:"id_token"`
+}
+
+type idTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+// provider talks to one OpenID Connect provider using the authorization
+// code flow with PKCE.
+type provider struct {
+	client       *resty.Client
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	discovery    discoveryDocument
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	refreshedAt time.Time
+}
+
+// AuthCodeURL returns the provider URL the user is sent to. codeVerifier is
+// kept by us; only its S256 challenge is sent.
+func (p *provider) AuthCodeURL(state, nonce, codeVerifier string) string {
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.clientID)
+	params.Set("redirect_uri", p.redirectURL)
+	params.Set("scope", "openid email profile")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", CodeChallenge(codeVerifier))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.discovery.AuthorizationEndpoint + separator + params.Encode()
+}
+
+// Exchange redeems an authorization code and returns the verified identity
+// from the ID token.
+func (p *provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (entities.ExternalIdentity, error) {
+	var token tokenResponse
+	response, err := p.client.R().
+		SetContext(ctx).
+		SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret)).
+		SetFormData(map[string]string{
+			"grant_type":    "authorization_code",
+			"code":          code,
+			"redirect_uri":  p.redirectURL,
+			"code_verifier": codeVerifier,
+		}).
+		SetResult(&token).
+		Post(p.discovery.TokenEndpoint)
+	if err != nil {
+		return entities.ExternalIdentity{}, fmt.Errorf("%w: %v", ErrTokenRequest, err)
+	}
+	if response.StatusCode() != http.StatusOK || token.IDToken == "" {
+		return entities.ExternalIdentity{}, fmt.Errorf("%w: status %d", ErrTokenRequest, response.StatusCode())
+	}
+	return p.VerifyIDToken(ctx, token.IDToken, nonce)
+}
+
+// VerifyIDToken checks the signature against the provider JWKS, the issuer,
+// the audience, the expiry and the nonce of the login attempt.
+func (p *provider) VerifyIDToken(ctx context.Context, rawToken, nonce string) (entities.ExternalIdentity, error) {
+	claims := &idTokenClaims{}
+	token, err := jwt.ParseWithClaims(rawToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != jwt.SigningMethodRS256.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil || !token.Valid {
+		return entities.ExternalIdentity{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.Issuer != p.discovery.Issuer {
+		return entities.ExternalIdentity{}, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if !claims.VerifyAudience(p.clientID, true) {
+		return entities.ExternalIdentity{}, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+	if claims.ExpiresAt == nil {
+		return entities.ExternalIdentity{}, fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	if claims.Subject == "" || claims.Nonce == "" || claims.Nonce != nonce {
+		return entities.ExternalIdentity{}, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+
+	identity := entities.ExternalIdentity{
+		Issuer:            claims.Issuer,
+		Subject:           claims.Subject,
+		PreferredUsername: claims.PreferredUsername,
+	}
+	if claims.EmailVerified {
+		identity.Email = claims.Email
+	}
+	return identity, nil
+}
+
+// key returns the signing key with kid. The JWKS is fetched again when the
+// kid is unknown, which covers key rotation at the provider.
+func (p *provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.RLock()
+	key, ok := p.keys[kid]
+	p.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	if err := p.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	key, ok = p.keys[kid]
+	if !ok {
+		return nil, entities.ErrUnknownSigningKey
+	}
+	return key, nil
+}
+
+func (p *provider) refreshKeys(ctx context.Context) error {
+	p.mu.RLock()
+	recent := time.Since(p.refreshedAt) < keysRefreshInterval
+	p.mu.RUnlock()
+	if recent {
+		return nil
+	}
+
+	var set entities.JSONWebKeySet
+	response, err := p.client.R().SetContext(ctx).SetResult(&set).Get(p.discovery.JwksURI)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode() != http.StatusOK {
+		return fmt.Errorf("fetch JWKS failed: status %d", response.StatusCode())
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := rsaPublicKey(jwk)
+		if err != nil {
+			return err
+		}
+		keys[jwk.Kid] = key
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.refreshedAt = time.Now()
+	return nil
+}
+
+func rsaPublicKey(jwk entities.JSONWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, fmt.Errorf("decode modulus of key %s failed: %w", jwk.Kid, err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, fmt.Errorf("decode exponent of key %s failed: %w", jwk.Kid, err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// CodeChallenge derives the PKCE S256 challenge from a code verifier.
+func CodeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// NewProvider reads the discovery document of issuer. The issuer it
+// announces must match exactly, as required by the specification.
+func NewProvider(ctx context.Context, issuer, clientID, clientSecret, redirectURL string) (*provider, error) {
+	provider := &provider{
+		client:       resty.New().SetTimeout(requestTimeout),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+	}
+
+	response, err := provider.client.R().
+		SetContext(ctx).
+		SetResult(&provider.discovery).
+		Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	if response.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", ErrDiscovery, response.StatusCode())
+	}
+	if provider.discovery.Issuer != issuer {
+		return nil, fmt.Errorf("%w: issuer %q does not match %q", ErrDiscovery, provider.discovery.Issuer, issuer)
+	}
+	if provider.discovery.AuthorizationEndpoint == "" || provider.discovery.TokenEndpoint == "" ||
+		provider.discovery.JwksURI == "" {
+		return nil, fmt.Errorf("%w: incomplete discovery document", ErrDiscovery)
+	}
+	return provider, nil
+}
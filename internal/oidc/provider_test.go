@@ -0,0 +1,219 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+// standInProvider is a minimal OpenID provider: it hands out one code per
+// authorization request and checks the PKCE verifier when it is redeemed.
+type standInProvider struct {
+	server    *httptest.Server
+	issuer    string
+	key       entities.SigningKey
+	claims    func(nonce string) jwt.MapClaims
+	challenge string
+	nonce     string
+}
+
+func newStandInProvider(t *testing.T) *standInProvider {
+	p := &standInProvider{
+		key: entities.SigningKey{ID: "provider-key", Algorithm: entities.SigningAlgorithmRS256},
+	}
+	assert.NoError(t, utils.GenerateKeyMaterial(&p.key))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(discoveryDocument{
+			Issuer:                p.issuer,
+			AuthorizationEndpoint: p.issuer + "/authorize",
+			TokenEndpoint:         p.issuer + "/token",
+			JwksURI:               p.issuer + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk, _, err := utils.PublicJWK(p.key)
+		assert.NoError(t, err)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(entities.JSONWebKeySet{Keys: []entities.JSONWebKey{jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != "gophermart" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.PostFormValue("code") != "code" || CodeChallenge(r.PostFormValue("code_verifier")) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(tokenResponse{IDToken: p.sign(t, p.claims(p.nonce))})
+	})
+	p.server = httptest.NewServer(mux)
+	p.issuer = p.server.URL
+	p.claims = p.validClaims
+	return p
+}
+
+// authorize plays the browser part: it follows the authorization URL and
+// remembers what the provider would have stored.
+func (p *standInProvider) authorize(t *testing.T, authURL string) {
+	parsed, err := url.Parse(authURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "S256", parsed.Query().Get("code_challenge_method"))
+	p.challenge = parsed.Query().Get("code_challenge")
+	p.nonce = parsed.Query().Get("nonce")
+}
+
+func (p *standInProvider) validClaims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            p.issuer,
+		"sub":            "subject-1",
+		"aud":            "gophermart",
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "user@example.com",
+		"email_verified": true,
+	}
+}
+
+func (p *standInProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	signKey, err := utils.SignKey(p.key)
+	assert.NoError(t, err)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = p.key.ID
+	signed, err := token.SignedString(signKey)
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestProvider(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	standIn := newStandInProvider(t)
+	defer standIn.server.Close()
+
+	provider, err := NewProvider(ctx, standIn.issuer, "gophermart", "secret", "https://gophermart/callback")
+	assert.NoError(t, err)
+
+	exchangeTests := []struct {
+		name             string
+		codeVerifier     string
+		claims           func(nonce string) jwt.MapClaims
+		expectedIdentity entities.ExternalIdentity
+		expectedErr      error
+	}{
+		{
+			name:         "Exchange: success",
+			codeVerifier: "verifier",
+			claims:       standIn.validClaims,
+			expectedIdentity: entities.ExternalIdentity{
+				Issuer:  standIn.issuer,
+				Subject: "subject-1",
+				Email:   "user@example.com",
+			},
+			expectedErr: nil,
+		},
+		{
+			name:         "Exchange: unverified email is dropped",
+			codeVerifier: "verifier",
+			claims: func(nonce string) jwt.MapClaims {
+				claims := standIn.validClaims(nonce)
+				claims["email_verified"] = false
+				return claims
+			},
+			expectedIdentity: entities.ExternalIdentity{Issuer: standIn.issuer, Subject: "subject-1"},
+			expectedErr:      nil,
+		},
+		{
+			name:         "Exchange: wrong code verifier",
+			codeVerifier: "other",
+			claims:       standIn.validClaims,
+			expectedErr:  ErrTokenRequest,
+		},
+		{
+			name:         "Exchange: nonce mismatch",
+			codeVerifier: "verifier",
+			claims: func(string) jwt.MapClaims {
+				return standIn.validClaims("replayed")
+			},
+			expectedErr: ErrInvalidToken,
+		},
+		{
+			name:         "Exchange: wrong audience",
+			codeVerifier: "verifier",
+			claims: func(nonce string) jwt.MapClaims {
+				claims := standIn.validClaims(nonce)
+				claims["aud"] = "another-client"
+				return claims
+			},
+			expectedErr: ErrInvalidToken,
+		},
+		{
+			name:         "Exchange: wrong issuer",
+			codeVerifier: "verifier",
+			claims: func(nonce string) jwt.MapClaims {
+				claims := standIn.validClaims(nonce)
+				claims["iss"] = "https://evil.example.com"
+				return claims
+			},
+			expectedErr: ErrInvalidToken,
+		},
+		{
+			name:         "Exchange: expired token",
+			codeVerifier: "verifier",
+			claims: func(nonce string) jwt.MapClaims {
+				claims := standIn.validClaims(nonce)
+				claims["exp"] = time.Now().Add(-time.Minute).Unix()
+				return claims
+			},
+			expectedErr: ErrInvalidToken,
+		},
+	}
+	for _, tt := range exchangeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			standIn.claims = tt.claims
+			standIn.authorize(t, provider.AuthCodeURL("state", "nonce", "verifier"))
+
+			identity, err := provider.Exchange(ctx, "code", tt.codeVerifier, "nonce")
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedIdentity, identity)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, entities.ErrOIDCLoginFailed)
+			}
+		})
+	}
+
+	t.Run("VerifyIDToken: key not in JWKS", func(t *testing.T) {
+		other := entities.SigningKey{ID: "other-key", Algorithm: entities.SigningAlgorithmRS256}
+		assert.NoError(t, utils.GenerateKeyMaterial(&other))
+		signKey, err := utils.SignKey(other)
+		assert.NoError(t, err)
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, standIn.validClaims("nonce"))
+		token.Header["kid"] = other.ID
+		signed, err := token.SignedString(signKey)
+		assert.NoError(t, err)
+
+		_, err = provider.VerifyIDToken(ctx, signed, "nonce")
+		assert.ErrorIs(t, err, ErrInvalidToken)
+	})
+
+	t.Run("NewProvider: issuer mismatch", func(t *testing.T) {
+		_, err := NewProvider(ctx, standIn.issuer+"/", "gophermart", "secret", "https://gophermart/callback")
+		assert.ErrorIs(t, err, ErrDiscovery)
+	})
+}
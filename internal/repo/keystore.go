@@ -0,0 +1,306 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+type keyStore struct {
+	mu   sync.RWMutex
+	path string
+	keys entities.SigningKeySet
+}
+
+// JSONWebKeySet publishes the public halves of all non-retired asymmetric
+// keys so other services can validate tokens without a shared secret.
+func (k *keyStore) JSONWebKeySet() (entities.JSONWebKeySet, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := entities.JSONWebKeySet{Keys: []entities.JSONWebKey{}}
+	for _, key := range k.keys.Keys {
+		if key.RetiredAt != nil {
+			continue
+		}
+		jwk, ok, err := utils.PublicJWK(key)
+		if err != nil {
+			return set, err
+		}
+		if ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set, nil
+}
+
+// ActiveKey returns the most recently activated key that has not been
+// retired. New tokens are signed with it.
+func (k *keyStore) ActiveKey() (entities.SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return activeKey(k.keys, time.Now())
+}
+
+// VerificationKey returns the key with the given kid if it is not retired.
+// Keys waiting for activation are returned too.
+func (k *keyStore) VerificationKey(kid string) (entities.SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys.Keys {
+		if key.ID == kid && key.RetiredAt == nil {
+			return key, nil
+		}
+	}
+	return entities.SigningKey{}, entities.ErrUnknownSigningKey
+}
+
+// Reload re-reads the key file so keys added by the rotation command are
+// picked up without a restart. Stores created from env are not reloaded.
+func (k *keyStore) Reload() error {
+	if k.path == "" {
+		return nil
+	}
+	keys, err := ReadKeySet(k.path)
+	if err != nil {
+		return err
+	}
+	if _, err = activeKey(keys, time.Now()); err != nil {
+		return err
+	}
+	if err = prepareKeys(keys); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	return nil
+}
+
+func (k *keyStore) ReloadEvery(ctx context.Context, interval time.Duration) {
+	if k.path == "" || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.Reload(); err != nil {
+				utils.Logger.Error("keyStore:ReloadEvery - reload keys", zap.Error(err))
+			}
+		}
+	}
+}
+
+func activeKey(keys entities.SigningKeySet, now time.Time) (entities.SigningKey, error) {
+	var active entities.SigningKey
+	found := false
+
+	for _, key := range keys.Keys {
+		if key.RetiredAt != nil || activatesAt(key).After(now) {
+			continue
+		}
+		if !found || activatesAt(key).After(activatesAt(active)) {
+			active = key
+			found = true
+		}
+	}
+	if !found {
+		return active, entities.ErrNoActiveSigningKey
+	}
+	return active, nil
+}
+
+// newestKey returns the most recently created key that has not been
+// retired, whether it signs yet or not.
+func newestKey(keys entities.SigningKeySet) (entities.SigningKey, bool) {
+	var newest entities.SigningKey
+	found := false
+
+	for _, key := range keys.Keys {
+		if key.RetiredAt == nil && (!found || key.CreatedAt.After(newest.CreatedAt)) {
+			newest = key
+			found = true
+		}
+	}
+	return newest, found
+}
+
+func activatesAt(key entities.SigningKey) time.Time {
+	if key.ActivateAfter != nil {
+		return *key.ActivateAfter
+	}
+	return key.CreatedAt
+}
+
+func ReadKeySet(path string) (entities.SigningKeySet, error) {
+	var keys entities.SigningKeySet
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return keys, err
+	}
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return keys, fmt.Errorf("parse key file %s failed: %w", path, err)
+	}
+	return keys, nil
+}
+
+// WriteKeySet replaces the key file atomically so a concurrent Reload never
+// sees a partially written file.
+func WriteKeySet(path string, keys entities.SigningKeySet) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func NewSigningKey(now time.Time, algorithm string) (entities.SigningKey, error) {
+	key := entities.SigningKey{
+		Algorithm: algorithm,
+		CreatedAt: now.UTC(),
+	}
+
+	id, err := utils.GenerateKeyID()
+	if err != nil {
+		return key, err
+	}
+	key.ID = id
+	err = utils.GenerateKeyMaterial(&key)
+	return key, err
+}
+
+// RotateKeySet adds a new key when the newest one is older than
+// rotateAfter, uses another algorithm or force is set. The new key starts
+// signing activateAfter later; that has to outlast the key reload interval
+// of the replicas plus JWKSMaxAge, otherwise tokens signed with it are
+// rejected by those that don't know it yet. Only a key set nobody can sign
+// with gets a key that signs at once. RotateKeySet retires keys that were
+// superseded by an active key more than retireAfter ago and drops keys
+// retired more than removeAfter ago. retireAfter must be longer than the
+// access token lifetime, otherwise tokens signed right before a rotation are
+// rejected early.
+func RotateKeySet(
+	keys entities.SigningKeySet, now time.Time, algorithm string,
+	rotateAfter, activateAfter, retireAfter, removeAfter time.Duration, force bool,
+) (entities.SigningKeySet, error) {
+	_, noActiveKey := activeKey(keys, now)
+	newest, found := newestKey(keys)
+	algorithmChanged := !utils.SameAlgorithm(newest.Algorithm, algorithm)
+	if force || !found || now.Sub(newest.CreatedAt) >= rotateAfter || algorithmChanged {
+		newKey, err := NewSigningKey(now, algorithm)
+		if err != nil {
+			return keys, err
+		}
+		if noActiveKey == nil && activateAfter > 0 {
+			activateAt := now.Add(activateAfter).UTC()
+			newKey.ActivateAfter = &activateAt
+		}
+		keys.Keys = append(keys.Keys, newKey)
+	}
+
+	sort.Slice(keys.Keys, func(i, j int) bool {
+		return keys.Keys[i].CreatedAt.Before(keys.Keys[j].CreatedAt)
+	})
+
+	rotated := entities.SigningKeySet{Keys: make([]entities.SigningKey, 0, len(keys.Keys))}
+	for i, key := range keys.Keys {
+		if key.RetiredAt == nil && i < len(keys.Keys)-1 {
+			supersededAt := activatesAt(keys.Keys[i+1])
+			if !supersededAt.After(now) && now.Sub(supersededAt) >= retireAfter {
+				retiredAt := now.UTC()
+				key.RetiredAt = &retiredAt
+			}
+		}
+		if key.RetiredAt != nil && now.Sub(*key.RetiredAt) >= removeAfter {
+			continue
+		}
+		rotated.Keys = append(rotated.Keys, key)
+	}
+	return rotated, nil
+}
+
+// NewKeyStore loads signing keys from a JSON key file or, if no file is
+// configured, from the JSON in envKeys. Without either, a random key for
+// algorithm is generated: tokens then do not survive a restart and are not
+// accepted by other replicas.
+func NewKeyStore(path, envKeys, algorithm string) (*keyStore, error) {
+	store := &keyStore{path: path}
+
+	switch {
+	case path != "":
+		if err := store.Reload(); err != nil {
+			return nil, fmt.Errorf("load signing keys failed: %w", err)
+		}
+	case envKeys != "":
+		if err := json.Unmarshal([]byte(envKeys), &store.keys); err != nil {
+			return nil, fmt.Errorf("parse signing keys from env failed: %w", err)
+		}
+		if _, err := activeKey(store.keys, time.Now()); err != nil {
+			return nil, err
+		}
+		if err := prepareKeys(store.keys); err != nil {
+			return nil, err
+		}
+	default:
+		utils.Logger.Warn("keyStore - no signing keys configured, using an ephemeral key")
+		key, err := NewSigningKey(time.Now(), algorithm)
+		if err != nil {
+			return nil, err
+		}
+		if err = utils.PrepareKey(&key); err != nil {
+			return nil, err
+		}
+		store.keys.Keys = []entities.SigningKey{key}
+	}
+
+	// Tokens would otherwise quietly be signed with another algorithm than
+	// the one configured.
+	active, err := store.ActiveKey()
+	if err != nil {
+		return nil, err
+	}
+	if !utils.SameAlgorithm(active.Algorithm, algorithm) {
+		return nil, fmt.Errorf("%w: key %s is %s, configured %s",
+			entities.ErrSigningAlgorithmMismatch, active.ID, keyAlgorithm(active), algorithm)
+	}
+	return store, nil
+}
+
+// prepareKeys parses the key material of every key in place.
+func prepareKeys(keys entities.SigningKeySet) error {
+	for i := range keys.Keys {
+		if err := utils.PrepareKey(&keys.Keys[i]); err != nil {
+			return fmt.Errorf("key %s: %w", keys.Keys[i].ID, err)
+		}
+	}
+	return nil
+}
+
+func keyAlgorithm(key entities.SigningKey) string {
+	if key.Algorithm == "" {
+		return entities.SigningAlgorithmHS256
+	}
+	return key.Algorithm
+}
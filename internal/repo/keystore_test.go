@@ -0,0 +1,99 @@
+package repo
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+func TestNewKeyStore(t *testing.T) {
+	utils.Logger = zap.NewNop()
+	key, err := NewSigningKey(time.Now(), entities.SigningAlgorithmRS256)
+	require.NoError(t, err)
+	envKeys, err := json.Marshal(entities.SigningKeySet{Keys: []entities.SigningKey{key}})
+	require.NoError(t, err)
+
+	t.Run("NewKeyStore: parses key material once", func(t *testing.T) {
+		store, err := NewKeyStore("", string(envKeys), entities.SigningAlgorithmRS256)
+		require.NoError(t, err)
+		active, err := store.ActiveKey()
+		require.NoError(t, err)
+		assert.NotNil(t, active.SignMaterial)
+		assert.NotNil(t, active.VerifyMaterial)
+	})
+
+	t.Run("NewKeyStore: configured algorithm does not match the keys", func(t *testing.T) {
+		_, err := NewKeyStore("", string(envKeys), entities.SigningAlgorithmHS256)
+		assert.ErrorIs(t, err, entities.ErrSigningAlgorithmMismatch)
+	})
+
+	t.Run("NewKeyStore: ephemeral key", func(t *testing.T) {
+		_, err := NewKeyStore("", "", entities.SigningAlgorithmEdDSA)
+		assert.NoError(t, err)
+	})
+}
+
+func TestRotateKeySet(t *testing.T) {
+	now := time.Now().UTC()
+	const (
+		rotateAfter   = 30 * 24 * time.Hour
+		activateAfter = 10 * time.Minute
+		retireAfter   = 2 * time.Hour
+		removeAfter   = 7 * 24 * time.Hour
+	)
+	rotate := func(keys entities.SigningKeySet, at time.Time, force bool) entities.SigningKeySet {
+		rotated, err := RotateKeySet(
+			keys, at, entities.SigningAlgorithmHS256, rotateAfter, activateAfter, retireAfter, removeAfter, force,
+		)
+		require.NoError(t, err)
+		return rotated
+	}
+
+	first := rotate(entities.SigningKeySet{}, now, false)
+	require.Len(t, first.Keys, 1)
+	assert.Nil(t, first.Keys[0].ActivateAfter, "the first key signs at once")
+
+	second := rotate(first, now.Add(time.Minute), true)
+	require.Len(t, second.Keys, 2)
+	pending := second.Keys[1]
+	require.NotNil(t, pending.ActivateAfter)
+	assert.Equal(t, now.Add(time.Minute+activateAfter), *pending.ActivateAfter)
+	assert.Len(t, rotate(second, now.Add(2*time.Minute), false).Keys, 2, "no new key while one is pending")
+
+	t.Run("RotateKeySet: pending key is published but does not sign", func(t *testing.T) {
+		active, err := activeKey(second, now.Add(2*time.Minute))
+		require.NoError(t, err)
+		assert.Equal(t, first.Keys[0].ID, active.ID)
+
+		envKeys, err := json.Marshal(second)
+		require.NoError(t, err)
+		store, err := NewKeyStore("", string(envKeys), entities.SigningAlgorithmHS256)
+		require.NoError(t, err)
+		_, err = store.VerificationKey(pending.ID)
+		assert.NoError(t, err)
+		active, err = store.ActiveKey()
+		require.NoError(t, err)
+		assert.Equal(t, first.Keys[0].ID, active.ID)
+	})
+
+	t.Run("RotateKeySet: pending key signs after activation", func(t *testing.T) {
+		active, err := activeKey(second, pending.ActivateAfter.Add(time.Second))
+		require.NoError(t, err)
+		assert.Equal(t, pending.ID, active.ID)
+	})
+
+	t.Run("RotateKeySet: superseded key is retired after activation of its successor", func(t *testing.T) {
+		rotated := rotate(second, now.Add(retireAfter+2*time.Minute), false)
+		assert.Nil(t, rotated.Keys[0].RetiredAt, "counted from the activation, not the creation")
+
+		rotated = rotate(second, pending.ActivateAfter.Add(retireAfter), false)
+		assert.NotNil(t, rotated.Keys[0].RetiredAt)
+	})
+}
@@ -0,0 +1,83 @@
+package repo
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+// memoryLoginAttempts keeps failed login counters in process memory. It is
+// enough for a single node; replicas have to share the Postgres backend.
+type memoryLoginAttempts struct {
+	mu       sync.Mutex
+	attempts map[string]entities.LoginAttempts
+}
+
+// AddLoginAttempt counts an attempt for key and returns the counter as it
+// was before. A counter whose last failure is older than resetBefore starts
+// over.
+func (m *memoryLoginAttempts) AddLoginAttempt(
+	_ context.Context, key string, now, resetBefore time.Time,
+) (entities.LoginAttempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous := m.attempts[key]
+	attempts := previous
+	if attempts.LastFailureAt.Before(resetBefore) {
+		attempts = entities.LoginAttempts{}
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = now
+	m.attempts[key] = attempts
+	return previous, nil
+}
+
+// ForgiveLoginAttempt takes one attempt back from the counter of key.
+func (m *memoryLoginAttempts) ForgiveLoginAttempt(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	attempts, ok := m.attempts[key]
+	if !ok {
+		return nil
+	}
+	if attempts.Failures <= 1 {
+		delete(m.attempts, key)
+		return nil
+	}
+	attempts.Failures--
+	m.attempts[key] = attempts
+	return nil
+}
+
+// DeleteExpiredLoginAttempts drops counters whose last failure is older
+// than before. It runs on a timer rather than on every attempt, so a flood
+// of attempts does not sweep the whole map each time.
+func (m *memoryLoginAttempts) DeleteExpiredLoginAttempts(_ context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, attempts := range m.attempts {
+		if attempts.LastFailureAt.Before(before) {
+			delete(m.attempts, key)
+		}
+	}
+	return nil
+}
+
+func (m *memoryLoginAttempts) ResetLoginAttempts(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, key)
+	return nil
+}
+
+func NewMemoryLoginAttempts() *memoryLoginAttempts {
+	return &memoryLoginAttempts{
+		attempts: make(map[string]entities.LoginAttempts),
+	}
+}
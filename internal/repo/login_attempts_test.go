@@ -0,0 +1,59 @@
+package repo
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+func TestMemoryLoginAttempts(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	resetBefore := now.Add(-15 * time.Minute)
+
+	t.Run("AddLoginAttempt: parallel attempts each see the ones before", func(t *testing.T) {
+		attempts := NewMemoryLoginAttempts()
+		seen := make([]int, 10)
+		var wg sync.WaitGroup
+		for i := range seen {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				previous, err := attempts.AddLoginAttempt(ctx, "login:login", now, resetBefore)
+				assert.NoError(t, err)
+				seen[i] = previous.Failures
+			}(i)
+		}
+		wg.Wait()
+		assert.ElementsMatch(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, seen)
+	})
+
+	t.Run("AddLoginAttempt: old counter starts over", func(t *testing.T) {
+		attempts := NewMemoryLoginAttempts()
+		attempts.attempts["login:login"] = entities.LoginAttempts{Failures: 9, LastFailureAt: now.Add(-time.Hour)}
+		_, err := attempts.AddLoginAttempt(ctx, "login:login", now, resetBefore)
+		assert.NoError(t, err)
+		assert.Equal(t, entities.LoginAttempts{Failures: 1, LastFailureAt: now}, attempts.attempts["login:login"])
+	})
+
+	t.Run("DeleteExpiredLoginAttempts: drops old counters only", func(t *testing.T) {
+		attempts := NewMemoryLoginAttempts()
+		attempts.attempts["ip:old"] = entities.LoginAttempts{Failures: 1, LastFailureAt: now.Add(-time.Hour)}
+		attempts.attempts["ip:new"] = entities.LoginAttempts{Failures: 1, LastFailureAt: now}
+		assert.NoError(t, attempts.DeleteExpiredLoginAttempts(ctx, resetBefore))
+		assert.Len(t, attempts.attempts, 1)
+		assert.Contains(t, attempts.attempts, "ip:new")
+	})
+
+	t.Run("ForgiveLoginAttempt: takes one back", func(t *testing.T) {
+		attempts := NewMemoryLoginAttempts()
+		attempts.attempts["ip:ip"] = entities.LoginAttempts{Failures: 2, LastFailureAt: now}
+		assert.NoError(t, attempts.ForgiveLoginAttempt(ctx, "ip:ip"))
+		assert.Equal(t, 1, attempts.attempts["ip:ip"].Failures)
+	})
+}
@@ -0,0 +1,106 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+// storedLogin is the login of one user as stored.
+type storedLogin struct {
+	id    string
+	login string
+}
+
+// normalizeLogins rewrites logins stored before they were normalised, once
+// per database. It is done here with utils.NormalizeLogin rather than with
+// lower() in SQL, whose result depends on the database collation, so the
+// stored logins are exactly what the lookups compare against.
+func normalizeLogins(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			utils.Logger.Error(err.Error())
+		}
+	}(tx)
+
+	// Replicas starting together wait here for the first one to finish.
+	result, err := tx.ExecContext(
+		ctx, "INSERT INTO data_migrations (name) VALUES ('normalize_logins') ON CONFLICT DO NOTHING;",
+	)
+	if err != nil {
+		return err
+	}
+	if applied, err := result.RowsAffected(); err != nil || applied == 0 {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, login FROM users FOR UPDATE;")
+	if err != nil {
+		return err
+	}
+	var logins []storedLogin
+	for rows.Next() {
+		var login storedLogin
+		if err = rows.Scan(&login.id, &login.login); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		logins = append(logins, login)
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, rename := range renameLogins(logins) {
+		_, err = tx.ExecContext(ctx, "UPDATE users SET login=$1 WHERE id=$2;", rename.login, rename.id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// renameLogins returns the new login of every user whose login is not
+// normalised. Logins that differ only in case or surrounding whitespace used
+// to be separate accounts. The one already stored in normal form, or else
+// the one with the lowest id, keeps the login; the others get their id
+// appended so they stay unique and can still log in.
+func renameLogins(logins []storedLogin) []storedLogin {
+	groups := make(map[string][]storedLogin)
+	for _, login := range logins {
+		normalized := utils.NormalizeLogin(login.login)
+		groups[normalized] = append(groups[normalized], login)
+	}
+
+	var renames []storedLogin
+	for normalized, group := range groups {
+		sort.Slice(group, func(i, j int) bool {
+			iNormal, jNormal := group[i].login == normalized, group[j].login == normalized
+			if iNormal != jNormal {
+				return iNormal
+			}
+			return group[i].id < group[j].id
+		})
+		for i, login := range group {
+			switch {
+			case i > 0:
+				renames = append(renames, storedLogin{id: login.id, login: normalized + "#" + login.id})
+			case login.login != normalized:
+				renames = append(renames, storedLogin{id: login.id, login: normalized})
+			}
+		}
+	}
+	sort.Slice(renames, func(i, j int) bool { return renames[i].id < renames[j].id })
+	return renames
+}
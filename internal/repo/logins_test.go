@@ -0,0 +1,87 @@
+package repo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenameLogins(t *testing.T) {
+	tests := []struct {
+		name     string
+		logins   []storedLogin
+		expected []storedLogin
+	}{
+		{
+			name:     "renameLogins: normal logins stay",
+			logins:   []storedLogin{{id: "1", login: "user"}, {id: "2", login: "ärger"}},
+			expected: nil,
+		},
+		{
+			name:     "renameLogins: case and whitespace are normalised",
+			logins:   []storedLogin{{id: "1", login: " User\t"}},
+			expected: []storedLogin{{id: "1", login: "user"}},
+		},
+		{
+			name:     "renameLogins: non-ASCII logins are lowercased",
+			logins:   []storedLogin{{id: "1", login: "ÄRGER"}, {id: "2", login: "ΣΊΣΥΦΟΣ"}},
+			expected: []storedLogin{{id: "1", login: "ärger"}, {id: "2", login: "σίσυφοσ"}},
+		},
+		{
+			name: "renameLogins: normal form keeps the login",
+			logins: []storedLogin{
+				{id: "1", login: "Dup"}, {id: "2", login: " dup"}, {id: "3", login: "dup"},
+			},
+			expected: []storedLogin{{id: "1", login: "dup#1"}, {id: "2", login: "dup#2"}},
+		},
+		{
+			name:     "renameLogins: else the lowest id keeps it",
+			logins:   []storedLogin{{id: "2", login: "Ärger"}, {id: "1", login: "ÄRGER"}},
+			expected: []storedLogin{{id: "1", login: "ärger"}, {id: "2", login: "ärger#2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, renameLogins(tt.logins))
+		})
+	}
+}
+
+func TestNormalizeLogins(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	storage := newTestRepository(t, ctx)
+
+	// Go back to a database from before logins were normalised.
+	_, err := storage.db.ExecContext(ctx, "DELETE FROM data_migrations WHERE name='normalize_logins';")
+	require.NoError(t, err)
+	suffix := uuid.New().String()
+	ids := []string{uuid.New().String(), uuid.New().String(), uuid.New().String(), uuid.New().String()}
+	logins := []string{"Dup-" + suffix, " dup-" + suffix + "\t", "dup-" + suffix, "ÄRGER-" + suffix}
+	for i, id := range ids {
+		_, err = storage.db.ExecContext(
+			ctx, "INSERT INTO users (id, login, password) VALUES ($1, $2, 'hash');", id, logins[i],
+		)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, normalizeLogins(ctx, storage.db))
+
+	user, err := storage.GetUserByLogin(ctx, "dup-"+suffix)
+	require.NoError(t, err)
+	assert.Equal(t, ids[2], user.ID)
+	for _, id := range ids[:2] {
+		user, err = storage.GetUserByLogin(ctx, "dup-"+suffix+"#"+id)
+		require.NoError(t, err)
+		assert.Equal(t, id, user.ID)
+	}
+	user, err = storage.GetUserByLogin(ctx, "ärger-"+suffix)
+	require.NoError(t, err)
+	assert.Equal(t, ids[3], user.ID)
+	err = storage.Register(ctx, uuid.New().String(), "dup-"+suffix, "hash", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+// ClaimDueOrders leases up to limit orders whose accrual check is due. Rows
+// locked by another replica are skipped, and a leased order is not claimed
+// again until the lease runs out, so a crashed worker's orders come back
+// on their own.
+func (r *repository) ClaimDueOrders(
+	ctx context.Context, limit int, lease time.Duration,
+) ([]entities.AccrualJob, error) {
+	return r.claimOrders(
+		ctx,
+		`SELECT order_number FROM orders
+		WHERE next_check_at <= now() AND (locked_until IS NULL OR locked_until < now())
+		ORDER BY next_check_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`,
+		lease, limit,
+	)
+}
+
+// ClaimOrders leases those of the given orders that are due and not leased
+// already, the same way ClaimDueOrders does.
+func (r *repository) ClaimOrders(
+	ctx context.Context, numbers []entities.OrderNumber, lease time.Duration,
+) ([]entities.AccrualJob, error) {
+	orderNumbers := make([]string, 0, len(numbers))
+	for _, number := range numbers {
+		orderNumbers = append(orderNumbers, string(number))
+	}
+	return r.claimOrders(
+		ctx,
+		`SELECT order_number FROM orders
+		WHERE order_number = ANY($2::text[])
+		AND next_check_at <= now() AND (locked_until IS NULL OR locked_until < now())
+		FOR UPDATE SKIP LOCKED`,
+		lease, orderNumbers,
+	)
+}
+
+// claimOrders leases the orders selected by the given query, which gets its
+// argument as $2.
+func (r *repository) claimOrders(
+	ctx context.Context, selectOrders string, lease time.Duration, arg interface{},
+) ([]entities.AccrualJob, error) {
+	orders := []entities.AccrualJob{}
+
+	rows, err := r.db.QueryContext(
+		ctx,
+		`UPDATE orders SET locked_until = now() + $1 * interval '1 second'
+		WHERE order_number IN (`+selectOrders+`)
+		RETURNING order_number, status, accrual, uploaded_at, check_attempts, deferred_checks;`,
+		lease.Seconds(), arg,
+	)
+	if err != nil {
+		return orders, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			utils.Logger.Error(err.Error())
+		}
+	}(rows)
+
+	for rows.Next() {
+		var order entities.AccrualJob
+		var uploadedAt sql.NullTime
+		err = rows.Scan(
+			&order.OrderID, &order.Status, &order.Accrual, &uploadedAt, &order.Attempts, &order.Deferrals,
+		)
+		if err != nil {
+			return orders, err
+		}
+		order.UploadedAt = localWallClock(uploadedAt)
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// ReleaseOrder gives up the lease on an order without news from the accrual
+// service, counts the attempt and schedules the next check.
+func (r *repository) ReleaseOrder(ctx context.Context, number entities.OrderNumber, nextCheckAt time.Time) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		`UPDATE orders SET next_check_at=$1, locked_until=NULL, check_attempts = check_attempts + 1
+		WHERE order_number=$2 AND next_check_at IS NOT NULL;`,
+		nextCheckAt, number,
+	)
+	return err
+}
+
+// DeferOrder gives up the lease on an order the accrual service put off and
+// schedules the next check. Unlike ReleaseOrder it does not count an
+// attempt.
+func (r *repository) DeferOrder(ctx context.Context, number entities.OrderNumber, nextCheckAt time.Time) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		`UPDATE orders SET next_check_at=$1, locked_until=NULL, deferred_checks = deferred_checks + 1
+		WHERE order_number=$2 AND next_check_at IS NOT NULL;`,
+		nextCheckAt, number,
+	)
+	return err
+}
+
+// DeadLetterOrder takes an order the accrual checks keep failing on off the
+// queue. It keeps its status; the reason is stored for whoever looks into
+// it.
+func (r *repository) DeadLetterOrder(ctx context.Context, number entities.OrderNumber, reason string) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		`UPDATE orders SET next_check_at=NULL, locked_until=NULL, check_attempts = check_attempts + 1,
+		dead_lettered_at=now(), dead_letter_reason=$1
+		WHERE order_number=$2 AND next_check_at IS NOT NULL;`,
+		reason, number,
+	)
+	return err
+}
+
+// ListDeadLetteredOrders returns dead-lettered orders, most recent first.
+func (r *repository) ListDeadLetteredOrders(ctx context.Context, limit int) ([]entities.DeadLetteredOrder, error) {
+	orders := []entities.DeadLetteredOrder{}
+
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT order_number, user_id, status, check_attempts, coalesce(dead_letter_reason, ''), dead_lettered_at
+		FROM orders WHERE dead_lettered_at IS NOT NULL
+		ORDER BY dead_lettered_at DESC, order_number LIMIT $1;`,
+		limit,
+	)
+	if err != nil {
+		return orders, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			utils.Logger.Error(err.Error())
+		}
+	}(rows)
+
+	for rows.Next() {
+		var order entities.DeadLetteredOrder
+		err = rows.Scan(
+			&order.OrderID, &order.UserID, &order.Status, &order.Attempts, &order.Reason, &order.DeadLetteredAt,
+		)
+		if err != nil {
+			return orders, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// RequeueOrder puts a dead-lettered order back on the queue with its
+// attempts reset, due now.
+func (r *repository) RequeueOrder(ctx context.Context, number entities.OrderNumber) error {
+	result, err := r.db.ExecContext(
+		ctx,
+		`UPDATE orders SET next_check_at=now(), locked_until=NULL, check_attempts=0, deferred_checks=0,
+		dead_lettered_at=NULL, dead_letter_reason=NULL
+		WHERE order_number=$1 AND dead_lettered_at IS NOT NULL;`,
+		number,
+	)
+	if err != nil {
+		return err
+	}
+	requeued, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if requeued == 0 {
+		return entities.ErrOrderNotDeadLettered
+	}
+	return nil
+}
+
+// localWallClock reads uploaded_at back as the local time it was written
+// in. Rows without one count as uploaded now.
+func localWallClock(t sql.NullTime) time.Time {
+	if !t.Valid {
+		return time.Now()
+	}
+	return time.Date(
+		t.Time.Year(), t.Time.Month(), t.Time.Day(),
+		t.Time.Hour(), t.Time.Minute(), t.Time.Second(), t.Time.Nanosecond(), time.Local,
+	)
+}
@@ -3,8 +3,10 @@ package repo
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgconn"
@@ -23,6 +25,21 @@ const schema = `
 		login text not null unique,
 		password text not null
 	);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS role text not null default 'user';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS email text;
+	-- Logins are normalised by normalizeLogins and the application, not by
+	-- lower(), which depends on the collation; plain equality finds them.
+	DROP INDEX IF EXISTS users_login_lower_idx;
+	DROP INDEX IF EXISTS users_login_normalized_idx;
+	DROP FUNCTION IF EXISTS normalize_login(text);
+	CREATE TABLE IF NOT EXISTS data_migrations (
+	    name text primary key,
+	    applied_at timestamptz not null default now()
+	);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret text;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean not null default false;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint not null default 0;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
 	CREATE TABLE IF NOT EXISTS orders (
 	  	"order_number" text primary key unique,
 	  	user_id text not null references users(id),
@@ -30,12 +47,173 @@ const schema = `
 	    accrual float not null default 0,
 	    uploaded_at timestamp
 	);
+	CREATE INDEX IF NOT EXISTS orders_user_uploaded_idx ON orders (user_id, uploaded_at, order_number);
+	CREATE INDEX IF NOT EXISTS orders_user_status_uploaded_idx ON orders (user_id, status, uploaded_at, order_number);
+	DO $$
+	BEGIN
+	    -- Orders are queued for accrual checks by next_check_at. When the
+	    -- column is first added, every unfinished order is queued.
+	    IF NOT EXISTS (
+	        SELECT 1 FROM information_schema.columns
+	        WHERE table_schema = current_schema() AND table_name = 'orders' AND column_name = 'next_check_at'
+	    ) THEN
+	        ALTER TABLE orders ADD COLUMN next_check_at timestamptz;
+	        UPDATE orders SET next_check_at = now() WHERE status IN ('NEW', 'PROCESSING');
+	    END IF;
+	END
+	$$;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS locked_until timestamptz;
+	-- check_attempts counts checks in a row that brought no news. Orders
+	-- that run out of attempts are dead-lettered: taken off the queue with
+	-- the reason, until someone looks into them.
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS check_attempts int not null default 0;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS dead_lettered_at timestamptz;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS dead_letter_reason text;
+	-- deferred_checks counts checks the accrual service put off. They only
+	-- stretch the wait between checks and never dead-letter an order.
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS deferred_checks int not null default 0;
+	-- Orders may only hold the statuses of entities.OrderStatus. REGISTERED,
+	-- the accrual system's word, was stored as is and means PROCESSING here.
+	-- Empty statuses were written over orders from unusable accrual answers
+	-- and start over as NEW. Either way the order is queued for a check.
+	UPDATE orders
+	SET status = CASE status WHEN 'REGISTERED' THEN 'PROCESSING' ELSE 'NEW' END,
+	    next_check_at = coalesce(next_check_at, now())
+	WHERE status IN ('REGISTERED', '');
+	CREATE INDEX IF NOT EXISTS orders_next_check_idx ON orders (next_check_at) WHERE next_check_at IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS orders_dead_lettered_idx ON orders (dead_lettered_at)
+	    WHERE dead_lettered_at IS NOT NULL;
+	CREATE TABLE IF NOT EXISTS order_status_history (
+	    id bigserial primary key,
+	    order_number text not null references orders(order_number),
+	    status text not null,
+	    accrual float not null default 0,
+	    accrual_response jsonb,
+	    changed_at timestamptz not null default now()
+	);
+	CREATE INDEX IF NOT EXISTS order_status_history_order_idx ON order_status_history (order_number, id);
 	CREATE TABLE IF NOT EXISTS withdrawals (
 	    "order_number" text primary key unique,
 	    user_id text not null references users(id),
 		"withdraw" float not null,
 		processed_at timestamp
 	);
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+	    token_hash text primary key,
+	    user_id text not null references users(id),
+	    family_id text not null,
+	    expires_at timestamptz not null,
+	    used_at timestamptz,
+	    revoked_at timestamptz
+	);
+	CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (family_id);
+	CREATE TABLE IF NOT EXISTS revoked_tokens (
+	    jti text primary key,
+	    expires_at timestamptz not null
+	);
+	CREATE TABLE IF NOT EXISTS password_reset_tokens (
+	    token_hash text primary key,
+	    user_id text not null references users(id),
+	    expires_at timestamptz not null,
+	    used_at timestamptz
+	);
+	CREATE TABLE IF NOT EXISTS account_deletion_tokens (
+	    token_hash text primary key,
+	    user_id text not null references users(id),
+	    expires_at timestamptz not null,
+	    used_at timestamptz
+	);
+	CREATE TABLE IF NOT EXISTS api_keys (
+	    id text primary key,
+	    user_id text not null references users(id),
+	    name text not null,
+	    prefix text not null,
+	    key_hash text not null unique,
+	    scopes text not null,
+	    created_at timestamptz not null,
+	    last_used_at timestamptz,
+	    revoked_at timestamptz
+	);
+	CREATE INDEX IF NOT EXISTS api_keys_user_idx ON api_keys (user_id);
+	CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+	    user_id text not null references users(id),
+	    code_hash text not null,
+	    used_at timestamptz,
+	    primary key (user_id, code_hash)
+	);
+	CREATE TABLE IF NOT EXISTS sessions (
+	    id text primary key,
+	    user_id text not null references users(id),
+	    user_agent text not null,
+	    ip text not null,
+	    created_at timestamptz not null,
+	    last_seen_at timestamptz not null,
+	    terminated_at timestamptz
+	);
+	CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id);
+	CREATE TABLE IF NOT EXISTS oidc_states (
+	    state_hash text primary key,
+	    code_verifier text not null,
+	    nonce text not null,
+	    expires_at timestamptz not null
+	);
+	CREATE TABLE IF NOT EXISTS user_identities (
+	    issuer text not null,
+	    subject text not null,
+	    user_id text not null references users(id),
+	    created_at timestamptz not null default now(),
+	    primary key (issuer, subject)
+	);
+	CREATE TABLE IF NOT EXISTS audit_events (
+	    id bigserial primary key,
+	    type text not null,
+	    actor_id text,
+	    ip text not null,
+	    request_id text not null,
+	    payload jsonb,
+	    created_at timestamptz not null default now()
+	);
+	CREATE INDEX IF NOT EXISTS audit_events_actor_idx ON audit_events (actor_id, created_at);
+	CREATE INDEX IF NOT EXISTS audit_events_created_idx ON audit_events (created_at);
+	-- Personal data in events may only be blanked, for erasure, by
+	-- transactions that opt in with audit.erasure. What happened and when
+	-- is kept.
+	CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+	BEGIN
+	    IF TG_OP = 'UPDATE' AND current_setting('audit.erasure', true) = 'on'
+	        AND NEW.id = OLD.id AND NEW.type = OLD.type AND NEW.request_id = OLD.request_id
+	        AND NEW.created_at = OLD.created_at THEN
+	        RETURN NEW;
+	    END IF;
+	    RAISE EXCEPTION 'audit_events is append-only';
+	END;
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+	CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+	    FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+	DO $$
+	BEGIN
+	    -- Logins used to be kept in the payload in the clear. Without the
+	    -- pseudonym key they can't be converted, so they are dropped.
+	    IF NOT EXISTS (
+	        SELECT 1 FROM information_schema.columns
+	        WHERE table_schema = current_schema() AND table_name = 'audit_events' AND column_name = 'login_hash'
+	    ) THEN
+	        ALTER TABLE audit_events ADD COLUMN login_hash text;
+	        PERFORM set_config('audit.erasure', 'on', true);
+	        UPDATE audit_events SET payload = payload - 'login' WHERE payload ? 'login';
+	        PERFORM set_config('audit.erasure', 'off', true);
+	    END IF;
+	END
+	$$;
+	CREATE INDEX IF NOT EXISTS audit_events_login_idx ON audit_events (login_hash, created_at)
+	    WHERE login_hash IS NOT NULL;
+	CREATE TABLE IF NOT EXISTS login_attempts (
+	    key text primary key,
+	    failures int not null,
+	    last_failure_at timestamptz not null
+	);
+	CREATE INDEX IF NOT EXISTS login_attempts_last_failure_idx ON login_attempts (last_failure_at);
  	`
 
 type repository struct {
@@ -43,24 +221,125 @@ type repository struct {
 	ctx context.Context
 }
 
-func (r *repository) UpdateOrder(ctx context.Context, order entities.Order) error {
-	updateOrder, err := r.db.PrepareContext(
-		ctx, "UPDATE orders SET status=$1, accrual=$2 WHERE order_number=$3;",
-	)
-	defer func(updateOrder *sql.Stmt) {
-		err = updateOrder.Close()
-		if err != nil {
+// UpdateOrder stores the accrual service's view of an order and releases
+// its lease. An unfinished order is checked again at nextCheckAt. A change
+// of status or accrual is added to the order's history together with the
+// raw response it came from and resets the order's check attempts; polls
+// that change nothing only count as an attempt.
+func (r *repository) UpdateOrder(
+	ctx context.Context, order entities.Order, accrualResponse []byte, nextCheckAt time.Time,
+) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
 			utils.Logger.Error(err.Error())
 		}
-	}(updateOrder)
+	}()
+
+	var status entities.OrderStatus
+	var accrual float64
+	err = tx.QueryRowContext(
+		ctx, "SELECT status, accrual FROM orders WHERE order_number=$1 FOR UPDATE;", order.OrderID,
+	).Scan(&status, &accrual)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.ErrOrderNotFound
+	}
+	if err != nil {
+		return err
+	}
+	changed := status != order.Status || accrual != order.Accrual
+	if changed && !status.CanTransitionTo(order.Status) {
+		return &entities.OrderTransitionError{Order: order.OrderID, From: status, To: order.Status}
+	}
+
+	var next interface{}
+	if !order.Status.Final() {
+		next = nextCheckAt
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE orders SET status=$1, accrual=$2, next_check_at=$3, locked_until=NULL,
+		check_attempts = CASE WHEN $5 THEN 0 ELSE check_attempts + 1 END,
+		deferred_checks = CASE WHEN $5 THEN 0 ELSE deferred_checks END
+		WHERE order_number=$4;`,
+		order.Status, order.Accrual, next, order.OrderID, changed,
+	)
 	if err != nil {
 		return err
 	}
-	_, err = updateOrder.ExecContext(ctx, order.Status, order.Accrual, order.OrderID)
+	if !changed {
+		return tx.Commit()
+	}
+	var response interface{}
+	if len(accrualResponse) > 0 {
+		response = string(accrualResponse)
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO order_status_history (order_number, status, accrual, accrual_response)
+		VALUES ($1, $2, $3, $4::jsonb);`,
+		order.OrderID, order.Status, order.Accrual, response,
+	)
 	if err != nil {
 		return err
 	}
-	return nil
+	return tx.Commit()
+}
+
+// GetOrder returns one of the user's orders with its status history, oldest
+// change first. Orders of other users are ErrOrderNotFound as well.
+func (r *repository) GetOrder(
+	ctx context.Context, userID string, number entities.OrderNumber,
+) (entities.OrderDetail, error) {
+	var detail entities.OrderDetail
+	var uploadedAt time.Time
+
+	err := r.db.QueryRowContext(
+		ctx,
+		"SELECT order_number, status, accrual, uploaded_at FROM orders WHERE order_number=$1 AND user_id=$2;",
+		number, userID,
+	).Scan(&detail.OrderID, &detail.Status, &detail.Accrual, &uploadedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return detail, entities.ErrOrderNotFound
+	}
+	if err != nil {
+		return detail, err
+	}
+	detail.UpdatedAt = uploadedAt.Format(time.RFC3339Nano)
+
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT status, accrual, coalesce(accrual_response::text, ''), changed_at
+		FROM order_status_history WHERE order_number=$1 ORDER BY id;`,
+		number,
+	)
+	if err != nil {
+		return detail, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			utils.Logger.Error(err.Error())
+		}
+	}(rows)
+
+	detail.History = []entities.OrderStatusChange{}
+	for rows.Next() {
+		var change entities.OrderStatusChange
+		var response string
+		err = rows.Scan(&change.Status, &change.Accrual, &response, &change.ChangedAt)
+		if err != nil {
+			return detail, err
+		}
+		if response != "" {
+			change.AccrualResponse = json.RawMessage(response)
+		}
+		detail.History = append(detail.History, change)
+	}
+	return detail, rows.Err()
 }
 
 func (r *repository) GetUserBalance(ctx context.Context, user string) (float64, error) {
@@ -176,57 +455,98 @@ func (r *repository) Withdraw(ctx context.Context, userID string, withdrawReques
 	return nil
 }
 
-func (r *repository) GetUserForOrder(ctx context.Context, order string) (string, error) {
-	var userID string
+// CreateOrder inserts the order unless the number is taken. A conflicting
+// insert waits for the row and reports its owner in the same statement, so
+// concurrent uploads of one number create it exactly once. It returns
+// ErrOrderAlreadyCreatedByThisUser or ErrOrderAlreadyCreatedByAnotherUser
+// when the number was already registered.
+func (r *repository) CreateOrder(ctx context.Context, order entities.Order, userID string) error {
+	var owner string
+	var created bool
 
-	selectUserIDForOrder, err := r.db.PrepareContext(
-		ctx, "SELECT user_id FROM orders WHERE order_number=$1;",
-	)
-	defer func(selectUserIDForOrder *sql.Stmt) {
-		err := selectUserIDForOrder.Close()
-		if err != nil {
-			utils.Logger.Error(err.Error())
-		}
-	}(selectUserIDForOrder)
+	// The no-op update makes RETURNING yield the existing row on conflict;
+	// xmax is zero only for a freshly inserted row.
+	// The initial status starts the order's history in the same statement.
+	err := r.db.QueryRowContext(
+		ctx,
+		`WITH upserted AS (
+			INSERT INTO orders (order_number, user_id, status, uploaded_at, next_check_at)
+			VALUES ($1, $2, $3, $4, now())
+			ON CONFLICT (order_number) DO UPDATE SET user_id = orders.user_id
+			RETURNING order_number, user_id, status, xmax = 0 AS created
+		), history AS (
+			INSERT INTO order_status_history (order_number, status)
+			SELECT order_number, status FROM upserted WHERE created
+		)
+		SELECT user_id, created FROM upserted;`,
+		order.OrderID, userID, order.Status, time.Now().Format(time.RFC3339),
+	).Scan(&owner, &created)
 	if err != nil {
-		return "", err
+		return err
 	}
-	err = selectUserIDForOrder.QueryRowContext(ctx, order).Scan(&userID)
-
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return "", entities.ErrNoOrderForUser
-		} else {
-			return "", err
-		}
+	if created {
+		return nil
 	}
-	return userID, nil
+	if owner == userID {
+		return entities.ErrOrderAlreadyCreatedByThisUser
+	}
+	return entities.ErrOrderAlreadyCreatedByAnotherUser
 }
 
-func (r *repository) CreateOrder(ctx context.Context, order entities.Order, userID string) error {
-	now := time.Now()
-	uploadedAt := now.Format(time.RFC3339)
+// CreateOrders inserts a batch of distinct orders in one statement, in
+// number order so concurrent batches lock rows the same way. Like
+// CreateOrder it maps every number to nil when it was created or to the
+// error naming its existing owner.
+func (r *repository) CreateOrders(
+	ctx context.Context, orders []entities.Order, userID string,
+) (map[entities.OrderNumber]error, error) {
+	numbers := make([]string, 0, len(orders))
+	for _, order := range orders {
+		numbers = append(numbers, string(order.OrderID))
+	}
 
-	createOrder, err := r.db.PrepareContext(
-		ctx, "INSERT INTO orders (order_number, user_id, status, uploaded_at) VALUES ($1, $2, $3, $4);",
+	rows, err := r.db.QueryContext(
+		ctx,
+		`WITH upserted AS (
+			INSERT INTO orders (order_number, user_id, status, uploaded_at, next_check_at)
+			SELECT number, $2, $3, $4, now() FROM unnest($1::text[]) AS number ORDER BY number
+			ON CONFLICT (order_number) DO UPDATE SET user_id = orders.user_id
+			RETURNING order_number, user_id, status, xmax = 0 AS created
+		), history AS (
+			INSERT INTO order_status_history (order_number, status)
+			SELECT order_number, status FROM upserted WHERE created
+		)
+		SELECT order_number, user_id, created FROM upserted;`,
+		numbers, userID, entities.OrderStatusNew, time.Now().Format(time.RFC3339),
 	)
-	defer func(createOrder *sql.Stmt) {
-		err := createOrder.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
 		if err != nil {
 			utils.Logger.Error(err.Error())
 		}
-	}(createOrder)
-
-	if err != nil {
-		return err
-	}
-	_, err = createOrder.ExecContext(ctx, order.OrderID, userID, order.Status, uploadedAt)
+	}(rows)
 
-	if err != nil {
-		return err
+	results := make(map[entities.OrderNumber]error, len(orders))
+	for rows.Next() {
+		var number entities.OrderNumber
+		var owner string
+		var created bool
+		if err = rows.Scan(&number, &owner, &created); err != nil {
+			return nil, err
+		}
+		switch {
+		case created:
+			results[number] = nil
+		case owner == userID:
+			results[number] = entities.ErrOrderAlreadyCreatedByThisUser
+		default:
+			results[number] = entities.ErrOrderAlreadyCreatedByAnotherUser
+		}
 	}
-
-	return nil
+	return results, rows.Err()
 }
 
 func (r *repository) GetOrdersForUser(ctx context.Context, userID string) ([]entities.OrderWithTime, error) {
@@ -273,11 +593,77 @@ func (r *repository) GetOrdersForUser(ctx context.Context, userID string) ([]ent
 	return orders, nil
 }
 
-func (r *repository) Register(ctx context.Context, id, login, hashedPassword string) error {
+// ListOrders returns one page of the user's orders. Ties in upload time are
+// broken by number, so the cursor position is unambiguous.
+func (r *repository) ListOrders(
+	ctx context.Context, userID string, query entities.OrderListQuery,
+) ([]entities.OrderWithTime, error) {
+	orders := []entities.OrderWithTime{}
+
+	compare, direction := ">", "ASC"
+	if query.Descending {
+		compare, direction = "<", "DESC"
+	}
+	var afterTime, afterNumber interface{}
+	if query.After != nil {
+		afterTime, afterNumber = query.After.UploadedAt, string(query.After.Number)
+	}
+	statuses := make([]string, 0, len(query.Statuses))
+	for _, status := range query.Statuses {
+		statuses = append(statuses, string(status))
+	}
+
+	// uploaded_at holds the server's local wall time, so the range bounds
+	// are converted to it.
+	rows, err := r.db.QueryContext(
+		ctx,
+		fmt.Sprintf(
+			`SELECT order_number, status, accrual, uploaded_at FROM orders
+			WHERE user_id = $1
+			AND (cardinality($2::text[]) = 0 OR status = ANY($2::text[]))
+			AND ($3::timestamp IS NULL OR uploaded_at >= $3::timestamp)
+			AND ($4::timestamp IS NULL OR uploaded_at < $4::timestamp)
+			AND ($5::timestamp IS NULL OR (uploaded_at, order_number) %s ($5::timestamp, $6::text))
+			ORDER BY uploaded_at %s, order_number %s LIMIT $7;`,
+			compare, direction, direction,
+		),
+		userID, statuses, localTimeOrNull(query.From), localTimeOrNull(query.To), afterTime, afterNumber, query.Limit,
+	)
+	if err != nil {
+		return orders, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			utils.Logger.Error(err.Error())
+		}
+	}(rows)
+
+	for rows.Next() {
+		var order entities.OrderWithTime
+		var uploadedAt time.Time
+		err = rows.Scan(&order.OrderID, &order.Status, &order.Accrual, &uploadedAt)
+		if err != nil {
+			return orders, err
+		}
+		order.UpdatedAt = uploadedAt.Format(time.RFC3339Nano)
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+func localTimeOrNull(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Local()
+}
+
+func (r *repository) Register(ctx context.Context, id, login, hashedPassword, email string) error {
 	var pgErr *pgconn.PgError
 
 	insertCredentials, err := r.db.PrepareContext(
-		ctx, "INSERT INTO users (id, login, password) VALUES ($1, $2, $3);",
+		ctx, "INSERT INTO users (id, login, password, email) VALUES ($1, $2, $3, NULLIF($4, ''));",
 	)
 	if err != nil {
 		return err
@@ -288,7 +674,7 @@ func (r *repository) Register(ctx context.Context, id, login, hashedPassword str
 			utils.Logger.Error(err.Error())
 		}
 	}(insertCredentials)
-	_, err = insertCredentials.ExecContext(ctx, id, login, hashedPassword)
+	_, err = insertCredentials.ExecContext(ctx, id, login, hashedPassword, email)
 
 	if err != nil && errors.As(err, &pgErr) {
 		if pgErr.Code == uniqueViolationErr {
@@ -300,13 +686,120 @@ func (r *repository) Register(ctx context.Context, id, login, hashedPassword str
 	return nil
 }
 
+func (r *repository) UpdatePassword(ctx context.Context, userID, hashedPassword string) error {
+	updatePassword, err := r.db.PrepareContext(
+		ctx, "UPDATE users SET password=$1 WHERE id=$2;",
+	)
+	if err != nil {
+		return err
+	}
+	defer func(updatePassword *sql.Stmt) {
+		err := updatePassword.Close()
+		if err != nil {
+			utils.Logger.Error(err.Error())
+		}
+	}(updatePassword)
+
+	_, err = updatePassword.ExecContext(ctx, hashedPassword, userID)
+	return err
+}
+
+// SetUserRole changes the role of a user. A changed role ends all sessions
+// of the user in the same transaction, so no token with the old role
+// outlives the change.
+func (r *repository) SetUserRole(ctx context.Context, userID string, role entities.Role) error {
+	var current entities.Role
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			utils.Logger.Error(err.Error())
+		}
+	}(tx)
+
+	err = tx.QueryRowContext(ctx, "SELECT role FROM users WHERE id=$1 FOR UPDATE;", userID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if current == role {
+		return nil
+	}
+	if _, err = tx.ExecContext(ctx, "UPDATE users SET role=$1 WHERE id=$2;", string(role), userID); err != nil {
+		return err
+	}
+	if err = terminateUserSessions(ctx, tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// terminateUserSessions ends all sessions of the user and revokes all of
+// their refresh tokens. Access tokens of the sessions are refused by
+// TouchSession from then on.
+func terminateUserSessions(ctx context.Context, tx *sql.Tx, userID string) error {
+	_, err := tx.ExecContext(
+		ctx, "UPDATE sessions SET terminated_at=now() WHERE user_id=$1 AND terminated_at IS NULL;", userID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx, "UPDATE refresh_tokens SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL;", userID,
+	)
+	return err
+}
+
+// PromoteFirstAdmin makes the user with the given normalized login an admin
+// if there is no admin yet. It reports whether the user was promoted.
+func (r *repository) PromoteFirstAdmin(ctx context.Context, login string) (bool, error) {
+	result, err := r.db.ExecContext(
+		ctx,
+		`UPDATE users SET role='admin'
+		WHERE login=$1 AND deleted_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM users WHERE role='admin');`,
+		login,
+	)
+	if err != nil {
+		return false, err
+	}
+	promoted, err := result.RowsAffected()
+	return promoted > 0, err
+}
+
+func (r *repository) GetUserByID(ctx context.Context, userID string) (entities.User, error) {
+	return r.getUser(ctx, "SELECT id, login, password, role, coalesce(email, '') FROM users WHERE id=$1;", userID)
+}
+
+func (r *repository) GetUserByLogin(ctx context.Context, login string) (entities.User, error) {
+	return r.getUser(ctx, "SELECT id, login, password, role, coalesce(email, '') FROM users WHERE login=$1;", login)
+}
+
+func (r *repository) getUser(ctx context.Context, query, arg string) (entities.User, error) {
+	var user entities.User
+
+	err := r.db.QueryRowContext(ctx, query, arg).Scan(&user.ID, &user.Login, &user.Password, &user.Role, &user.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, entities.ErrUserNotFound
+	}
+	return user, err
+}
+
 func (r *repository) GetCredentials(ctx context.Context, login string) (entities.User, error) {
 	var user entities.User
 	var id string
 	var hashedPassword string
+	var role string
+	var totpEnabled bool
 
 	selectPassForLogin, err := r.db.PrepareContext(
-		ctx, "SELECT id, password FROM users WHERE login=$1;",
+		ctx, "SELECT id, password, role, totp_enabled FROM users WHERE login=$1;",
 	)
 	if err != nil {
 		return user, err
@@ -318,43 +811,943 @@ func (r *repository) GetCredentials(ctx context.Context, login string) (entities
 		}
 	}(selectPassForLogin)
 
-	err = selectPassForLogin.QueryRowContext(ctx, login).Scan(&id, &hashedPassword)
+	err = selectPassForLogin.QueryRowContext(ctx, login).Scan(&id, &hashedPassword, &role, &totpEnabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, entities.ErrInvalidCredentials
+	}
 	if err != nil {
 		return user, err
 	}
 	user.ID = id
 	user.Login = login
 	user.Password = hashedPassword
+	user.Role = entities.Role(role)
+	user.TOTPEnabled = totpEnabled
 	return user, nil
 }
 
-func (r *repository) Ping() error {
-	ctx, cancel := context.WithTimeout(r.ctx, 1*time.Second)
-	defer cancel()
-	err := r.db.PingContext(ctx)
+func (r *repository) SaveRefreshToken(ctx context.Context, token entities.RefreshToken) error {
+	insertToken, err := r.db.PrepareContext(
+		ctx, "INSERT INTO refresh_tokens (token_hash, user_id, family_id, expires_at) VALUES ($1, $2, $3, $4);",
+	)
 	if err != nil {
-		return fmt.Errorf("PingContext failed: %w", err)
+		return err
 	}
-	return nil
+	defer func(insertToken *sql.Stmt) {
+		err := insertToken.Close()
+		if err != nil {
+			utils.Logger.Error(err.Error())
+		}
+	}(insertToken)
+
+	_, err = insertToken.ExecContext(ctx, token.Hash, token.UserID, token.FamilyID, token.ExpiresAt.UTC())
+	return err
 }
 
-func (r *repository) Close() {
-	err := r.db.Close()
+// RotateRefreshToken marks the presented token as used and stores its
+// replacement in the same family. It returns the family ID, which is also
+// the ID of the session. Presenting an already used token means it was
+// stolen, so the whole family is revoked and its session terminated.
+func (r *repository) RotateRefreshToken(
+	ctx context.Context, oldHash string, newToken entities.RefreshToken,
+) (entities.User, string, error) {
+	var user entities.User
+	var familyID string
+	var expiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return
+		return user, "", err
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			utils.Logger.Error(err.Error())
+		}
+	}(tx)
+
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT t.family_id, t.expires_at, t.used_at, t.revoked_at, u.id, u.login, u.role
+		FROM refresh_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash=$1 FOR UPDATE OF t;`,
+		oldHash,
+	).Scan(&familyID, &expiresAt, &usedAt, &revokedAt, &user.ID, &user.Login, &user.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, "", entities.ErrInvalidRefreshToken
 	}
+	if err != nil {
+		return user, "", err
+	}
+	if revokedAt.Valid || time.Now().UTC().After(expiresAt) {
+		return user, "", entities.ErrInvalidRefreshToken
+	}
+	if usedAt.Valid {
+		_, err = tx.ExecContext(
+			ctx, "UPDATE refresh_tokens SET revoked_at=now() WHERE family_id=$1 AND revoked_at IS NULL;", familyID,
+		)
+		if err != nil {
+			return user, "", err
+		}
+		_, err = tx.ExecContext(
+			ctx, "UPDATE sessions SET terminated_at=now() WHERE id=$1 AND terminated_at IS NULL;", familyID,
+		)
+		if err != nil {
+			return user, "", err
+		}
+		if err = tx.Commit(); err != nil {
+			return user, "", err
+		}
+		return user, "", entities.ErrRefreshTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at=now() WHERE token_hash=$1;", oldHash)
+	if err != nil {
+		return user, "", err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO refresh_tokens (token_hash, user_id, family_id, expires_at) VALUES ($1, $2, $3, $4);",
+		newToken.Hash, user.ID, familyID, newToken.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		return user, "", err
+	}
+	// Families issued before sessions were tracked get a session on their
+	// first refresh, otherwise their access tokens would be refused.
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO sessions (id, user_id, user_agent, ip, created_at, last_seen_at)
+		VALUES ($1, $2, '', '', now(), now()) ON CONFLICT (id) DO NOTHING;`,
+		familyID, user.ID,
+	)
+	if err != nil {
+		return user, "", err
+	}
+	return user, familyID, tx.Commit()
 }
 
-func NewRepository(ctx context.Context, psqlConn string) (*repository, error) {
-	db, err := sql.Open("pgx", psqlConn)
+func (r *repository) RevokeRefreshTokenFamily(ctx context.Context, userID, tokenHash string) error {
+	revokeFamily, err := r.db.PrepareContext(
+		ctx,
+		`UPDATE refresh_tokens SET revoked_at=now()
+		WHERE revoked_at IS NULL AND family_id IN (
+			SELECT family_id FROM refresh_tokens WHERE token_hash=$1 AND user_id=$2
+		);`,
+	)
 	if err != nil {
-		return &repository{}, err
+		return err
 	}
-	if err = db.Ping(); err != nil {
-		return &repository{}, err
+	defer func(revokeFamily *sql.Stmt) {
+		err := revokeFamily.Close()
+		if err != nil {
+			utils.Logger.Error(err.Error())
+		}
+	}(revokeFamily)
+
+	_, err = revokeFamily.ExecContext(ctx, tokenHash, userID)
+	return err
+}
+
+func (r *repository) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := r.db.ExecContext(
+		ctx, "INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING;",
+		jti, expiresAt.UTC(),
+	)
+	if err != nil {
+		return err
 	}
-	_, err = db.ExecContext(ctx, schema)
+	// Entries are only needed until the token would have expired anyway.
+	_, err = r.db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < now();")
+	return err
+}
+
+// MarkTokenUsed records a single-use token as spent. It reports false when
+// the token was already used.
+func (r *repository) MarkTokenUsed(ctx context.Context, jti string, expiresAt time.Time) (bool, error) {
+	result, err := r.db.ExecContext(
+		ctx, "INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING;",
+		jti, expiresAt.UTC(),
+	)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return inserted == 1, nil
+}
+
+func (r *repository) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked bool
+
+	err := r.db.QueryRowContext(
+		ctx, "SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti=$1);", jti,
+	).Scan(&revoked)
+	return revoked, err
+}
+
+// ChangePassword sets a new password and ends all sessions of the user in
+// the same transaction.
+func (r *repository) ChangePassword(ctx context.Context, userID, hashedPassword string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			utils.Logger.Error(err.Error())
+		}
+	}(tx)
+
+	_, err = tx.ExecContext(ctx, "UPDATE users SET password=$1 WHERE id=$2;", hashedPassword, userID)
+	if err != nil {
+		return err
+	}
+	if err = terminateUserSessions(ctx, tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteUser anonymizes a user in place. The row stays because orders and
+// withdrawals reference it and are kept for accounting; everything else
+// that belongs to the user is removed. Audit events keep what happened, but
+// no longer who did it, from where, or whom it was done to. Failed logins
+// that never reached the account only carry the login's keyed pseudonym.
+func (r *repository) DeleteUser(ctx context.Context, userID, anonymizedLogin, unusablePassword string) error {
+	var login string
+
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			utils.Logger.Error(err.Error())
+		}
+	}(tx)
+
+	err = tx.QueryRowContext(
+		ctx, "SELECT login FROM users WHERE id=$1 AND deleted_at IS NULL FOR UPDATE;", userID,
+	).Scan(&login)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Children first, so no foreign key to users is left dangling.
+	for _, table := range []string{
+		"refresh_tokens", "password_reset_tokens", "account_deletion_tokens", "api_keys", "mfa_recovery_codes",
+		"sessions", "user_identities",
+	} {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE user_id=$1;", userID)
+		if err != nil {
+			return err
+		}
+	}
+	login = utils.NormalizeLogin(login)
+	_, err = tx.ExecContext(
+		ctx, "DELETE FROM login_attempts WHERE key IN ($1, $2, $3);",
+		"login:"+login, "reset-login:"+login, "user:"+userID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "SELECT set_config('audit.erasure', 'on', true);")
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx, "UPDATE audit_events SET actor_id=NULL, login_hash=NULL, ip='' WHERE actor_id=$1;", userID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx, "UPDATE audit_events SET payload = payload - 'user_id' WHERE payload->>'user_id' = $1;", userID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		`UPDATE users SET login=$1, password=$2, email=NULL, role='user',
+		totp_secret=NULL, totp_enabled=false, totp_last_step=0, deleted_at=now()
+		WHERE id=$3;`,
+		anonymizedLogin, unusablePassword, userID,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *repository) CreateSession(ctx context.Context, session entities.Session) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		`INSERT INTO sessions (id, user_id, user_agent, ip, created_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6);`,
+		session.ID, session.UserID, session.UserAgent, session.IP,
+		session.CreatedAt.UTC(), session.LastSeenAt.UTC(),
+	)
+	return err
+}
+
+// ListSessions returns sessions that are neither terminated nor expired,
+// i.e. still have a usable refresh token.
+func (r *repository) ListSessions(ctx context.Context, userID string) ([]entities.Session, error) {
+	sessions := []entities.Session{}
+
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT s.id, s.user_id, s.user_agent, s.ip, s.created_at, s.last_seen_at
+		FROM sessions s
+		WHERE s.user_id=$1 AND s.terminated_at IS NULL AND EXISTS (
+			SELECT 1 FROM refresh_tokens t
+			WHERE t.family_id = s.id AND t.used_at IS NULL AND t.revoked_at IS NULL AND t.expires_at > now()
+		)
+		ORDER BY s.last_seen_at DESC;`,
+		userID,
+	)
+	if err != nil {
+		return sessions, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			utils.Logger.Error(err.Error())
+		}
+	}(rows)
+
+	for rows.Next() {
+		var session entities.Session
+		err = rows.Scan(
+			&session.ID, &session.UserID, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastSeenAt,
+		)
+		if err != nil {
+			return sessions, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// TerminateSession ends a session of the user and revokes its refresh
+// tokens. Access tokens of the session are refused by TouchSession.
+func (r *repository) TerminateSession(ctx context.Context, userID, sessionID string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			utils.Logger.Error(err.Error())
+		}
+	}(tx)
+
+	result, err := tx.ExecContext(
+		ctx,
+		"UPDATE sessions SET terminated_at=now() WHERE id=$1 AND user_id=$2 AND terminated_at IS NULL;",
+		sessionID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return entities.ErrSessionNotFound
+	}
+	_, err = tx.ExecContext(
+		ctx, "UPDATE refresh_tokens SET revoked_at=now() WHERE family_id=$1 AND revoked_at IS NULL;", sessionID,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// TouchSession reports whether the session is still active and moves its
+// last-seen time forward. To spare a write per request, the time is only
+// updated once it is older than touchAfter.
+func (r *repository) TouchSession(ctx context.Context, sessionID string, touchAfter time.Duration) (bool, error) {
+	var terminatedAt sql.NullTime
+	var lastSeenAt time.Time
+
+	err := r.db.QueryRowContext(
+		ctx, "SELECT terminated_at, last_seen_at FROM sessions WHERE id=$1;", sessionID,
+	).Scan(&terminatedAt, &lastSeenAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if terminatedAt.Valid {
+		return false, nil
+	}
+	if time.Since(lastSeenAt) < touchAfter {
+		return true, nil
+	}
+	_, err = r.db.ExecContext(ctx, "UPDATE sessions SET last_seen_at=now() WHERE id=$1;", sessionID)
+	return true, err
+}
+
+func (r *repository) SavePasswordResetToken(ctx context.Context, token entities.PasswordResetToken) error {
+	_, err := r.db.ExecContext(
+		ctx, "INSERT INTO password_reset_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3);",
+		token.Hash, token.UserID, token.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+func (r *repository) SaveDeletionToken(ctx context.Context, token entities.DeletionToken) error {
+	_, err := r.db.ExecContext(
+		ctx, "INSERT INTO account_deletion_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3);",
+		token.Hash, token.UserID, token.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+// UseDeletionToken marks a deletion token of the user as used, or returns
+// ErrInvalidDeletionToken if it is unknown, used or expired.
+func (r *repository) UseDeletionToken(ctx context.Context, userID, tokenHash string) error {
+	result, err := r.db.ExecContext(
+		ctx,
+		`UPDATE account_deletion_tokens SET used_at=now()
+		WHERE token_hash=$1 AND user_id=$2 AND used_at IS NULL AND expires_at > now();`,
+		tokenHash, userID,
+	)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return entities.ErrInvalidDeletionToken
+	}
+	return nil
+}
+
+// ConsumePasswordResetToken sets a new password if the token is unused and
+// not expired. The token and all other pending reset tokens of the user are
+// invalidated and all sessions of the user ended in the same transaction.
+func (r *repository) ConsumePasswordResetToken(ctx context.Context, tokenHash, hashedPassword string) error {
+	var userID string
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			utils.Logger.Error(err.Error())
+		}
+	}(tx)
+
+	err = tx.QueryRowContext(
+		ctx,
+		`UPDATE password_reset_tokens SET used_at=now()
+		WHERE token_hash=$1 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id;`,
+		tokenHash,
+	).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE users SET password=$1 WHERE id=$2;", hashedPassword, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx, "UPDATE password_reset_tokens SET used_at=now() WHERE user_id=$1 AND used_at IS NULL;", userID,
+	)
+	if err != nil {
+		return err
+	}
+	if err = terminateUserSessions(ctx, tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *repository) CreateAPIKey(ctx context.Context, key entities.APIKey, keyHash string) error {
+	_, err := r.db.ExecContext(
+		ctx,
+		`INSERT INTO api_keys (id, user_id, name, prefix, key_hash, scopes, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+		key.ID, key.UserID, key.Name, key.Prefix, keyHash, strings.Join(key.Scopes, ","), key.CreatedAt.UTC(),
+	)
+	return err
+}
+
+func (r *repository) ListAPIKeys(ctx context.Context, userID string) ([]entities.APIKey, error) {
+	keys := []entities.APIKey{}
+
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT id, user_id, name, prefix, scopes, created_at, last_used_at, revoked_at
+		FROM api_keys WHERE user_id=$1 ORDER BY created_at;`,
+		userID,
+	)
+	if err != nil {
+		return keys, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			utils.Logger.Error(err.Error())
+		}
+	}(rows)
+
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (r *repository) RevokeAPIKey(ctx context.Context, userID, keyID string) error {
+	result, err := r.db.ExecContext(
+		ctx, "UPDATE api_keys SET revoked_at=now() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL;",
+		keyID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return entities.ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// UseAPIKey looks up a non-revoked key by hash and records that it was used.
+func (r *repository) UseAPIKey(ctx context.Context, keyHash string) (entities.APIKey, error) {
+	row := r.db.QueryRowContext(
+		ctx,
+		`UPDATE api_keys SET last_used_at=now() WHERE key_hash=$1 AND revoked_at IS NULL
+		RETURNING id, user_id, name, prefix, scopes, created_at, last_used_at, revoked_at;`,
+		keyHash,
+	)
+	key, err := scanAPIKey(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, entities.ErrInvalidAPIKey
+	}
+	return key, err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row rowScanner) (entities.APIKey, error) {
+	var key entities.APIKey
+	var scopes string
+	var lastUsedAt, revokedAt sql.NullTime
+
+	err := row.Scan(
+		&key.ID, &key.UserID, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &lastUsedAt, &revokedAt,
+	)
+	if err != nil {
+		return key, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	if lastUsedAt.Valid {
+		key.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, nil
+}
+
+func (r *repository) SaveOIDCState(ctx context.Context, state entities.OIDCState) error {
+	_, err := r.db.ExecContext(
+		ctx, "INSERT INTO oidc_states (state_hash, code_verifier, nonce, expires_at) VALUES ($1, $2, $3, $4);",
+		state.StateHash, state.CodeVerifier, state.Nonce, state.ExpiresAt.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	// Abandoned logins leave states behind.
+	_, err = r.db.ExecContext(ctx, "DELETE FROM oidc_states WHERE expires_at < now();")
+	return err
+}
+
+// ConsumeOIDCState deletes the state so each callback can be completed once.
+func (r *repository) ConsumeOIDCState(ctx context.Context, stateHash string) (entities.OIDCState, error) {
+	state := entities.OIDCState{StateHash: stateHash}
+
+	err := r.db.QueryRowContext(
+		ctx, "DELETE FROM oidc_states WHERE state_hash=$1 RETURNING code_verifier, nonce, expires_at;", stateHash,
+	).Scan(&state.CodeVerifier, &state.Nonce, &state.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return state, entities.ErrInvalidOIDCState
+	}
+	if err != nil {
+		return state, err
+	}
+	if time.Now().After(state.ExpiresAt) {
+		return state, entities.ErrInvalidOIDCState
+	}
+	return state, nil
+}
+
+func (r *repository) GetUserByIdentity(ctx context.Context, issuer, subject string) (entities.User, error) {
+	var user entities.User
+
+	err := r.db.QueryRowContext(
+		ctx,
+		`SELECT u.id, u.login, u.role, coalesce(u.email, ''), u.totp_enabled
+		FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.issuer=$1 AND i.subject=$2;`,
+		issuer, subject,
+	).Scan(&user.ID, &user.Login, &user.Role, &user.Email, &user.TOTPEnabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, entities.ErrUserNotFound
+	}
+	return user, err
+}
+
+// RegisterWithIdentity creates a user signed up through an OIDC provider
+// together with the link to their external subject.
+func (r *repository) RegisterWithIdentity(
+	ctx context.Context, user entities.User, identity entities.ExternalIdentity,
+) error {
+	var pgErr *pgconn.PgError
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			utils.Logger.Error(err.Error())
+		}
+	}(tx)
+
+	_, err = tx.ExecContext(
+		ctx, "INSERT INTO users (id, login, password, email) VALUES ($1, $2, $3, NULLIF($4, ''));",
+		user.ID, user.Login, user.Password, user.Email,
+	)
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolationErr {
+		return entities.ErrLoginAlreadyInUse
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx, "INSERT INTO user_identities (issuer, subject, user_id) VALUES ($1, $2, $3);",
+		identity.Issuer, identity.Subject, user.ID,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *repository) GetMFASettings(ctx context.Context, userID string) (entities.MFASettings, error) {
+	var settings entities.MFASettings
+
+	err := r.db.QueryRowContext(
+		ctx, "SELECT coalesce(totp_secret, ''), totp_enabled, totp_last_step FROM users WHERE id=$1;", userID,
+	).Scan(&settings.EncryptedSecret, &settings.Enabled, &settings.LastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return settings, entities.ErrUserNotFound
+	}
+	return settings, err
+}
+
+// SavePendingTOTPSecret stores a secret that becomes active only after
+// EnableTOTP. It never replaces the secret of an enabled second factor.
+func (r *repository) SavePendingTOTPSecret(ctx context.Context, userID, encryptedSecret string) error {
+	result, err := r.db.ExecContext(
+		ctx, "UPDATE users SET totp_secret=$1 WHERE id=$2 AND NOT totp_enabled;", encryptedSecret, userID,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return entities.ErrMFAAlreadyEnabled
+	}
+	return nil
+}
+
+func (r *repository) EnableTOTP(ctx context.Context, userID string, step int64, recoveryCodeHashes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			utils.Logger.Error(err.Error())
+		}
+	}(tx)
+
+	result, err := tx.ExecContext(
+		ctx,
+		"UPDATE users SET totp_enabled=true, totp_last_step=$1 WHERE id=$2 AND NOT totp_enabled AND totp_secret IS NOT NULL;",
+		step, userID,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return entities.ErrMFAAlreadyEnabled
+	}
+	if err = replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *repository) DisableTOTP(ctx context.Context, userID string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) {
+		err := tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			utils.Logger.Error(err.Error())
+		}
+	}(tx)
+
+	_, err = tx.ExecContext(
+		ctx, "UPDATE users SET totp_secret=NULL, totp_enabled=false, totp_last_step=0 WHERE id=$1;", userID,
+	)
+	if err != nil {
+		return err
+	}
+	if err = replaceRecoveryCodes(ctx, tx, userID, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID string, codeHashes []string) error {
+	_, err := tx.ExecContext(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id=$1;", userID)
+	if err != nil {
+		return err
+	}
+	for _, codeHash := range codeHashes {
+		_, err = tx.ExecContext(
+			ctx, "INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2);", userID, codeHash,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseTOTPStep records the time step of an accepted code. A step that is not
+// newer than the last accepted one is a replay and is refused.
+func (r *repository) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	result, err := r.db.ExecContext(
+		ctx, "UPDATE users SET totp_last_step=$1 WHERE id=$2 AND totp_last_step < $1;", step, userID,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return entities.ErrInvalidMFACode
+	}
+	return nil
+}
+
+func (r *repository) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	result, err := r.db.ExecContext(
+		ctx,
+		"UPDATE mfa_recovery_codes SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL;",
+		userID, codeHash,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return entities.ErrInvalidMFACode
+	}
+	return nil
+}
+
+func (r *repository) SaveAuditEvent(ctx context.Context, event entities.AuditEvent) error {
+	var payload interface{}
+	if len(event.Payload) > 0 {
+		payload = string(event.Payload)
+	}
+	_, err := r.db.ExecContext(
+		ctx,
+		`INSERT INTO audit_events (type, actor_id, login_hash, ip, request_id, payload, created_at)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5, $6::jsonb, $7);`,
+		event.Type, event.ActorID, event.LoginHash, event.IP, event.RequestID, payload, event.CreatedAt.UTC(),
+	)
+	return err
+}
+
+// ListAuditEvents returns events in the query range, newest first. An empty
+// UserID matches events of every actor, an empty LoginHash those about any
+// login.
+func (r *repository) ListAuditEvents(ctx context.Context, query entities.AuditQuery) ([]entities.AuditEvent, error) {
+	events := []entities.AuditEvent{}
+
+	rows, err := r.db.QueryContext(
+		ctx,
+		`SELECT id, type, coalesce(actor_id, ''), coalesce(login_hash, ''), ip, request_id,
+			coalesce(payload::text, ''), created_at
+		FROM audit_events
+		WHERE ($1 = '' OR actor_id = $1) AND ($2 = '' OR login_hash = $2) AND created_at >= $3 AND created_at < $4
+		ORDER BY created_at DESC, id DESC LIMIT $5;`,
+		query.UserID, query.LoginHash, query.From.UTC(), query.To.UTC(), query.Limit,
+	)
+	if err != nil {
+		return events, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			utils.Logger.Error(err.Error())
+		}
+	}(rows)
+
+	for rows.Next() {
+		var event entities.AuditEvent
+		var payload string
+		err = rows.Scan(
+			&event.ID, &event.Type, &event.ActorID, &event.LoginHash, &event.IP, &event.RequestID, &payload,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return events, err
+		}
+		if payload != "" {
+			event.Payload = json.RawMessage(payload)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// AddLoginAttempt counts an attempt for key in one statement and returns
+// the counter as it was before, so concurrent attempts against several
+// replicas each see the ones counted before them. Counters whose last
+// failure is older than resetBefore start over.
+func (r *repository) AddLoginAttempt(
+	ctx context.Context, key string, now, resetBefore time.Time,
+) (entities.LoginAttempts, error) {
+	var attempts entities.LoginAttempts
+	var lastFailureAt sql.NullTime
+
+	err := r.db.QueryRowContext(
+		ctx,
+		`WITH previous AS (
+			SELECT failures, last_failure_at FROM login_attempts WHERE key=$1 FOR UPDATE
+		), counted AS (
+			INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 1, $2)
+			ON CONFLICT (key) DO UPDATE SET
+				failures = CASE WHEN login_attempts.last_failure_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+				last_failure_at = EXCLUDED.last_failure_at
+			RETURNING 1
+		)
+		SELECT coalesce((SELECT failures FROM previous), 0), (SELECT last_failure_at FROM previous)
+		FROM counted;`,
+		key, now, resetBefore,
+	).Scan(&attempts.Failures, &lastFailureAt)
+	attempts.LastFailureAt = lastFailureAt.Time
+	return attempts, err
+}
+
+// ForgiveLoginAttempt takes one attempt back from the counter of key.
+func (r *repository) ForgiveLoginAttempt(ctx context.Context, key string) error {
+	_, err := r.db.ExecContext(
+		ctx, "UPDATE login_attempts SET failures = greatest(failures - 1, 0) WHERE key=$1;", key,
+	)
+	return err
+}
+
+// DeleteExpiredLoginAttempts drops counters whose last failure is older
+// than before.
+func (r *repository) DeleteExpiredLoginAttempts(ctx context.Context, before time.Time) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE last_failure_at < $1;", before)
+	return err
+}
+
+func (r *repository) ResetLoginAttempts(ctx context.Context, key string) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM login_attempts WHERE key=$1;", key)
+	return err
+}
+
+func (r *repository) Ping() error {
+	ctx, cancel := context.WithTimeout(r.ctx, 1*time.Second)
+	defer cancel()
+	err := r.db.PingContext(ctx)
+	if err != nil {
+		return fmt.Errorf("PingContext failed: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) Close() {
+	err := r.db.Close()
+	if err != nil {
+		return
+	}
+}
+
+func NewRepository(ctx context.Context, psqlConn string) (*repository, error) {
+	db, err := sql.Open("pgx", psqlConn)
+	if err != nil {
+		return &repository{}, err
+	}
+	if err = db.Ping(); err != nil {
+		return &repository{}, err
+	}
+	_, err = db.ExecContext(ctx, schema)
+	if err != nil {
+		return &repository{}, err
+	}
+	if err = normalizeLogins(ctx, db); err != nil {
 		return &repository{}, err
 	}
 
@@ -0,0 +1,186 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+// newTestRepository connects to the database in TEST_DATABASE_URI and skips
+// the test when it is not set.
+func newTestRepository(t *testing.T, ctx context.Context) *repository {
+	databaseURI := os.Getenv("TEST_DATABASE_URI")
+	if databaseURI == "" {
+		t.Skip("TEST_DATABASE_URI is not set")
+	}
+	storage, err := NewRepository(ctx, databaseURI)
+	require.NoError(t, err)
+	t.Cleanup(storage.Close)
+	return storage
+}
+
+func TestCreateOrderConcurrently(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	storage := newTestRepository(t, ctx)
+
+	users := []string{uuid.New().String(), uuid.New().String()}
+	for _, userID := range users {
+		require.NoError(t, storage.Register(ctx, userID, "orders-"+userID, "hash", ""))
+	}
+	order := entities.Order{OrderID: entities.OrderNumber(strconv.FormatInt(time.Now().UnixNano(), 10)), Status: "NEW"}
+
+	const uploads = 50
+	results := make([]error, uploads)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			results[i] = storage.CreateOrder(ctx, order, users[i%len(users)])
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	created := -1
+	for i, err := range results {
+		if err == nil {
+			assert.Equal(t, -1, created, "order created twice")
+			created = i
+		}
+	}
+	require.NotEqual(t, -1, created, "order never created")
+	owner := users[created%len(users)]
+	for i, err := range results {
+		switch {
+		case i == created:
+		case users[i%len(users)] == owner:
+			assert.Equal(t, entities.ErrOrderAlreadyCreatedByThisUser, err)
+		default:
+			assert.Equal(t, entities.ErrOrderAlreadyCreatedByAnotherUser, err)
+		}
+	}
+}
+
+func TestClaimDueOrdersConcurrently(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	storage := newTestRepository(t, ctx)
+
+	userID := uuid.New().String()
+	require.NoError(t, storage.Register(ctx, userID, "queue-"+userID, "hash", ""))
+	for i := 0; i < 20; i++ {
+		order := entities.Order{
+			OrderID: entities.OrderNumber(strconv.FormatInt(time.Now().UnixNano(), 10)),
+			Status:  entities.OrderStatusNew,
+		}
+		require.NoError(t, storage.CreateOrder(ctx, order, userID))
+	}
+
+	const replicas = 4
+	claims := make([][]entities.AccrualJob, replicas)
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			claims[i], err = storage.ClaimDueOrders(ctx, 10, time.Minute)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[entities.OrderNumber]bool{}
+	for _, claim := range claims {
+		for _, order := range claim {
+			assert.False(t, seen[order.OrderID], "order %s claimed twice", order.OrderID)
+			seen[order.OrderID] = true
+		}
+	}
+	assert.NotEmpty(t, seen)
+}
+
+func TestDeleteUserErasesAuditEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	storage := newTestRepository(t, ctx)
+
+	userID := uuid.New().String()
+	require.NoError(t, storage.Register(ctx, userID, "audit-"+userID, "hash", ""))
+	require.NoError(t, storage.SaveAuditEvent(ctx, entities.AuditEvent{
+		Type:      entities.AuditLoginSucceeded,
+		ActorID:   userID,
+		LoginHash: "pseudonym",
+		IP:        "10.0.0.1",
+		RequestID: "request-" + userID,
+		CreatedAt: time.Now(),
+	}))
+
+	_, err := storage.db.ExecContext(ctx, "DELETE FROM audit_events WHERE actor_id=$1;", userID)
+	assert.Error(t, err, "audit events stay append-only outside of erasure")
+
+	require.NoError(t, storage.DeleteUser(ctx, userID, "deleted-"+userID, "unusable"))
+	var actorID, loginHash sql.NullString
+	var ip string
+	err = storage.db.QueryRowContext(
+		ctx, "SELECT actor_id, login_hash, ip FROM audit_events WHERE request_id=$1;", "request-"+userID,
+	).Scan(&actorID, &loginHash, &ip)
+	require.NoError(t, err)
+	assert.False(t, actorID.Valid)
+	assert.False(t, loginHash.Valid)
+	assert.Empty(t, ip)
+}
+
+func TestDeferAndRequeueOrder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	storage := newTestRepository(t, ctx)
+
+	userID := uuid.New().String()
+	require.NoError(t, storage.Register(ctx, userID, "dead-"+userID, "hash", ""))
+	number := entities.OrderNumber(strconv.FormatInt(time.Now().UnixNano(), 10))
+	require.NoError(t, storage.CreateOrder(ctx, entities.Order{OrderID: number, Status: entities.OrderStatusNew}, userID))
+
+	// Deferred checks are counted apart from attempts.
+	require.NoError(t, storage.DeferOrder(ctx, number, time.Now().Add(-time.Second)))
+	jobs, err := storage.ClaimOrders(ctx, []entities.OrderNumber{number}, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, 0, jobs[0].Attempts)
+	assert.Equal(t, 1, jobs[0].Deferrals)
+
+	require.NoError(t, storage.DeadLetterOrder(ctx, number, "gave up"))
+	dead, err := storage.ListDeadLetteredOrders(ctx, 1000)
+	require.NoError(t, err)
+	var found bool
+	for _, order := range dead {
+		if order.OrderID == number {
+			found = true
+			assert.Equal(t, "gave up", order.Reason)
+			assert.Equal(t, userID, order.UserID)
+		}
+	}
+	assert.True(t, found)
+
+	require.NoError(t, storage.RequeueOrder(ctx, number))
+	assert.ErrorIs(t, storage.RequeueOrder(ctx, number), entities.ErrOrderNotDeadLettered)
+	jobs, err = storage.ClaimOrders(ctx, []entities.OrderNumber{number}, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, 0, jobs[0].Attempts)
+	assert.Equal(t, 0, jobs[0].Deferrals)
+}
@@ -0,0 +1,240 @@
+package usecase
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+//go:generate mockery --name accountRepository
+type accountRepository interface {
+	GetUserByID(ctx context.Context, userID string) (entities.User, error)
+	GetOrdersForUser(ctx context.Context, userID string) ([]entities.OrderWithTime, error)
+	GetUserAllWithdrawals(ctx context.Context, userID string) ([]entities.WithdrawWithTime, error)
+	ListSessions(ctx context.Context, userID string) ([]entities.Session, error)
+	GetMFASettings(ctx context.Context, userID string) (entities.MFASettings, error)
+	SaveDeletionToken(ctx context.Context, token entities.DeletionToken) error
+	UseDeletionToken(ctx context.Context, userID, tokenHash string) error
+	DeleteUser(ctx context.Context, userID, anonymizedLogin, unusablePassword string) error
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+}
+
+//go:generate mockery --name secondFactor
+type secondFactor interface {
+	Verify(ctx context.Context, userID string, request entities.MFACodeRequest) error
+}
+
+// deletionTokenTTL is how long a mailed deletion token can be used.
+const deletionTokenTTL = 15 * time.Minute
+
+type accountManager struct {
+	repository accountRepository
+	mfa        secondFactor
+	notifier   notifier
+	now        func() time.Time
+}
+
+// Collect gathers everything stored about the user for the data export.
+func (a *accountManager) Collect(ctx context.Context, userID string) (entities.AccountExport, error) {
+	var export entities.AccountExport
+
+	user, err := a.repository.GetUserByID(ctx, userID)
+	if err != nil {
+		return export, err
+	}
+	export.Profile = entities.Profile{ID: user.ID, Login: user.Login, Email: user.Email, Role: user.Role}
+
+	export.Orders, err = a.repository.GetOrdersForUser(ctx, userID)
+	if err != nil && !errors.Is(err, entities.ErrNoOrderForUser) {
+		return export, err
+	}
+	export.Withdrawals, err = a.repository.GetUserAllWithdrawals(ctx, userID)
+	if err != nil && !errors.Is(err, entities.ErrNoWithdrawals) {
+		return export, err
+	}
+	export.Sessions, err = a.repository.ListSessions(ctx, userID)
+	if err != nil {
+		return export, err
+	}
+
+	// Empty lists are exported as [] rather than null.
+	if export.Orders == nil {
+		export.Orders = []entities.OrderWithTime{}
+	}
+	if export.Withdrawals == nil {
+		export.Withdrawals = []entities.WithdrawWithTime{}
+	}
+	return export, nil
+}
+
+// Export returns the data export as a zip archive with the profile as JSON
+// and every list both as JSON and as CSV.
+func (a *accountManager) Export(ctx context.Context, userID string) ([]byte, error) {
+	export, err := a.Collect(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	orders := [][]string{{"number", "status", "accrual", "uploaded_at"}}
+	for _, order := range export.Orders {
+		orders = append(orders, []string{
+			string(order.OrderID), string(order.Status), strconv.FormatFloat(order.Accrual, 'f', -1, 64), order.UpdatedAt,
+		})
+	}
+	withdrawals := [][]string{{"order", "sum", "processed_at"}}
+	for _, withdrawal := range export.Withdrawals {
+		withdrawals = append(withdrawals, []string{
+			string(withdrawal.Order), strconv.FormatFloat(withdrawal.Sum, 'f', -1, 64), withdrawal.ProcessedAt,
+		})
+	}
+	sessions := [][]string{{"id", "user_agent", "ip", "created_at", "last_seen_at"}}
+	for _, session := range export.Sessions {
+		sessions = append(sessions, []string{
+			session.ID, session.UserAgent, session.IP,
+			session.CreatedAt.UTC().Format(time.RFC3339), session.LastSeenAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	files := []struct {
+		name string
+		json interface{}
+		csv  [][]string
+	}{
+		{name: "profile.json", json: export.Profile},
+		{name: "orders.json", json: export.Orders},
+		{name: "orders.csv", csv: orders},
+		{name: "withdrawals.json", json: export.Withdrawals},
+		{name: "withdrawals.csv", csv: withdrawals},
+		{name: "sessions.json", json: export.Sessions},
+		{name: "sessions.csv", csv: sessions},
+	}
+	for _, file := range files {
+		fileWriter, err := writer.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if file.csv != nil {
+			err = csv.NewWriter(fileWriter).WriteAll(file.csv)
+		} else {
+			encoder := json.NewEncoder(fileWriter)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(file.json)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return archive.Bytes(), nil
+}
+
+// RequestDeletion mails the user a single-use token that confirms Delete in
+// place of the password. It returns ErrNoEmail if there is nowhere to send
+// it.
+func (a *accountManager) RequestDeletion(ctx context.Context, userID string) error {
+	user, err := a.repository.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return entities.ErrNoEmail
+	}
+
+	token, err := utils.GenerateToken()
+	if err != nil {
+		return err
+	}
+	err = a.repository.SaveDeletionToken(ctx, entities.DeletionToken{
+		Hash:      utils.HexHash(token),
+		UserID:    userID,
+		ExpiresAt: a.now().Add(deletionTokenTTL),
+	})
+	if err != nil {
+		return err
+	}
+	return a.notifier.Send(ctx, entities.Notification{
+		To:      user.Email,
+		Subject: "Account deletion",
+		Body: fmt.Sprintf(
+			"Somebody asked to delete your account.\n\n"+
+				"Deletion token: %s\n\nThe token expires in %s. If it wasn't you, change your password.\n",
+			token, deletionTokenTTL,
+		),
+	})
+}
+
+// Delete anonymizes the account the access token belongs to and revokes the
+// token. Orders and withdrawals are kept for accounting. A stolen access
+// token alone is not enough: the request must carry the current password or
+// a token from RequestDeletion, or a second-factor code if two-factor
+// authentication is on.
+func (a *accountManager) Delete(
+	ctx context.Context, claims entities.JwtCustomClaims, request entities.DeleteAccountRequest,
+) error {
+	err := a.confirm(ctx, claims.ID, request)
+	if err != nil {
+		return err
+	}
+	token, err := utils.GenerateToken()
+	if err != nil {
+		return err
+	}
+	unusablePassword, err := utils.HashPassword(token)
+	if err != nil {
+		return err
+	}
+	err = a.repository.DeleteUser(ctx, claims.ID, "deleted-"+claims.ID, unusablePassword)
+	if err != nil {
+		return err
+	}
+	if claims.ExpiresAt == nil {
+		return nil
+	}
+	return a.repository.RevokeAccessToken(ctx, claims.RegisteredClaims.ID, claims.ExpiresAt.Time)
+}
+
+// confirm checks that the user, not just their access token, asks for the
+// deletion.
+func (a *accountManager) confirm(ctx context.Context, userID string, request entities.DeleteAccountRequest) error {
+	settings, err := a.repository.GetMFASettings(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if settings.Enabled {
+		return a.mfa.Verify(ctx, userID, request.MFACodeRequest)
+	}
+	if request.Token != "" {
+		return a.repository.UseDeletionToken(ctx, userID, utils.HexHash(request.Token))
+	}
+	user, err := a.repository.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	match, _, err := utils.ComparePassword(user.Password, request.Password)
+	if err != nil || !match {
+		return entities.ErrInvalidCredentials
+	}
+	return nil
+}
+
+func NewAccountManager(repository accountRepository, mfa secondFactor, notifier notifier) *accountManager {
+	return &accountManager{
+		repository: repository,
+		mfa:        mfa,
+		notifier:   notifier,
+		now:        time.Now,
+	}
+}
@@ -0,0 +1,210 @@
+package usecase
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+func TestAccountManager(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	mockAccountRepository := newMockAccountRepository(t)
+	mockSecondFactor := newMockSecondFactor(t)
+	mockNotifier := newMockNotifier(t)
+	accountManager := NewAccountManager(mockAccountRepository, mockSecondFactor, mockNotifier)
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	accountManager.now = func() time.Time { return now }
+
+	user := entities.User{ID: "123456", Login: "login", Password: "hash", Role: entities.RoleUser, Email: "a@b.c"}
+	orders := []entities.OrderWithTime{
+		{OrderID: "12345678903", Status: "PROCESSED", Accrual: 500, UpdatedAt: "2023-01-01"},
+	}
+
+	t.Run("Export: archive with JSON and CSV", func(t *testing.T) {
+		mockAccountRepository.EXPECT().GetUserByID(ctx, "123456").Return(user, nil).Once()
+		mockAccountRepository.EXPECT().GetOrdersForUser(ctx, "123456").Return(orders, nil).Once()
+		mockAccountRepository.EXPECT().
+			GetUserAllWithdrawals(ctx, "123456").
+			Return(nil, entities.ErrNoWithdrawals).
+			Once()
+		mockAccountRepository.EXPECT().ListSessions(ctx, "123456").Return([]entities.Session{}, nil).Once()
+
+		archive, err := accountManager.Export(ctx, "123456")
+		assert.NoError(t, err)
+
+		reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		assert.NoError(t, err)
+		files := map[string]string{}
+		for _, file := range reader.File {
+			content, err := file.Open()
+			assert.NoError(t, err)
+			data, err := io.ReadAll(content)
+			assert.NoError(t, err)
+			files[file.Name] = string(data)
+		}
+		assert.Len(t, files, 7)
+		assert.NotContains(t, files["profile.json"], "hash")
+
+		var profile entities.Profile
+		assert.NoError(t, json.Unmarshal([]byte(files["profile.json"]), &profile))
+		assert.Equal(t, entities.Profile{ID: "123456", Login: "login", Email: "a@b.c", Role: entities.RoleUser}, profile)
+		assert.Equal(t, "number,status,accrual,uploaded_at\n12345678903,PROCESSED,500,2023-01-01\n", files["orders.csv"])
+		assert.JSONEq(t, "[]", files["withdrawals.json"])
+	})
+
+	t.Run("Export: DB error", func(t *testing.T) {
+		mockAccountRepository.EXPECT().GetUserByID(ctx, "123456").Return(user, nil).Once()
+		mockAccountRepository.EXPECT().
+			GetOrdersForUser(ctx, "123456").
+			Return(nil, errors.New("database error")).
+			Once()
+		_, err := accountManager.Export(ctx, "123456")
+		assert.Equal(t, errors.New("database error"), err)
+	})
+
+	expiresAt := time.Now().Add(time.Hour)
+	claims := entities.JwtCustomClaims{
+		ID: "123456",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "jti",
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	passwordHash, err := utils.HashPassword("password")
+	assert.NoError(t, err)
+	withPassword := entities.User{ID: "123456", Password: passwordHash}
+	code := entities.MFACodeRequest{Code: "123456"}
+	deleteTests := []struct {
+		name        string
+		mfaEnabled  bool
+		request     entities.DeleteAccountRequest
+		verifyErr   error
+		tokenErr    error
+		errFromDB   error
+		expectedErr error
+	}{
+		{
+			name:        "Delete: anonymizes and revokes token",
+			request:     entities.DeleteAccountRequest{Password: "password"},
+			errFromDB:   nil,
+			expectedErr: nil,
+		},
+		{
+			name:        "Delete: already deleted",
+			request:     entities.DeleteAccountRequest{Password: "password"},
+			errFromDB:   entities.ErrUserNotFound,
+			expectedErr: entities.ErrUserNotFound,
+		},
+		{
+			name:        "Delete: wrong password",
+			request:     entities.DeleteAccountRequest{Password: "wrong"},
+			expectedErr: entities.ErrInvalidCredentials,
+		},
+		{
+			name:        "Delete: confirmed with mailed token",
+			request:     entities.DeleteAccountRequest{Token: "token"},
+			expectedErr: nil,
+		},
+		{
+			name:        "Delete: used or expired token",
+			request:     entities.DeleteAccountRequest{Token: "token"},
+			tokenErr:    entities.ErrInvalidDeletionToken,
+			expectedErr: entities.ErrInvalidDeletionToken,
+		},
+		{
+			name:        "Delete: confirmed with second factor",
+			mfaEnabled:  true,
+			request:     entities.DeleteAccountRequest{MFACodeRequest: code},
+			expectedErr: nil,
+		},
+		{
+			name:        "Delete: password is not enough with second factor",
+			mfaEnabled:  true,
+			request:     entities.DeleteAccountRequest{Password: "password"},
+			verifyErr:   entities.ErrInvalidMFACode,
+			expectedErr: entities.ErrInvalidMFACode,
+		},
+	}
+	for _, tt := range deleteTests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockAccountRepository.EXPECT().
+				GetMFASettings(ctx, "123456").
+				Return(entities.MFASettings{Enabled: tt.mfaEnabled}, nil).
+				Once()
+			switch {
+			case tt.mfaEnabled:
+				mockSecondFactor.EXPECT().Verify(ctx, "123456", tt.request.MFACodeRequest).Return(tt.verifyErr).Once()
+			case tt.request.Token != "":
+				mockAccountRepository.EXPECT().
+					UseDeletionToken(ctx, "123456", utils.HexHash(tt.request.Token)).
+					Return(tt.tokenErr).
+					Once()
+			default:
+				mockAccountRepository.EXPECT().GetUserByID(ctx, "123456").Return(withPassword, nil).Once()
+			}
+			if tt.expectedErr == nil || tt.errFromDB != nil {
+				mockAccountRepository.EXPECT().
+					DeleteUser(ctx, "123456", "deleted-123456", mock.AnythingOfType("string")).
+					Return(tt.errFromDB).
+					Once()
+			}
+			if tt.expectedErr == nil {
+				mockAccountRepository.EXPECT().
+					RevokeAccessToken(ctx, "jti", claims.ExpiresAt.Time).
+					Return(nil).
+					Once()
+			}
+			err := accountManager.Delete(ctx, claims, tt.request)
+			assert.Equal(t, tt.expectedErr, err)
+		})
+	}
+
+	t.Run("RequestDeletion: mails a token", func(t *testing.T) {
+		mockAccountRepository.EXPECT().GetUserByID(ctx, "123456").Return(user, nil).Once()
+		var saved entities.DeletionToken
+		mockAccountRepository.EXPECT().
+			SaveDeletionToken(ctx, mock.AnythingOfType("entities.DeletionToken")).
+			Run(func(_ context.Context, token entities.DeletionToken) { saved = token }).
+			Return(nil).
+			Once()
+		var sent entities.Notification
+		mockNotifier.EXPECT().
+			Send(ctx, mock.AnythingOfType("entities.Notification")).
+			Run(func(_ context.Context, notification entities.Notification) { sent = notification }).
+			Return(nil).
+			Once()
+
+		err := accountManager.RequestDeletion(ctx, "123456")
+		assert.NoError(t, err)
+		assert.Equal(t, "123456", saved.UserID)
+		assert.Equal(t, now.Add(deletionTokenTTL), saved.ExpiresAt)
+		assert.Equal(t, "a@b.c", sent.To)
+
+		token := sent.Body[strings.Index(sent.Body, "Deletion token: ")+len("Deletion token: "):]
+		token = token[:strings.Index(token, "\n")]
+		assert.Equal(t, utils.HexHash(token), saved.Hash)
+	})
+
+	t.Run("RequestDeletion: no email", func(t *testing.T) {
+		mockAccountRepository.EXPECT().
+			GetUserByID(ctx, "123456").
+			Return(entities.User{ID: "123456"}, nil).
+			Once()
+		err := accountManager.RequestDeletion(ctx, "123456")
+		assert.Equal(t, entities.ErrNoEmail, err)
+	})
+}
@@ -0,0 +1,94 @@
+package usecase
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+//go:generate mockery --name apiKeyRepository
+type apiKeyRepository interface {
+	CreateAPIKey(ctx context.Context, key entities.APIKey, keyHash string) error
+	ListAPIKeys(ctx context.Context, userID string) ([]entities.APIKey, error)
+	RevokeAPIKey(ctx context.Context, userID, keyID string) error
+	UseAPIKey(ctx context.Context, keyHash string) (entities.APIKey, error)
+}
+
+const (
+	apiKeyPrefix       = "gm_"
+	apiKeyPrefixLength = len(apiKeyPrefix) + 6
+)
+
+type apiKeyManager struct {
+	repository apiKeyRepository
+}
+
+// Create issues a key with the given scopes. Only its hash is stored, so the
+// returned plain key can't be shown again.
+func (a *apiKeyManager) Create(
+	ctx context.Context, userID string, request entities.CreateAPIKeyRequest,
+) (entities.CreatedAPIKey, error) {
+	var created entities.CreatedAPIKey
+
+	if len(request.Scopes) == 0 {
+		return created, entities.ErrInvalidScope
+	}
+	for _, scope := range request.Scopes {
+		if !validScope(scope) {
+			return created, entities.ErrInvalidScope
+		}
+	}
+
+	token, err := utils.GenerateToken()
+	if err != nil {
+		return created, err
+	}
+	created.Key = apiKeyPrefix + token
+	created.APIKey = entities.APIKey{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Name:      request.Name,
+		Prefix:    created.Key[:apiKeyPrefixLength],
+		Scopes:    request.Scopes,
+		CreatedAt: time.Now(),
+	}
+	err = a.repository.CreateAPIKey(ctx, created.APIKey, utils.HexHash(created.Key))
+	if err != nil {
+		return entities.CreatedAPIKey{}, err
+	}
+	return created, nil
+}
+
+func (a *apiKeyManager) List(ctx context.Context, userID string) ([]entities.APIKey, error) {
+	return a.repository.ListAPIKeys(ctx, userID)
+}
+
+func (a *apiKeyManager) Revoke(ctx context.Context, userID, keyID string) error {
+	return a.repository.RevokeAPIKey(ctx, userID, keyID)
+}
+
+func (a *apiKeyManager) Authenticate(ctx context.Context, key string) (entities.APIKey, error) {
+	if len(key) <= apiKeyPrefixLength {
+		return entities.APIKey{}, entities.ErrInvalidAPIKey
+	}
+	return a.repository.UseAPIKey(ctx, utils.HexHash(key))
+}
+
+func validScope(scope string) bool {
+	for _, known := range entities.APIKeyScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+func NewAPIKeyManager(repository apiKeyRepository) *apiKeyManager {
+	return &apiKeyManager{
+		repository: repository,
+	}
+}
@@ -0,0 +1,140 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+func TestAPIKeyManager(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	mockAPIKeyRepository := newMockApiKeyRepository(t)
+	apiKeyManager := NewAPIKeyManager(mockAPIKeyRepository)
+
+	createTests := []struct {
+		name        string
+		userID      string
+		request     entities.CreateAPIKeyRequest
+		errFromDB   error
+		expectedErr error
+	}{
+		{
+			name:   "Create: success",
+			userID: "123456",
+			request: entities.CreateAPIKeyRequest{
+				Name:   "POS",
+				Scopes: []string{entities.ScopeOrdersWrite, entities.ScopeBalanceRead},
+			},
+			errFromDB:   nil,
+			expectedErr: nil,
+		},
+		{
+			name:   "Create: unknown scope",
+			userID: "123456",
+			request: entities.CreateAPIKeyRequest{
+				Name:   "POS",
+				Scopes: []string{"balance:write"},
+			},
+			expectedErr: entities.ErrInvalidScope,
+		},
+		{
+			name:   "Create: no scopes",
+			userID: "123456",
+			request: entities.CreateAPIKeyRequest{
+				Name: "POS",
+			},
+			expectedErr: entities.ErrInvalidScope,
+		},
+		{
+			name:   "Create: DB error",
+			userID: "123456",
+			request: entities.CreateAPIKeyRequest{
+				Name:   "POS",
+				Scopes: []string{entities.ScopeOrdersWrite},
+			},
+			errFromDB:   errors.New("database error"),
+			expectedErr: errors.New("database error"),
+		},
+	}
+	for _, tt := range createTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var storedHash string
+			if !errors.Is(tt.expectedErr, entities.ErrInvalidScope) {
+				mockAPIKeyRepository.EXPECT().
+					CreateAPIKey(ctx, mock.AnythingOfType("entities.APIKey"), mock.AnythingOfType("string")).
+					Run(func(ctx context.Context, key entities.APIKey, keyHash string) { storedHash = keyHash }).
+					Return(tt.errFromDB).
+					Once()
+			}
+			created, err := apiKeyManager.Create(ctx, tt.userID, tt.request)
+			assert.Equal(t, tt.expectedErr, err)
+			if tt.expectedErr != nil {
+				assert.Empty(t, created.Key)
+				return
+			}
+			assert.True(t, strings.HasPrefix(created.Key, created.Prefix))
+			assert.Equal(t, utils.HexHash(created.Key), storedHash)
+			assert.Equal(t, tt.userID, created.UserID)
+			assert.Equal(t, tt.request.Scopes, created.Scopes)
+		})
+	}
+
+	authenticateTests := []struct {
+		name        string
+		key         string
+		keyFromDB   entities.APIKey
+		errFromDB   error
+		expectedErr error
+	}{
+		{
+			name:        "Authenticate: success",
+			key:         "gm_abcdefghijklmnop",
+			keyFromDB:   entities.APIKey{ID: "1", UserID: "123456", Scopes: []string{entities.ScopeOrdersWrite}},
+			errFromDB:   nil,
+			expectedErr: nil,
+		},
+		{
+			name:        "Authenticate: revoked key",
+			key:         "gm_abcdefghijklmnop",
+			keyFromDB:   entities.APIKey{},
+			errFromDB:   entities.ErrInvalidAPIKey,
+			expectedErr: entities.ErrInvalidAPIKey,
+		},
+		{
+			name:        "Authenticate: malformed key",
+			key:         "gm_",
+			expectedErr: entities.ErrInvalidAPIKey,
+		},
+	}
+	for _, tt := range authenticateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.key != "gm_" {
+				mockAPIKeyRepository.EXPECT().
+					UseAPIKey(ctx, utils.HexHash(tt.key)).
+					Return(tt.keyFromDB, tt.errFromDB).
+					Once()
+			}
+			key, err := apiKeyManager.Authenticate(ctx, tt.key)
+			assert.Equal(t, tt.expectedErr, err)
+			assert.Equal(t, tt.keyFromDB, key)
+		})
+	}
+
+	t.Run("Revoke: unknown key", func(t *testing.T) {
+		mockAPIKeyRepository.EXPECT().
+			RevokeAPIKey(ctx, "123456", "1").
+			Return(entities.ErrAPIKeyNotFound).
+			Once()
+		err := apiKeyManager.Revoke(ctx, "123456", "1")
+		assert.Equal(t, entities.ErrAPIKeyNotFound, err)
+	})
+}
@@ -0,0 +1,89 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+	defaultAuditRange = 24 * time.Hour
+)
+
+//go:generate mockery --name auditRepository
+type auditRepository interface {
+	SaveAuditEvent(ctx context.Context, event entities.AuditEvent) error
+	ListAuditEvents(ctx context.Context, query entities.AuditQuery) ([]entities.AuditEvent, error)
+}
+
+type auditor struct {
+	repository   auditRepository
+	pseudonymKey []byte
+	now          func() time.Time
+}
+
+// Record appends an event to the audit log. The payload is stored as JSON
+// and the login, if any, only as its pseudonym.
+func (a *auditor) Record(ctx context.Context, event entities.AuditEvent, payload interface{}) error {
+	if event.Login != "" {
+		event.LoginHash = a.pseudonym(event.Login)
+		event.Login = ""
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		event.Payload = data
+	}
+	event.CreatedAt = a.now()
+	return a.repository.SaveAuditEvent(ctx, event)
+}
+
+// List returns audit events newest first. Without a range it covers the
+// last day; the limit defaults to 100 and is capped at 1000.
+func (a *auditor) List(ctx context.Context, query entities.AuditQuery) ([]entities.AuditEvent, error) {
+	if query.To.IsZero() {
+		query.To = a.now()
+	}
+	if query.From.IsZero() {
+		query.From = query.To.Add(-defaultAuditRange)
+	}
+	if !query.From.Before(query.To) || query.Limit < 0 || query.Limit > maxAuditLimit {
+		return nil, entities.ErrInvalidAuditQuery
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultAuditLimit
+	}
+	if query.Login != "" {
+		query.LoginHash = a.pseudonym(query.Login)
+		query.Login = ""
+	}
+	return a.repository.ListAuditEvents(ctx, query)
+}
+
+// pseudonym stands in for a login in the audit log. It is keyed, so logins
+// can't be found by hashing guesses, and taken of the normalized login, so
+// every spelling of an account's login maps to the same pseudonym.
+func (a *auditor) pseudonym(login string) string {
+	return utils.HexHMAC(a.pseudonymKey, utils.NormalizeLogin(login))
+}
+
+// NewAuditor takes the key logins are pseudonymised with. Pseudonyms can
+// only be compared while the key stays the same, so there is no fallback to
+// a generated key: events of every restart would look unrelated.
+func NewAuditor(repository auditRepository, pseudonymKey string) (*auditor, error) {
+	if pseudonymKey == "" {
+		return nil, entities.ErrNoAuditPseudonymKey
+	}
+	return &auditor{
+		repository:   repository,
+		pseudonymKey: []byte(pseudonymKey),
+		now:          time.Now,
+	}, nil
+}
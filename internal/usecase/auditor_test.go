@@ -0,0 +1,130 @@
+package usecase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+func TestAuditor(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	mockAuditRepository := newMockAuditRepository(t)
+	auditor, err := NewAuditor(mockAuditRepository, "pseudonym-key")
+	assert.NoError(t, err)
+	loginHash := utils.HexHMAC([]byte("pseudonym-key"), "user")
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	auditor.now = func() time.Time { return now }
+
+	t.Run("Record: payload stored as JSON", func(t *testing.T) {
+		mockAuditRepository.EXPECT().
+			SaveAuditEvent(ctx, entities.AuditEvent{
+				Type:      entities.AuditOrderUploaded,
+				ActorID:   "123456",
+				IP:        "10.0.0.1",
+				RequestID: "request",
+				Payload:   []byte(`{"order":"12345678903"}`),
+				CreatedAt: now,
+			}).
+			Return(nil).
+			Once()
+		err := auditor.Record(ctx, entities.AuditEvent{
+			Type:      entities.AuditOrderUploaded,
+			ActorID:   "123456",
+			IP:        "10.0.0.1",
+			RequestID: "request",
+		}, map[string]string{"order": "12345678903"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Record: login only as pseudonym", func(t *testing.T) {
+		mockAuditRepository.EXPECT().
+			SaveAuditEvent(ctx, entities.AuditEvent{
+				Type:      entities.AuditLoginFailed,
+				LoginHash: loginHash,
+				IP:        "10.0.0.1",
+				RequestID: "request",
+				CreatedAt: now,
+			}).
+			Return(nil).
+			Once()
+		err := auditor.Record(ctx, entities.AuditEvent{
+			Type:      entities.AuditLoginFailed,
+			Login:     " User ",
+			IP:        "10.0.0.1",
+			RequestID: "request",
+		}, nil)
+		assert.NoError(t, err)
+	})
+
+	listTests := []struct {
+		name          string
+		query         entities.AuditQuery
+		expectedQuery entities.AuditQuery
+		expectedErr   error
+	}{
+		{
+			name:  "List: defaults to the last day",
+			query: entities.AuditQuery{UserID: "123456"},
+			expectedQuery: entities.AuditQuery{
+				UserID: "123456",
+				From:   now.Add(-24 * time.Hour),
+				To:     now,
+				Limit:  100,
+			},
+			expectedErr: nil,
+		},
+		{
+			name: "List: explicit range",
+			query: entities.AuditQuery{
+				From:  now.Add(-time.Hour),
+				To:    now.Add(-time.Minute),
+				Limit: 10,
+			},
+			expectedQuery: entities.AuditQuery{
+				From:  now.Add(-time.Hour),
+				To:    now.Add(-time.Minute),
+				Limit: 10,
+			},
+			expectedErr: nil,
+		},
+		{
+			name:  "List: by login pseudonym",
+			query: entities.AuditQuery{Login: "USER", From: now.Add(-time.Hour), To: now},
+			expectedQuery: entities.AuditQuery{
+				LoginHash: loginHash,
+				From:      now.Add(-time.Hour),
+				To:        now,
+				Limit:     100,
+			},
+			expectedErr: nil,
+		},
+		{
+			name:        "List: inverted range",
+			query:       entities.AuditQuery{From: now, To: now.Add(-time.Hour)},
+			expectedErr: entities.ErrInvalidAuditQuery,
+		},
+		{
+			name:        "List: limit too large",
+			query:       entities.AuditQuery{Limit: 5000},
+			expectedErr: entities.ErrInvalidAuditQuery,
+		},
+	}
+	for _, tt := range listTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.expectedErr == nil {
+				mockAuditRepository.EXPECT().
+					ListAuditEvents(ctx, tt.expectedQuery).
+					Return([]entities.AuditEvent{}, nil).
+					Once()
+			}
+			_, err := auditor.List(ctx, tt.query)
+			assert.Equal(t, tt.expectedErr, err)
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package usecase
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+//go:generate mockery --name loginAttemptsRepository
+type loginAttemptsRepository interface {
+	AddLoginAttempt(ctx context.Context, key string, now, resetBefore time.Time) (entities.LoginAttempts, error)
+	ForgiveLoginAttempt(ctx context.Context, key string) error
+	ResetLoginAttempts(ctx context.Context, key string) error
+	DeleteExpiredLoginAttempts(ctx context.Context, before time.Time) error
+}
+
+const (
+	loginLockoutDuration = 15 * time.Minute
+	loginBaseDelay       = time.Second
+)
+
+// attemptsPolicy describes how failures of one key are throttled: the first
+// freeAttempts failures are free, then every failure doubles the delay before
+// the next attempt, and lockoutAttempts failures lock the key for
+// loginLockoutDuration.
+type attemptsPolicy struct {
+	freeAttempts    int
+	lockoutAttempts int
+}
+
+func (p attemptsPolicy) retryAfter(attempts entities.LoginAttempts, now time.Time) time.Duration {
+	if attempts.Failures <= p.freeAttempts {
+		return 0
+	}
+
+	delay := loginLockoutDuration
+	if attempts.Failures < p.lockoutAttempts {
+		delay = loginBaseDelay << (attempts.Failures - p.freeAttempts - 1)
+		if delay > loginLockoutDuration {
+			delay = loginLockoutDuration
+		}
+	}
+	until := attempts.LastFailureAt.Add(delay)
+	if now.Before(until) {
+		return until.Sub(now)
+	}
+	return 0
+}
+
+var (
+	loginPolicy = attemptsPolicy{freeAttempts: 3, lockoutAttempts: 10}
+	// Many users may share an address behind a NAT, so IPs get more room.
+	ipPolicy = attemptsPolicy{freeAttempts: 20, lockoutAttempts: 100}
+)
+
+type loginGuard struct {
+	repository loginAttemptsRepository
+	now        func() time.Time
+}
+
+// Check counts a login attempt for the login and the IP and returns
+// ErrTooManyLoginAttempts and how long the client has to wait if either was
+// throttled before it. Counting and checking is one step, so parallel
+// attempts cannot all pass before any of them is counted. Every attempt
+// counts as a failure until RegisterSuccess, throttled ones included.
+func (g *loginGuard) Check(ctx context.Context, login, ip string) (time.Duration, error) {
+	now := g.now()
+	resetBefore := now.Add(-loginLockoutDuration)
+
+	loginAttempts, err := g.repository.AddLoginAttempt(ctx, loginKey(login), now, resetBefore)
+	if err != nil {
+		return 0, err
+	}
+	ipAttempts, err := g.repository.AddLoginAttempt(ctx, ipKey(ip), now, resetBefore)
+	if err != nil {
+		return 0, err
+	}
+
+	retryAfter := loginPolicy.retryAfter(loginAttempts, now)
+	if ipRetryAfter := ipPolicy.retryAfter(ipAttempts, now); ipRetryAfter > retryAfter {
+		retryAfter = ipRetryAfter
+	}
+	if retryAfter > 0 {
+		return retryAfter, entities.ErrTooManyLoginAttempts
+	}
+	return 0, nil
+}
+
+// RegisterSuccess clears the login counter and takes the attempt back from
+// the IP counter. The rest of the IP counter is kept, otherwise an attacker
+// could reset it by logging into an account of their own.
+func (g *loginGuard) RegisterSuccess(ctx context.Context, login, ip string) error {
+	if err := g.repository.ResetLoginAttempts(ctx, loginKey(login)); err != nil {
+		return err
+	}
+	return g.repository.ForgiveLoginAttempt(ctx, ipKey(ip))
+}
+
+// CheckUser counts an attempt of a signed-in user to prove it is them, such
+// as a second-factor code, against the same policy as a login. A stolen
+// session must not give unlimited guesses at the secrets behind it.
+func (g *loginGuard) CheckUser(ctx context.Context, userID string) (time.Duration, error) {
+	now := g.now()
+	attempts, err := g.repository.AddLoginAttempt(ctx, userKey(userID), now, now.Add(-loginLockoutDuration))
+	if err != nil {
+		return 0, err
+	}
+	if retryAfter := loginPolicy.retryAfter(attempts, now); retryAfter > 0 {
+		return retryAfter, entities.ErrTooManyLoginAttempts
+	}
+	return 0, nil
+}
+
+// RegisterUserSuccess clears the counter of CheckUser.
+func (g *loginGuard) RegisterUserSuccess(ctx context.Context, userID string) error {
+	return g.repository.ResetLoginAttempts(ctx, userKey(userID))
+}
+
+// ExpireEvery drops counters without failures for loginLockoutDuration
+// until ctx is done.
+func (g *loginGuard) ExpireEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := g.repository.DeleteExpiredLoginAttempts(ctx, g.now().Add(-loginLockoutDuration))
+			if err != nil {
+				utils.Logger.Error("loginGuard:ExpireEvery - DeleteExpiredLoginAttempts", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Unlock lifts a lockout of login before it expires.
+func (g *loginGuard) Unlock(ctx context.Context, login string) error {
+	return g.repository.ResetLoginAttempts(ctx, loginKey(login))
+}
+
+func loginKey(login string) string {
+	return "login:" + utils.NormalizeLogin(login)
+}
+
+func userKey(userID string) string {
+	return "user:" + userID
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func NewLoginGuard(repository loginAttemptsRepository) *loginGuard {
+	return &loginGuard{
+		repository: repository,
+		now:        time.Now,
+	}
+}
@@ -0,0 +1,172 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+func TestLoginGuard(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	mockLoginAttemptsRepository := newMockLoginAttemptsRepository(t)
+	guard := NewLoginGuard(mockLoginAttemptsRepository)
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	guard.now = func() time.Time { return now }
+
+	checkTests := []struct {
+		name               string
+		login              string
+		ip                 string
+		loginAttempts      entities.LoginAttempts
+		ipAttempts         entities.LoginAttempts
+		errFromDB          error
+		expectedRetryAfter time.Duration
+		expectedErr        error
+	}{
+		{
+			name:               "Check: no failures",
+			login:              "login",
+			ip:                 "10.0.0.1",
+			loginAttempts:      entities.LoginAttempts{},
+			ipAttempts:         entities.LoginAttempts{},
+			errFromDB:          nil,
+			expectedRetryAfter: 0,
+			expectedErr:        nil,
+		},
+		{
+			name:               "Check: free attempts are not delayed",
+			login:              "login",
+			ip:                 "10.0.0.1",
+			loginAttempts:      entities.LoginAttempts{Failures: 3, LastFailureAt: now},
+			ipAttempts:         entities.LoginAttempts{Failures: 3, LastFailureAt: now},
+			errFromDB:          nil,
+			expectedRetryAfter: 0,
+			expectedErr:        nil,
+		},
+		{
+			name:               "Check: delay doubles after free attempts",
+			login:              "login",
+			ip:                 "10.0.0.1",
+			loginAttempts:      entities.LoginAttempts{Failures: 6, LastFailureAt: now.Add(-time.Second)},
+			ipAttempts:         entities.LoginAttempts{Failures: 6, LastFailureAt: now.Add(-time.Second)},
+			errFromDB:          nil,
+			expectedRetryAfter: 3 * time.Second,
+			expectedErr:        entities.ErrTooManyLoginAttempts,
+		},
+		{
+			name:               "Check: delay has passed",
+			login:              "login",
+			ip:                 "10.0.0.1",
+			loginAttempts:      entities.LoginAttempts{Failures: 6, LastFailureAt: now.Add(-time.Minute)},
+			ipAttempts:         entities.LoginAttempts{Failures: 6, LastFailureAt: now.Add(-time.Minute)},
+			errFromDB:          nil,
+			expectedRetryAfter: 0,
+			expectedErr:        nil,
+		},
+		{
+			name:               "Check: login locked out",
+			login:              "login",
+			ip:                 "10.0.0.1",
+			loginAttempts:      entities.LoginAttempts{Failures: 10, LastFailureAt: now.Add(-5 * time.Minute)},
+			ipAttempts:         entities.LoginAttempts{},
+			errFromDB:          nil,
+			expectedRetryAfter: 10 * time.Minute,
+			expectedErr:        entities.ErrTooManyLoginAttempts,
+		},
+		{
+			name:               "Check: ip locked out",
+			login:              "login",
+			ip:                 "10.0.0.1",
+			loginAttempts:      entities.LoginAttempts{},
+			ipAttempts:         entities.LoginAttempts{Failures: 100, LastFailureAt: now},
+			errFromDB:          nil,
+			expectedRetryAfter: 15 * time.Minute,
+			expectedErr:        entities.ErrTooManyLoginAttempts,
+		},
+		{
+			name:               "Check: DB error",
+			login:              "login",
+			ip:                 "10.0.0.1",
+			loginAttempts:      entities.LoginAttempts{},
+			ipAttempts:         entities.LoginAttempts{},
+			errFromDB:          errors.New("database error"),
+			expectedRetryAfter: 0,
+			expectedErr:        errors.New("database error"),
+		},
+	}
+	for _, tt := range checkTests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetBefore := now.Add(-loginLockoutDuration)
+			mockLoginAttemptsRepository.EXPECT().
+				AddLoginAttempt(ctx, "login:"+tt.login, now, resetBefore).
+				Return(tt.loginAttempts, tt.errFromDB).
+				Once()
+			if tt.errFromDB == nil {
+				mockLoginAttemptsRepository.EXPECT().
+					AddLoginAttempt(ctx, "ip:"+tt.ip, now, resetBefore).
+					Return(tt.ipAttempts, nil).
+					Once()
+			}
+			retryAfter, err := guard.Check(ctx, tt.login, tt.ip)
+			assert.Equal(t, tt.expectedErr, err)
+			assert.Equal(t, tt.expectedRetryAfter, retryAfter)
+		})
+	}
+
+	t.Run("RegisterSuccess: resets login, forgives one ip attempt", func(t *testing.T) {
+		mockLoginAttemptsRepository.EXPECT().
+			ResetLoginAttempts(ctx, "login:login").
+			Return(nil).
+			Once()
+		mockLoginAttemptsRepository.EXPECT().
+			ForgiveLoginAttempt(ctx, "ip:10.0.0.1").
+			Return(nil).
+			Once()
+		err := guard.RegisterSuccess(ctx, "login", "10.0.0.1")
+		assert.NoError(t, err)
+	})
+
+	t.Run("CheckUser: counts per user", func(t *testing.T) {
+		mockLoginAttemptsRepository.EXPECT().
+			AddLoginAttempt(ctx, "user:42", now, now.Add(-loginLockoutDuration)).
+			Return(entities.LoginAttempts{Failures: 3, LastFailureAt: now}, nil).
+			Once()
+		retryAfter, err := guard.CheckUser(ctx, "42")
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), retryAfter)
+	})
+
+	t.Run("CheckUser: user locked out", func(t *testing.T) {
+		mockLoginAttemptsRepository.EXPECT().
+			AddLoginAttempt(ctx, "user:42", now, now.Add(-loginLockoutDuration)).
+			Return(entities.LoginAttempts{Failures: 10, LastFailureAt: now}, nil).
+			Once()
+		retryAfter, err := guard.CheckUser(ctx, "42")
+		assert.Equal(t, entities.ErrTooManyLoginAttempts, err)
+		assert.Equal(t, loginLockoutDuration, retryAfter)
+	})
+
+	t.Run("RegisterUserSuccess: resets user", func(t *testing.T) {
+		mockLoginAttemptsRepository.EXPECT().
+			ResetLoginAttempts(ctx, "user:42").
+			Return(nil).
+			Once()
+		err := guard.RegisterUserSuccess(ctx, "42")
+		assert.NoError(t, err)
+	})
+
+	t.Run("Unlock: resets login", func(t *testing.T) {
+		mockLoginAttemptsRepository.EXPECT().
+			ResetLoginAttempts(ctx, "login:login").
+			Return(nil).
+			Once()
+		err := guard.Unlock(ctx, "login")
+		assert.NoError(t, err)
+	})
+}
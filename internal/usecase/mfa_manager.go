@@ -0,0 +1,182 @@
+package usecase
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+//go:generate mockery --name mfaRepository
+type mfaRepository interface {
+	GetMFASettings(ctx context.Context, userID string) (entities.MFASettings, error)
+	SavePendingTOTPSecret(ctx context.Context, userID, encryptedSecret string) error
+	EnableTOTP(ctx context.Context, userID string, step int64, recoveryCodeHashes []string) error
+	DisableTOTP(ctx context.Context, userID string) error
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+	UseRecoveryCode(ctx context.Context, userID, codeHash string) error
+}
+
+const (
+	recoveryCodesCount     = 10
+	recoveryCodeLength     = 10
+	mfaEncryptionKeyLength = 32
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type mfaManager struct {
+	repository    mfaRepository
+	encryptionKey []byte
+	issuer        string
+	now           func() time.Time
+}
+
+// Enroll generates a new TOTP secret for the user. It is stored encrypted
+// and stays inactive until Confirm receives a valid code for it.
+func (m *mfaManager) Enroll(ctx context.Context, userID, login string) (entities.TOTPEnrollment, error) {
+	var enrollment entities.TOTPEnrollment
+
+	if m.encryptionKey == nil {
+		return enrollment, entities.ErrMFAUnavailable
+	}
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return enrollment, err
+	}
+	encryptedSecret, err := utils.Encrypt(m.encryptionKey, secret)
+	if err != nil {
+		return enrollment, err
+	}
+	err = m.repository.SavePendingTOTPSecret(ctx, userID, encryptedSecret)
+	if err != nil {
+		return enrollment, err
+	}
+	enrollment.Secret = secret
+	enrollment.URI = utils.TOTPURI(m.issuer, login, secret)
+	return enrollment, nil
+}
+
+// Confirm enables the second factor once the user proves their app produces
+// valid codes, and returns recovery codes. Only their hashes are stored, so
+// they can't be shown again.
+func (m *mfaManager) Confirm(ctx context.Context, userID, code string) ([]string, error) {
+	settings, err := m.repository.GetMFASettings(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if settings.Enabled {
+		return nil, entities.ErrMFAAlreadyEnabled
+	}
+	if settings.EncryptedSecret == "" {
+		return nil, entities.ErrMFANotEnrolled
+	}
+	step, err := m.validateCode(settings, code)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodesCount)
+	hashes := make([]string, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		recoveryCode, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, recoveryCode)
+		hashes = append(hashes, utils.HexHash(normalizeRecoveryCode(recoveryCode)))
+	}
+	err = m.repository.EnableTOTP(ctx, userID, step, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Verify checks the second factor of an enrolled user. Each TOTP step and
+// each recovery code is accepted only once.
+func (m *mfaManager) Verify(ctx context.Context, userID string, request entities.MFACodeRequest) error {
+	settings, err := m.repository.GetMFASettings(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !settings.Enabled {
+		return entities.ErrMFANotEnrolled
+	}
+	if request.RecoveryCode != "" {
+		return m.repository.UseRecoveryCode(ctx, userID, utils.HexHash(normalizeRecoveryCode(request.RecoveryCode)))
+	}
+	step, err := m.validateCode(settings, request.Code)
+	if err != nil {
+		return err
+	}
+	return m.repository.UseTOTPStep(ctx, userID, step)
+}
+
+// Disable turns the second factor off. It takes a current code so a stolen
+// access token alone is not enough.
+func (m *mfaManager) Disable(ctx context.Context, userID string, request entities.MFACodeRequest) error {
+	err := m.Verify(ctx, userID, request)
+	if err != nil {
+		return err
+	}
+	return m.repository.DisableTOTP(ctx, userID)
+}
+
+func (m *mfaManager) validateCode(settings entities.MFASettings, code string) (int64, error) {
+	if m.encryptionKey == nil {
+		return 0, entities.ErrMFAUnavailable
+	}
+	secret, err := utils.Decrypt(m.encryptionKey, settings.EncryptedSecret)
+	if err != nil {
+		return 0, err
+	}
+	step, ok := utils.ValidateTOTP(secret, strings.TrimSpace(code), m.now())
+	if !ok {
+		return 0, entities.ErrInvalidMFACode
+	}
+	return step, nil
+}
+
+func generateRecoveryCode() (string, error) {
+	raw := make([]byte, recoveryCodeLength*5/8)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(recoveryCodeEncoding.EncodeToString(raw))
+	return code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:], nil
+}
+
+// normalizeRecoveryCode lets users type codes without the dash and in any case.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// NewMFAManager takes the base64 encoded AES-256 key secrets are encrypted
+// with. Without a key, enrolment and TOTP checks report ErrMFAUnavailable.
+func NewMFAManager(repository mfaRepository, encodedKey, issuer string) (*mfaManager, error) {
+	manager := &mfaManager{
+		repository: repository,
+		issuer:     issuer,
+		now:        time.Now,
+	}
+	if encodedKey == "" {
+		return manager, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode MFA encryption key failed: %w", err)
+	}
+	if len(key) != mfaEncryptionKeyLength {
+		return nil, fmt.Errorf("MFA encryption key must be %d bytes", mfaEncryptionKeyLength)
+	}
+	manager.encryptionKey = key
+	return manager, nil
+}
@@ -0,0 +1,208 @@
+package usecase
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+func TestMFAManager(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	mockMFARepository := newMockMfaRepository(t)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	mfaManager, err := NewMFAManager(mockMFARepository, base64.StdEncoding.EncodeToString(key), "Loyalty")
+	assert.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	mfaManager.now = func() time.Time { return now }
+
+	secret, err := utils.GenerateTOTPSecret()
+	assert.NoError(t, err)
+	encryptedSecret, err := utils.Encrypt(key, secret)
+	assert.NoError(t, err)
+	step := utils.TOTPStep(now)
+	validCode, err := utils.TOTPCode(secret, step)
+	assert.NoError(t, err)
+
+	t.Run("NewMFAManager: short key", func(t *testing.T) {
+		_, err := NewMFAManager(mockMFARepository, base64.StdEncoding.EncodeToString([]byte("short")), "Loyalty")
+		assert.Error(t, err)
+	})
+
+	t.Run("Enroll: no encryption key", func(t *testing.T) {
+		withoutKey, err := NewMFAManager(mockMFARepository, "", "Loyalty")
+		assert.NoError(t, err)
+		_, err = withoutKey.Enroll(ctx, "123456", "login")
+		assert.Equal(t, entities.ErrMFAUnavailable, err)
+	})
+
+	t.Run("Enroll: stores encrypted secret", func(t *testing.T) {
+		var stored string
+		mockMFARepository.EXPECT().
+			SavePendingTOTPSecret(ctx, "123456", mock.Anything).
+			Run(func(_ context.Context, _ string, encrypted string) { stored = encrypted }).
+			Return(nil).
+			Once()
+		enrollment, err := mfaManager.Enroll(ctx, "123456", "login")
+		assert.NoError(t, err)
+		assert.NotEqual(t, enrollment.Secret, stored)
+		decrypted, err := utils.Decrypt(key, stored)
+		assert.NoError(t, err)
+		assert.Equal(t, enrollment.Secret, decrypted)
+		assert.Contains(t, enrollment.URI, "otpauth://totp/Loyalty:login?")
+	})
+
+	confirmTests := []struct {
+		name          string
+		code          string
+		settings      entities.MFASettings
+		expectEnable  bool
+		expectedCodes int
+		expectedErr   error
+	}{
+		{
+			name:          "Confirm: success",
+			code:          validCode,
+			settings:      entities.MFASettings{EncryptedSecret: encryptedSecret},
+			expectEnable:  true,
+			expectedCodes: recoveryCodesCount,
+			expectedErr:   nil,
+		},
+		{
+			name:        "Confirm: wrong code",
+			code:        "000000",
+			settings:    entities.MFASettings{EncryptedSecret: encryptedSecret},
+			expectedErr: entities.ErrInvalidMFACode,
+		},
+		{
+			name:        "Confirm: not enrolled",
+			code:        validCode,
+			settings:    entities.MFASettings{},
+			expectedErr: entities.ErrMFANotEnrolled,
+		},
+		{
+			name:        "Confirm: already enabled",
+			code:        validCode,
+			settings:    entities.MFASettings{EncryptedSecret: encryptedSecret, Enabled: true},
+			expectedErr: entities.ErrMFAAlreadyEnabled,
+		},
+	}
+	for _, tt := range confirmTests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockMFARepository.EXPECT().
+				GetMFASettings(ctx, "123456").
+				Return(tt.settings, nil).
+				Once()
+			if tt.expectEnable {
+				mockMFARepository.EXPECT().
+					EnableTOTP(ctx, "123456", step, mock.AnythingOfType("[]string")).
+					Return(nil).
+					Once()
+			}
+			codes, err := mfaManager.Confirm(ctx, "123456", tt.code)
+			assert.Equal(t, tt.expectedErr, err)
+			assert.Len(t, codes, tt.expectedCodes)
+		})
+	}
+
+	enabled := entities.MFASettings{EncryptedSecret: encryptedSecret, Enabled: true, LastStep: step - 10}
+	verifyTests := []struct {
+		name        string
+		request     entities.MFACodeRequest
+		settings    entities.MFASettings
+		useStep     bool
+		useRecovery bool
+		errFromDB   error
+		expectedErr error
+	}{
+		{
+			name:        "Verify: valid code",
+			request:     entities.MFACodeRequest{Code: validCode},
+			settings:    enabled,
+			useStep:     true,
+			expectedErr: nil,
+		},
+		{
+			name:        "Verify: replayed code",
+			request:     entities.MFACodeRequest{Code: validCode},
+			settings:    enabled,
+			useStep:     true,
+			errFromDB:   entities.ErrInvalidMFACode,
+			expectedErr: entities.ErrInvalidMFACode,
+		},
+		{
+			name:        "Verify: wrong code",
+			request:     entities.MFACodeRequest{Code: "000000"},
+			settings:    enabled,
+			expectedErr: entities.ErrInvalidMFACode,
+		},
+		{
+			name:        "Verify: recovery code",
+			request:     entities.MFACodeRequest{RecoveryCode: "ABCDE-fghij"},
+			settings:    enabled,
+			useRecovery: true,
+			expectedErr: nil,
+		},
+		{
+			name:        "Verify: not enrolled",
+			request:     entities.MFACodeRequest{Code: validCode},
+			settings:    entities.MFASettings{EncryptedSecret: encryptedSecret},
+			expectedErr: entities.ErrMFANotEnrolled,
+		},
+		{
+			name:        "Verify: DB error",
+			request:     entities.MFACodeRequest{Code: validCode},
+			settings:    enabled,
+			useStep:     true,
+			errFromDB:   errors.New("database error"),
+			expectedErr: errors.New("database error"),
+		},
+	}
+	for _, tt := range verifyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockMFARepository.EXPECT().
+				GetMFASettings(ctx, "123456").
+				Return(tt.settings, nil).
+				Once()
+			if tt.useStep {
+				mockMFARepository.EXPECT().
+					UseTOTPStep(ctx, "123456", step).
+					Return(tt.errFromDB).
+					Once()
+			}
+			if tt.useRecovery {
+				mockMFARepository.EXPECT().
+					UseRecoveryCode(ctx, "123456", utils.HexHash("abcdefghij")).
+					Return(tt.errFromDB).
+					Once()
+			}
+			err := mfaManager.Verify(ctx, "123456", tt.request)
+			assert.Equal(t, tt.expectedErr, err)
+		})
+	}
+
+	t.Run("Disable: valid code", func(t *testing.T) {
+		mockMFARepository.EXPECT().
+			GetMFASettings(ctx, "123456").
+			Return(enabled, nil).
+			Once()
+		mockMFARepository.EXPECT().
+			UseTOTPStep(ctx, "123456", step).
+			Return(nil).
+			Once()
+		mockMFARepository.EXPECT().
+			DisableTOTP(ctx, "123456").
+			Return(nil).
+			Once()
+		err := mfaManager.Disable(ctx, "123456", entities.MFACodeRequest{Code: validCode})
+		assert.NoError(t, err)
+	})
+}
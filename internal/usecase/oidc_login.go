@@ -0,0 +1,141 @@
+package usecase
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+//go:generate mockery --name oidcProvider
+type oidcProvider interface {
+	AuthCodeURL(state, nonce, codeVerifier string) string
+	Exchange(ctx context.Context, code, codeVerifier, nonce string) (entities.ExternalIdentity, error)
+}
+
+//go:generate mockery --name oidcRepository
+type oidcRepository interface {
+	SaveOIDCState(ctx context.Context, state entities.OIDCState) error
+	ConsumeOIDCState(ctx context.Context, stateHash string) (entities.OIDCState, error)
+	GetUserByIdentity(ctx context.Context, issuer, subject string) (entities.User, error)
+	RegisterWithIdentity(ctx context.Context, user entities.User, identity entities.ExternalIdentity) error
+}
+
+// oidcStateTTL is how long a user may take to sign in at the provider.
+const oidcStateTTL = 10 * time.Minute
+
+type oidcLogin struct {
+	provider   oidcProvider
+	repository oidcRepository
+}
+
+// Begin starts a login at the provider and returns the URL to redirect the
+// user to.
+func (o *oidcLogin) Begin(ctx context.Context) (entities.OIDCAuthorization, error) {
+	var authorization entities.OIDCAuthorization
+
+	state, err := utils.GenerateToken()
+	if err != nil {
+		return authorization, err
+	}
+	nonce, err := utils.GenerateToken()
+	if err != nil {
+		return authorization, err
+	}
+	codeVerifier, err := utils.GenerateToken()
+	if err != nil {
+		return authorization, err
+	}
+	expiresAt := time.Now().Add(oidcStateTTL)
+	err = o.repository.SaveOIDCState(ctx, entities.OIDCState{
+		StateHash:    utils.HexHash(state),
+		CodeVerifier: codeVerifier,
+		Nonce:        nonce,
+		ExpiresAt:    expiresAt,
+	})
+	if err != nil {
+		return authorization, err
+	}
+	return entities.OIDCAuthorization{
+		RedirectURL: o.provider.AuthCodeURL(state, nonce, codeVerifier),
+		State:       state,
+		ExpiresAt:   expiresAt,
+	}, nil
+}
+
+// Complete finishes the login started by Begin and returns the linked user.
+// The state must match the one the browser got from Begin; otherwise anyone
+// could log a victim into the attacker's account with their own callback.
+// Subjects seen for the first time get a new account. Existing accounts are
+// never linked by email, since that would let anyone controlling the email
+// at the provider take them over.
+func (o *oidcLogin) Complete(ctx context.Context, state, browserState, code string) (entities.User, error) {
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(browserState)) != 1 {
+		return entities.User{}, entities.ErrInvalidOIDCState
+	}
+	storedState, err := o.repository.ConsumeOIDCState(ctx, utils.HexHash(state))
+	if err != nil {
+		return entities.User{}, err
+	}
+	identity, err := o.provider.Exchange(ctx, code, storedState.CodeVerifier, storedState.Nonce)
+	if err != nil {
+		return entities.User{}, err
+	}
+
+	user, err := o.repository.GetUserByIdentity(ctx, identity.Issuer, identity.Subject)
+	if errors.Is(err, entities.ErrUserNotFound) {
+		return o.provision(ctx, identity)
+	}
+	return user, err
+}
+
+// provision creates the account of a new external identity. The login is
+// taken from the provider if it is free, otherwise derived from the subject.
+// The random password can't be used to sign in.
+func (o *oidcLogin) provision(ctx context.Context, identity entities.ExternalIdentity) (entities.User, error) {
+	password, err := utils.GenerateToken()
+	if err != nil {
+		return entities.User{}, err
+	}
+	passwordHash, err := utils.HashPassword(password)
+	if err != nil {
+		return entities.User{}, err
+	}
+	user := entities.User{
+		ID:       uuid.New().String(),
+		Password: passwordHash,
+		Role:     entities.RoleUser,
+		Email:    identity.Email,
+	}
+
+	fallbackLogin := "oidc-" + utils.HexHash(identity.Issuer + " " + identity.Subject)[:16]
+	candidates := []string{identity.PreferredUsername, identity.Email, fallbackLogin}
+	for _, login := range candidates {
+		user.Login = utils.NormalizeLogin(login)
+		if user.Login == "" {
+			continue
+		}
+		err = o.repository.RegisterWithIdentity(ctx, user, identity)
+		if errors.Is(err, entities.ErrLoginAlreadyInUse) {
+			continue
+		}
+		if err != nil {
+			return entities.User{}, err
+		}
+		user.Password = ""
+		return user, nil
+	}
+	return entities.User{}, entities.ErrLoginAlreadyInUse
+}
+
+func NewOIDCLogin(provider oidcProvider, repository oidcRepository) *oidcLogin {
+	return &oidcLogin{
+		provider:   provider,
+		repository: repository,
+	}
+}
@@ -0,0 +1,125 @@
+package usecase
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	mockOIDCProvider := newMockOidcProvider(t)
+	mockOIDCRepository := newMockOidcRepository(t)
+	oidcLogin := NewOIDCLogin(mockOIDCProvider, mockOIDCRepository)
+
+	t.Run("Begin: stores state hash and PKCE verifier", func(t *testing.T) {
+		var saved entities.OIDCState
+		var sentState string
+		mockOIDCRepository.EXPECT().
+			SaveOIDCState(ctx, mock.AnythingOfType("entities.OIDCState")).
+			Run(func(ctx context.Context, state entities.OIDCState) { saved = state }).
+			Return(nil).
+			Once()
+		mockOIDCProvider.EXPECT().
+			AuthCodeURL(mock.Anything, mock.Anything, mock.Anything).
+			RunAndReturn(func(state, nonce, codeVerifier string) string {
+				sentState = state
+				assert.Equal(t, utils.HexHash(state), saved.StateHash)
+				assert.Equal(t, saved.Nonce, nonce)
+				assert.Equal(t, saved.CodeVerifier, codeVerifier)
+				return "https://provider/authorize"
+			}).
+			Once()
+		authorization, err := oidcLogin.Begin(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, "https://provider/authorize", authorization.RedirectURL)
+		assert.Equal(t, sentState, authorization.State)
+		assert.Equal(t, saved.ExpiresAt, authorization.ExpiresAt)
+	})
+
+	state := entities.OIDCState{StateHash: utils.HexHash("state"), CodeVerifier: "verifier", Nonce: "nonce"}
+	identity := entities.ExternalIdentity{
+		Issuer:            "https://provider",
+		Subject:           "subject-1",
+		Email:             "user@example.com",
+		PreferredUsername: "User",
+	}
+
+	t.Run("Complete: linked user", func(t *testing.T) {
+		linked := entities.User{ID: "123456", Login: "user", Role: entities.RoleUser}
+		mockOIDCRepository.EXPECT().ConsumeOIDCState(ctx, state.StateHash).Return(state, nil).Once()
+		mockOIDCProvider.EXPECT().Exchange(ctx, "code", "verifier", "nonce").Return(identity, nil).Once()
+		mockOIDCRepository.EXPECT().
+			GetUserByIdentity(ctx, identity.Issuer, identity.Subject).
+			Return(linked, nil).
+			Once()
+		user, err := oidcLogin.Complete(ctx, "state", "state", "code")
+		assert.NoError(t, err)
+		assert.Equal(t, linked, user)
+	})
+
+	t.Run("Complete: provisions new user, falls back to free login", func(t *testing.T) {
+		var logins []string
+		mockOIDCRepository.EXPECT().ConsumeOIDCState(ctx, state.StateHash).Return(state, nil).Once()
+		mockOIDCProvider.EXPECT().Exchange(ctx, "code", "verifier", "nonce").Return(identity, nil).Once()
+		mockOIDCRepository.EXPECT().
+			GetUserByIdentity(ctx, identity.Issuer, identity.Subject).
+			Return(entities.User{}, entities.ErrUserNotFound).
+			Once()
+		mockOIDCRepository.EXPECT().
+			RegisterWithIdentity(ctx, mock.AnythingOfType("entities.User"), identity).
+			RunAndReturn(func(ctx context.Context, user entities.User, identity entities.ExternalIdentity) error {
+				logins = append(logins, user.Login)
+				if user.Login == "user" {
+					return entities.ErrLoginAlreadyInUse
+				}
+				return nil
+			}).
+			Twice()
+		user, err := oidcLogin.Complete(ctx, "state", "state", "code")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user", "user@example.com"}, logins)
+		assert.Equal(t, "user@example.com", user.Login)
+		assert.Equal(t, "user@example.com", user.Email)
+		assert.Equal(t, entities.RoleUser, user.Role)
+		assert.Empty(t, user.Password)
+	})
+
+	t.Run("Complete: state already used", func(t *testing.T) {
+		mockOIDCRepository.EXPECT().
+			ConsumeOIDCState(ctx, state.StateHash).
+			Return(entities.OIDCState{}, entities.ErrInvalidOIDCState).
+			Once()
+		_, err := oidcLogin.Complete(ctx, "state", "state", "code")
+		assert.Equal(t, entities.ErrInvalidOIDCState, err)
+	})
+
+	t.Run("Complete: missing state", func(t *testing.T) {
+		_, err := oidcLogin.Complete(ctx, "", "", "code")
+		assert.Equal(t, entities.ErrInvalidOIDCState, err)
+	})
+
+	t.Run("Complete: state from another browser", func(t *testing.T) {
+		_, err := oidcLogin.Complete(ctx, "state", "other-state", "code")
+		assert.Equal(t, entities.ErrInvalidOIDCState, err)
+		_, err = oidcLogin.Complete(ctx, "state", "", "code")
+		assert.Equal(t, entities.ErrInvalidOIDCState, err)
+	})
+
+	t.Run("Complete: provider refuses code", func(t *testing.T) {
+		mockOIDCRepository.EXPECT().ConsumeOIDCState(ctx, state.StateHash).Return(state, nil).Once()
+		mockOIDCProvider.EXPECT().
+			Exchange(ctx, "code", "verifier", "nonce").
+			Return(entities.ExternalIdentity{}, entities.ErrOIDCLoginFailed).
+			Once()
+		_, err := oidcLogin.Complete(ctx, "state", "state", "code")
+		assert.Equal(t, entities.ErrOIDCLoginFailed, err)
+	})
+}
@@ -2,16 +2,27 @@ package usecase
 
 import (
 	"context"
-	"strconv"
+	"encoding/base64"
+	"encoding/json"
+	"time"
 
 	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+const (
+	defaultOrdersPage = 100
+	maxOrdersPage     = 1000
 )
 
 //go:generate mockery --name ordersRepository
 type ordersRepository interface {
-	GetUserForOrder(ctx context.Context, order string) (string, error)
 	CreateOrder(ctx context.Context, order entities.Order, userID string) error
-	GetOrdersForUser(ctx context.Context, user string) ([]entities.OrderWithTime, error)
+	CreateOrders(ctx context.Context, orders []entities.Order, userID string) (map[entities.OrderNumber]error, error)
+	ListOrders(ctx context.Context, userID string, query entities.OrderListQuery) ([]entities.OrderWithTime, error)
+	GetOrder(ctx context.Context, userID string, number entities.OrderNumber) (entities.OrderDetail, error)
+	ListDeadLetteredOrders(ctx context.Context, limit int) ([]entities.DeadLetteredOrder, error)
+	RequeueOrder(ctx context.Context, number entities.OrderNumber) error
 }
 
 //go:generate mockery --name ordersQueue
@@ -24,39 +35,202 @@ type ordersProcessor struct {
 	queue      ordersQueue
 }
 
-func (o *ordersProcessor) CheckOrderExist(ctx context.Context, order int, userFromRequest string) error {
-	userFromDB, err := o.repository.GetUserForOrder(ctx, strconv.Itoa(order))
+// RegisterOrder creates the order and queues it for accrual. The stored
+// order is what gets checked; Push never blocks the request. It returns
+// ErrOrderAlreadyCreatedByThisUser or ErrOrderAlreadyCreatedByAnotherUser
+// when the number is already registered.
+func (o *ordersProcessor) RegisterOrder(ctx context.Context, orderNumber entities.OrderNumber, userID string) error {
+	var order entities.Order
+
+	order.OrderID = orderNumber
+	order.Status = entities.OrderStatusNew
+
+	err := o.repository.CreateOrder(ctx, order, userID)
 	if err != nil {
 		return err
 	}
+	o.queue.Push(order)
+	return nil
+}
 
-	if userFromDB == userFromRequest {
-		return entities.ErrOrderAlreadyCreatedByThisUser
+// RegisterBatch validates and creates a bulk upload and reports the outcome
+// of every item. Numbers repeated within the batch are duplicates of their
+// first occurrence. Only newly created orders are queued for accrual.
+func (o *ordersProcessor) RegisterBatch(
+	ctx context.Context, userID string, items []entities.BatchOrderItem,
+) (entities.BatchOrderReport, error) {
+	report := entities.BatchOrderReport{Results: make([]entities.BatchOrderResult, len(items))}
+	orders := make([]entities.Order, 0, len(items))
+	seen := make(map[entities.OrderNumber]bool, len(items))
+
+	for i, item := range items {
+		result := &report.Results[i]
+		result.Line = item.Line
+		result.Number = item.Raw
+
+		number, err := utils.ParseOrderNumber(item.Raw)
+		if err != nil {
+			result.Status = entities.BatchOrderInvalid
+			result.Error = err.Error()
+			continue
+		}
+		result.Number = string(number)
+		if seen[number] {
+			result.Status = entities.BatchOrderDuplicate
+			result.Error = "repeated in this batch"
+			continue
+		}
+		seen[number] = true
+		orders = append(orders, entities.Order{OrderID: number, Status: entities.OrderStatusNew})
 	}
-	return entities.ErrOrderAlreadyCreatedByAnotherUser
+
+	if len(orders) > 0 {
+		created, err := o.repository.CreateOrders(ctx, orders, userID)
+		if err != nil {
+			return entities.BatchOrderReport{}, err
+		}
+		for i := range report.Results {
+			result := &report.Results[i]
+			if result.Status != "" {
+				continue
+			}
+			switch created[entities.OrderNumber(result.Number)] {
+			case nil:
+				result.Status = entities.BatchOrderAccepted
+			case entities.ErrOrderAlreadyCreatedByThisUser:
+				result.Status = entities.BatchOrderDuplicate
+				result.Error = entities.ErrOrderAlreadyCreatedByThisUser.Error()
+			default:
+				result.Status = entities.BatchOrderConflict
+				result.Error = entities.ErrOrderAlreadyCreatedByAnotherUser.Error()
+			}
+		}
+		for _, order := range orders {
+			if created[order.OrderID] == nil {
+				o.queue.Push(order)
+			}
+		}
+	}
+
+	for _, result := range report.Results {
+		switch result.Status {
+		case entities.BatchOrderAccepted:
+			report.Accepted++
+		case entities.BatchOrderDuplicate:
+			report.Duplicates++
+		case entities.BatchOrderConflict:
+			report.Conflicts++
+		case entities.BatchOrderInvalid:
+			report.Invalid++
+		}
+	}
+	return report, nil
 }
 
-func (o *ordersProcessor) RegisterOrder(ctx context.Context, orderNumber int, userID string) error {
-	var order entities.Order
+// ListOrders returns one page of the user's orders and a cursor for the
+// next one, empty on the last page. The limit defaults to 100 and is capped
+// at 1000.
+func (o *ordersProcessor) ListOrders(
+	ctx context.Context, userID string, query entities.OrderListQuery, cursor string,
+) (entities.OrderPage, error) {
+	var page entities.OrderPage
 
-	order.OrderID = strconv.Itoa(orderNumber)
-	order.Status = "NEW"
+	for _, status := range query.Statuses {
+		if !status.Valid() {
+			return page, entities.ErrInvalidOrderQuery
+		}
+	}
+	if query.Limit < 0 || query.Limit > maxOrdersPage {
+		return page, entities.ErrInvalidOrderQuery
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultOrdersPage
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		return page, entities.ErrInvalidOrderQuery
+	}
+	if cursor != "" {
+		after, err := decodeOrderCursor(cursor)
+		if err != nil {
+			return page, entities.ErrInvalidOrderQuery
+		}
+		query.After = &after
+	}
 
-	err := o.repository.CreateOrder(ctx, order, userID)
+	// One extra order tells whether there is a next page.
+	limit := query.Limit
+	query.Limit++
+	orders, err := o.repository.ListOrders(ctx, userID, query)
 	if err != nil {
-		return err
+		return page, err
 	}
-	o.queue.Push(order)
-	return nil
+	if len(orders) == 0 {
+		return page, entities.ErrNoOrderForUser
+	}
+	if len(orders) > limit {
+		orders = orders[:limit]
+		page.NextCursor, err = encodeOrderCursor(orders[limit-1])
+		if err != nil {
+			return page, err
+		}
+	}
+	page.Orders = orders
+	return page, nil
+}
+
+// GetOrder returns one of the user's orders with its status timeline.
+func (o *ordersProcessor) GetOrder(
+	ctx context.Context, userID string, number entities.OrderNumber,
+) (entities.OrderDetail, error) {
+	return o.repository.GetOrder(ctx, userID, number)
+}
+
+func encodeOrderCursor(order entities.OrderWithTime) (string, error) {
+	uploadedAt, err := time.Parse(time.RFC3339Nano, order.UpdatedAt)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(entities.OrderCursor{UploadedAt: uploadedAt, Number: order.OrderID})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
 }
 
-func (o *ordersProcessor) GetUserOrder(ctx context.Context, userID string) ([]entities.OrderWithTime, error) {
-	orders, err := o.repository.GetOrdersForUser(ctx, userID)
+func decodeOrderCursor(cursor string) (entities.OrderCursor, error) {
+	var after entities.OrderCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
 	if err != nil {
-		return orders, err
+		return after, err
+	}
+	err = json.Unmarshal(data, &after)
+	if err == nil && (after.UploadedAt.IsZero() || after.Number == "") {
+		err = entities.ErrInvalidOrderQuery
 	}
+	return after, err
+}
 
-	return orders, nil
+// ListDeadLettered returns the orders the accrual checks gave up on, most
+// recent first. The limit defaults to 100 and is capped at 1000.
+func (o *ordersProcessor) ListDeadLettered(ctx context.Context, limit int) ([]entities.DeadLetteredOrder, error) {
+	if limit < 0 || limit > maxOrdersPage {
+		return nil, entities.ErrInvalidOrderQuery
+	}
+	if limit == 0 {
+		limit = defaultOrdersPage
+	}
+	return o.repository.ListDeadLetteredOrders(ctx, limit)
+}
+
+// Requeue puts a dead-lettered order back on the accrual queue with a fresh
+// set of attempts. It returns ErrOrderNotDeadLettered for any other order.
+func (o *ordersProcessor) Requeue(ctx context.Context, number entities.OrderNumber) error {
+	err := o.repository.RequeueOrder(ctx, number)
+	if err != nil {
+		return err
+	}
+	o.queue.Push(entities.Order{OrderID: number})
+	return nil
 }
 
 func NewOrdersProcessor(repository ordersRepository, queue ordersQueue) *ordersProcessor {
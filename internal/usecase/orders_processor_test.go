@@ -3,7 +3,6 @@ package usecase
 import (
 	"context"
 	"errors"
-	"strconv"
 	"testing"
 	"time"
 
@@ -20,118 +19,266 @@ func TestOrdersProcessor(t *testing.T) {
 
 	ordersProcessor := NewOrdersProcessor(mockOrdersRepository, mockOrdersQueue)
 
-	checkOrderExistTests := []struct {
-		name            string
-		orderNumber     int
-		userFromRequest string
-		userFromDB      string
-		errorFromDB     error
-		expectedErr     error
+	first := entities.OrderWithTime{
+		OrderID: "12345678903", Status: entities.OrderStatusNew, UpdatedAt: "2023-01-01T10:00:00Z",
+	}
+	second := entities.OrderWithTime{
+		OrderID: "79927398713", Status: entities.OrderStatusNew, UpdatedAt: "2023-01-01T10:00:00Z",
+	}
+	cursor := "eyJ0IjoiMjAyMy0wMS0wMVQxMDowMDowMFoiLCJuIjoiMTIzNDU2Nzg5MDMifQ"
+	listOrdersTests := []struct {
+		name           string
+		query          entities.OrderListQuery
+		cursor         string
+		expectedQuery  entities.OrderListQuery
+		ordersFromDB   []entities.OrderWithTime
+		errorFromDB    error
+		expectedPage   entities.OrderPage
+		expectedErr    error
+		expectRepoCall bool
 	}{
 		{
-			name:            "CheckOrderExist: order already created by another user",
-			orderNumber:     1234567,
-			userFromRequest: "user1",
-			userFromDB:      "user2",
-			errorFromDB:     nil,
-			expectedErr:     entities.ErrOrderAlreadyCreatedByAnotherUser,
+			name:           "ListOrders: more orders than the limit yield a cursor",
+			query:          entities.OrderListQuery{Limit: 1},
+			expectedQuery:  entities.OrderListQuery{Limit: 2},
+			ordersFromDB:   []entities.OrderWithTime{first, second},
+			expectedPage:   entities.OrderPage{Orders: []entities.OrderWithTime{first}, NextCursor: cursor},
+			expectRepoCall: true,
+		},
+		{
+			name:   "ListOrders: cursor continues after the order",
+			query:  entities.OrderListQuery{Limit: 1, Statuses: []entities.OrderStatus{entities.OrderStatusNew}},
+			cursor: cursor,
+			expectedQuery: entities.OrderListQuery{
+				Limit:    2,
+				Statuses: []entities.OrderStatus{entities.OrderStatusNew},
+				After: &entities.OrderCursor{
+					UploadedAt: time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC),
+					Number:     "12345678903",
+				},
+			},
+			ordersFromDB:   []entities.OrderWithTime{second},
+			expectedPage:   entities.OrderPage{Orders: []entities.OrderWithTime{second}},
+			expectRepoCall: true,
+		},
+		{
+			name:           "ListOrders: default limit",
+			expectedQuery:  entities.OrderListQuery{Limit: 101},
+			ordersFromDB:   []entities.OrderWithTime{},
+			expectedErr:    entities.ErrNoOrderForUser,
+			expectRepoCall: true,
+		},
+		{
+			name:           "ListOrders: return orders with errors",
+			expectedQuery:  entities.OrderListQuery{Limit: 101},
+			errorFromDB:    errors.New("error from DB"),
+			expectedErr:    errors.New("error from DB"),
+			expectRepoCall: true,
 		},
 		{
-			name:            "CheckOrderExist: order already created by the same user",
-			orderNumber:     1234567,
-			userFromRequest: "user1",
-			userFromDB:      "user1",
-			errorFromDB:     nil,
-			expectedErr:     entities.ErrOrderAlreadyCreatedByThisUser,
+			name:        "ListOrders: unknown status",
+			query:       entities.OrderListQuery{Statuses: []entities.OrderStatus{"REGISTERED"}},
+			expectedErr: entities.ErrInvalidOrderQuery,
 		},
 		{
-			name:            "CheckOrderExist: internal error",
-			orderNumber:     1234567,
-			userFromRequest: "user1",
-			userFromDB:      "user1",
-			errorFromDB:     errors.New("internal error"),
-			expectedErr:     errors.New("internal error"),
+			name:        "ListOrders: malformed cursor",
+			cursor:      "not a cursor",
+			expectedErr: entities.ErrInvalidOrderQuery,
 		},
 	}
-	for _, tt := range checkOrderExistTests {
+	for _, tt := range listOrdersTests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockOrdersRepository.EXPECT().
-				GetUserForOrder(ctx, strconv.Itoa(tt.orderNumber)).
-				Return(tt.userFromDB, tt.errorFromDB).
-				Once()
-			err := ordersProcessor.CheckOrderExist(ctx, tt.orderNumber, tt.userFromRequest)
+			if tt.expectRepoCall {
+				mockOrdersRepository.EXPECT().
+					ListOrders(ctx, "1234567", tt.expectedQuery).
+					Return(tt.ordersFromDB, tt.errorFromDB).
+					Once()
+			}
+			page, err := ordersProcessor.ListOrders(ctx, "1234567", tt.query, tt.cursor)
 			assert.Equal(t, tt.expectedErr, err)
+			if tt.expectedErr == nil {
+				assert.Equal(t, tt.expectedPage, page)
+			}
 		})
 	}
 
-	getUserOrderTests := []struct {
+	registerOrderTests := []struct {
 		name        string
+		orderNumber entities.OrderNumber
 		userID      string
 		errorFromDB error
 		expectedErr error
 	}{
 		{
-			name:        "CheckOrderExist: return orders without errors",
+			name:        "RegisterOrder: return orders without errors",
+			orderNumber: "0000000000000000000000000018",
 			userID:      "1234567",
 			errorFromDB: nil,
 			expectedErr: nil,
 		},
 		{
-			name:        "CheckOrderExist: return orders with errors",
+			name:        "RegisterOrder: already registered by this user",
+			orderNumber: "0000000000000000000000000018",
+			userID:      "1234567",
+			errorFromDB: entities.ErrOrderAlreadyCreatedByThisUser,
+			expectedErr: entities.ErrOrderAlreadyCreatedByThisUser,
+		},
+		{
+			name:        "RegisterOrder: already registered by another user",
+			orderNumber: "0000000000000000000000000018",
+			userID:      "1234567",
+			errorFromDB: entities.ErrOrderAlreadyCreatedByAnotherUser,
+			expectedErr: entities.ErrOrderAlreadyCreatedByAnotherUser,
+		},
+		{
+			name:        "RegisterOrder: return orders with errors",
+			orderNumber: "0000000000000000000000000018",
 			userID:      "1234567",
 			errorFromDB: errors.New("error from DB"),
 			expectedErr: errors.New("error from DB"),
 		},
 	}
-	for _, tt := range getUserOrderTests {
+	for _, tt := range registerOrderTests {
 		t.Run(tt.name, func(t *testing.T) {
-			var userOrdersFromDB []entities.OrderWithTime
+			var order entities.Order
+			order.OrderID = tt.orderNumber
+			order.Status = "NEW"
+
 			mockOrdersRepository.EXPECT().
-				GetOrdersForUser(ctx, tt.userID).
-				Return(userOrdersFromDB, tt.errorFromDB).
+				CreateOrder(ctx, order, tt.userID).
+				Return(tt.errorFromDB).
 				Once()
-			_, err := ordersProcessor.GetUserOrder(ctx, tt.userID)
+			if tt.errorFromDB == nil {
+				mockOrdersQueue.EXPECT().
+					Push(order).
+					Once()
+			}
+			err := ordersProcessor.RegisterOrder(ctx, tt.orderNumber, tt.userID)
 			assert.Equal(t, tt.expectedErr, err)
+
 		})
 	}
 
-	registerOrderTests := []struct {
+	t.Run("RegisterBatch: reports every item and queues new orders", func(t *testing.T) {
+		items := []entities.BatchOrderItem{
+			{Line: 1, Raw: "12345678903"},
+			{Line: 2, Raw: "12345678904"},
+			{Line: 3, Raw: "0000000000000000000000000018"},
+			{Line: 4, Raw: "12345678903"},
+			{Line: 5, Raw: "79927398713"},
+			{Line: 6, Raw: "abc"},
+		}
+		orders := []entities.Order{
+			{OrderID: "12345678903", Status: entities.OrderStatusNew},
+			{OrderID: "0000000000000000000000000018", Status: entities.OrderStatusNew},
+			{OrderID: "79927398713", Status: entities.OrderStatusNew},
+		}
+		mockOrdersRepository.EXPECT().
+			CreateOrders(ctx, orders, "1234567").
+			Return(map[entities.OrderNumber]error{
+				"12345678903":                  nil,
+				"0000000000000000000000000018": entities.ErrOrderAlreadyCreatedByThisUser,
+				"79927398713":                  entities.ErrOrderAlreadyCreatedByAnotherUser,
+			}, nil).
+			Once()
+		mockOrdersQueue.EXPECT().Push(orders[0]).Once()
+
+		report, err := ordersProcessor.RegisterBatch(ctx, "1234567", items)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, report.Accepted)
+		assert.Equal(t, 2, report.Duplicates)
+		assert.Equal(t, 1, report.Conflicts)
+		assert.Equal(t, 2, report.Invalid)
+		statuses := make([]string, 0, len(report.Results))
+		for _, result := range report.Results {
+			statuses = append(statuses, result.Status)
+		}
+		assert.Equal(t, []string{
+			entities.BatchOrderAccepted,
+			entities.BatchOrderInvalid,
+			entities.BatchOrderDuplicate,
+			entities.BatchOrderDuplicate,
+			entities.BatchOrderConflict,
+			entities.BatchOrderInvalid,
+		}, statuses)
+	})
+
+	t.Run("RegisterBatch: nothing valid skips the DB", func(t *testing.T) {
+		report, err := ordersProcessor.RegisterBatch(ctx, "1234567", []entities.BatchOrderItem{{Line: 1, Raw: "1"}})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, report.Invalid)
+	})
+
+	getOrderTests := []struct {
 		name        string
-		orderNumber int
-		userID      string
 		errorFromDB error
 		expectedErr error
 	}{
 		{
-			name:        "RegisterOrder: return orders without errors",
-			orderNumber: 111111,
-			userID:      "1234567",
+			name:        "GetOrder: order with history",
 			errorFromDB: nil,
 			expectedErr: nil,
 		},
 		{
-			name:        "RegisterOrder: return orders with errors",
-			orderNumber: 111111,
-			userID:      "1234567",
-			errorFromDB: errors.New("error from DB"),
-			expectedErr: errors.New("error from DB"),
+			name:        "GetOrder: not the user's order",
+			errorFromDB: entities.ErrOrderNotFound,
+			expectedErr: entities.ErrOrderNotFound,
 		},
 	}
-	for _, tt := range registerOrderTests {
+	for _, tt := range getOrderTests {
 		t.Run(tt.name, func(t *testing.T) {
-			var order entities.Order
-			order.OrderID = strconv.Itoa(tt.orderNumber)
-			order.Status = "NEW"
-
+			detail := entities.OrderDetail{
+				OrderWithTime: first,
+				History:       []entities.OrderStatusChange{{Status: entities.OrderStatusNew}},
+			}
 			mockOrdersRepository.EXPECT().
-				CreateOrder(ctx, order, tt.userID).
-				Return(tt.errorFromDB).
+				GetOrder(ctx, "1234567", first.OrderID).
+				Return(detail, tt.errorFromDB).
 				Once()
-			mockOrdersQueue.EXPECT().
-				Push(order)
-			err := ordersProcessor.RegisterOrder(ctx, tt.orderNumber, tt.userID)
+			order, err := ordersProcessor.GetOrder(ctx, "1234567", first.OrderID)
 			assert.Equal(t, tt.expectedErr, err)
+			assert.Equal(t, detail, order)
+		})
+	}
 
+	t.Run("ListDeadLettered: default limit", func(t *testing.T) {
+		mockOrdersRepository.EXPECT().
+			ListDeadLetteredOrders(ctx, 100).
+			Return([]entities.DeadLetteredOrder{}, nil).
+			Once()
+		_, err := ordersProcessor.ListDeadLettered(ctx, 0)
+		assert.NoError(t, err)
+	})
+
+	t.Run("ListDeadLettered: limit too large", func(t *testing.T) {
+		_, err := ordersProcessor.ListDeadLettered(ctx, 5000)
+		assert.Equal(t, entities.ErrInvalidOrderQuery, err)
+	})
+
+	requeueTests := []struct {
+		name        string
+		errorFromDB error
+		expectedErr error
+	}{
+		{
+			name:        "Requeue: dead-lettered order is queued again",
+			errorFromDB: nil,
+			expectedErr: nil,
+		},
+		{
+			name:        "Requeue: order is not dead-lettered",
+			errorFromDB: entities.ErrOrderNotDeadLettered,
+			expectedErr: entities.ErrOrderNotDeadLettered,
+		},
+	}
+	for _, tt := range requeueTests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockOrdersRepository.EXPECT().RequeueOrder(ctx, first.OrderID).Return(tt.errorFromDB).Once()
+			if tt.errorFromDB == nil {
+				mockOrdersQueue.EXPECT().Push(entities.Order{OrderID: first.OrderID}).Once()
+			}
+			err := ordersProcessor.Requeue(ctx, first.OrderID)
+			assert.Equal(t, tt.expectedErr, err)
 		})
 	}
 }
@@ -0,0 +1,183 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+//go:generate mockery --name passwordRepository
+type passwordRepository interface {
+	GetUserByID(ctx context.Context, userID string) (entities.User, error)
+	GetUserByLogin(ctx context.Context, login string) (entities.User, error)
+	ChangePassword(ctx context.Context, userID, hashedPassword string) error
+	SavePasswordResetToken(ctx context.Context, token entities.PasswordResetToken) error
+	ConsumePasswordResetToken(ctx context.Context, tokenHash, hashedPassword string) error
+}
+
+//go:generate mockery --name notifier
+type notifier interface {
+	Send(ctx context.Context, notification entities.Notification) error
+}
+
+// resetSendTimeout bounds sending one reset message in the background.
+const resetSendTimeout = 30 * time.Second
+
+var (
+	// A login gets few reset messages so its mailbox can't be flooded; an
+	// IP gets more since many users may share it.
+	resetLoginPolicy = attemptsPolicy{freeAttempts: 3, lockoutAttempts: 6}
+	resetIPPolicy    = attemptsPolicy{freeAttempts: 20, lockoutAttempts: 50}
+)
+
+type passwordManager struct {
+	repository passwordRepository
+	notifier   notifier
+	attempts   loginAttemptsRepository
+	resetTTL   time.Duration
+	resetURL   string
+	now        func() time.Time
+	// async runs the lookup and sending of a reset message after
+	// RequestReset has returned.
+	async func(func())
+}
+
+// ChangePassword sets a new password after checking the current one and
+// signs the user out on every device, the current one included.
+func (p *passwordManager) ChangePassword(ctx context.Context, userID, oldPassword, newPassword string) error {
+	if newPassword == "" {
+		return entities.ErrInvalidPassword
+	}
+	user, err := p.repository.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	match, _, err := utils.ComparePassword(user.Password, oldPassword)
+	if err != nil || !match {
+		return entities.ErrInvalidCredentials
+	}
+
+	passwordHash, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	return p.repository.ChangePassword(ctx, userID, passwordHash)
+}
+
+// RequestReset sends a single-use reset token to the email of login. Unknown
+// logins and users without an email are silently ignored, and the lookup
+// and sending happen after it returns, so neither the answer nor its timing
+// tells which logins exist. Requests are throttled per login and per IP
+// with ErrTooManyResetRequests.
+func (p *passwordManager) RequestReset(ctx context.Context, login, ip string) (time.Duration, error) {
+	now := p.now()
+	resetBefore := now.Add(-loginLockoutDuration)
+	login = utils.NormalizeLogin(login)
+
+	loginAttempts, err := p.attempts.AddLoginAttempt(ctx, "reset-login:"+login, now, resetBefore)
+	if err != nil {
+		return 0, err
+	}
+	ipAttempts, err := p.attempts.AddLoginAttempt(ctx, "reset-ip:"+ip, now, resetBefore)
+	if err != nil {
+		return 0, err
+	}
+	retryAfter := resetLoginPolicy.retryAfter(loginAttempts, now)
+	if ipRetryAfter := resetIPPolicy.retryAfter(ipAttempts, now); ipRetryAfter > retryAfter {
+		retryAfter = ipRetryAfter
+	}
+	if retryAfter > 0 {
+		return retryAfter, entities.ErrTooManyResetRequests
+	}
+
+	p.async(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), resetSendTimeout)
+		defer cancel()
+		if err := p.sendReset(ctx, login); err != nil {
+			utils.Logger.Error("passwordManager:RequestReset - sendReset", zap.Error(err))
+		}
+	})
+	return 0, nil
+}
+
+func (p *passwordManager) sendReset(ctx context.Context, login string) error {
+	user, err := p.repository.GetUserByLogin(ctx, login)
+	if errors.Is(err, entities.ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return nil
+	}
+
+	token, err := utils.GenerateToken()
+	if err != nil {
+		return err
+	}
+	err = p.repository.SavePasswordResetToken(ctx, entities.PasswordResetToken{
+		Hash:      utils.HexHash(token),
+		UserID:    user.ID,
+		ExpiresAt: p.now().Add(p.resetTTL),
+	})
+	if err != nil {
+		return err
+	}
+	return p.notifier.Send(ctx, entities.Notification{
+		To:      user.Email,
+		Subject: "Password reset",
+		Body:    p.resetBody(token),
+	})
+}
+
+func (p *passwordManager) ResetPassword(ctx context.Context, token, newPassword string) error {
+	if newPassword == "" {
+		return entities.ErrInvalidPassword
+	}
+	if token == "" {
+		return entities.ErrInvalidResetToken
+	}
+	passwordHash, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	return p.repository.ConsumePasswordResetToken(ctx, utils.HexHash(token), passwordHash)
+}
+
+func (p *passwordManager) resetBody(token string) string {
+	body := fmt.Sprintf(
+		"Somebody requested a password reset for your account.\n\n"+
+			"Reset token: %s\n\nThe token expires in %s. If it wasn't you, ignore this message.\n",
+		token, p.resetTTL,
+	)
+	if p.resetURL != "" {
+		body += fmt.Sprintf("\nReset link: %s?token=%s\n", p.resetURL, url.QueryEscape(token))
+	}
+	return body
+}
+
+func NewPasswordManager(
+	repository passwordRepository,
+	notifier notifier,
+	attempts loginAttemptsRepository,
+	resetTTL time.Duration,
+	resetURL string,
+) *passwordManager {
+	return &passwordManager{
+		repository: repository,
+		notifier:   notifier,
+		attempts:   attempts,
+		resetTTL:   resetTTL,
+		resetURL:   resetURL,
+		now:        time.Now,
+		async:      func(f func()) { go f() },
+	}
+}
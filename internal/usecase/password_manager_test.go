@@ -0,0 +1,230 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+func TestPasswordManager(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	mockPasswordRepository := newMockPasswordRepository(t)
+	mockNotifier := newMockNotifier(t)
+	mockLoginAttemptsRepository := newMockLoginAttemptsRepository(t)
+	passwordManager := NewPasswordManager(
+		mockPasswordRepository, mockNotifier, mockLoginAttemptsRepository, time.Hour, "https://example.com/reset",
+	)
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	passwordManager.now = func() time.Time { return now }
+	// Run the background part before RequestReset returns.
+	passwordManager.async = func(f func()) { f() }
+
+	currentHash, err := utils.HashPassword("old")
+	assert.NoError(t, err)
+
+	changePasswordTests := []struct {
+		name        string
+		userID      string
+		oldPassword string
+		newPassword string
+		userFromDB  entities.User
+		errFromDB   error
+		expectedErr error
+	}{
+		{
+			name:        "ChangePassword: success",
+			userID:      "123456",
+			oldPassword: "old",
+			newPassword: "new",
+			userFromDB:  entities.User{ID: "123456", Login: "login", Password: currentHash},
+			errFromDB:   nil,
+			expectedErr: nil,
+		},
+		{
+			name:        "ChangePassword: wrong old password",
+			userID:      "123456",
+			oldPassword: "wrong",
+			newPassword: "new",
+			userFromDB:  entities.User{ID: "123456", Login: "login", Password: currentHash},
+			errFromDB:   nil,
+			expectedErr: entities.ErrInvalidCredentials,
+		},
+		{
+			name:        "ChangePassword: empty new password",
+			userID:      "123456",
+			oldPassword: "old",
+			newPassword: "",
+			expectedErr: entities.ErrInvalidPassword,
+		},
+		{
+			name:        "ChangePassword: DB error",
+			userID:      "123456",
+			oldPassword: "old",
+			newPassword: "new",
+			userFromDB:  entities.User{},
+			errFromDB:   errors.New("database error"),
+			expectedErr: errors.New("database error"),
+		},
+	}
+	for _, tt := range changePasswordTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.newPassword != "" {
+				mockPasswordRepository.EXPECT().
+					GetUserByID(ctx, tt.userID).
+					Return(tt.userFromDB, tt.errFromDB).
+					Once()
+			}
+			if tt.expectedErr == nil {
+				mockPasswordRepository.EXPECT().
+					ChangePassword(ctx, tt.userID, mock.MatchedBy(func(hash string) bool {
+						match, _, err := utils.ComparePassword(hash, tt.newPassword)
+						return match && err == nil
+					})).
+					Return(nil).
+					Once()
+			}
+			err := passwordManager.ChangePassword(ctx, tt.userID, tt.oldPassword, tt.newPassword)
+			assert.Equal(t, tt.expectedErr, err)
+		})
+	}
+
+	requestResetTests := []struct {
+		name        string
+		login       string
+		userFromDB  entities.User
+		errFromDB   error
+		sent        bool
+		expectedErr error
+	}{
+		{
+			name:        "RequestReset: token sent to email",
+			login:       "login",
+			userFromDB:  entities.User{ID: "123456", Login: "login", Email: "user@example.com"},
+			errFromDB:   nil,
+			sent:        true,
+			expectedErr: nil,
+		},
+		{
+			name:        "RequestReset: unknown login is ignored",
+			login:       "unknown",
+			userFromDB:  entities.User{},
+			errFromDB:   entities.ErrUserNotFound,
+			sent:        false,
+			expectedErr: nil,
+		},
+		{
+			name:        "RequestReset: user without email is ignored",
+			login:       "login",
+			userFromDB:  entities.User{ID: "123456", Login: "login"},
+			errFromDB:   nil,
+			sent:        false,
+			expectedErr: nil,
+		},
+	}
+	for _, tt := range requestResetTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saved entities.PasswordResetToken
+			var sent entities.Notification
+			mockLoginAttemptsRepository.EXPECT().
+				AddLoginAttempt(ctx, mock.AnythingOfType("string"), now, now.Add(-loginLockoutDuration)).
+				Return(entities.LoginAttempts{}, nil).
+				Twice()
+			mockPasswordRepository.EXPECT().
+				GetUserByLogin(mock.Anything, tt.login).
+				Return(tt.userFromDB, tt.errFromDB).
+				Once()
+			if tt.sent {
+				mockPasswordRepository.EXPECT().
+					SavePasswordResetToken(mock.Anything, mock.AnythingOfType("entities.PasswordResetToken")).
+					Run(func(ctx context.Context, token entities.PasswordResetToken) { saved = token }).
+					Return(nil).
+					Once()
+				mockNotifier.EXPECT().
+					Send(mock.Anything, mock.AnythingOfType("entities.Notification")).
+					Run(func(ctx context.Context, notification entities.Notification) { sent = notification }).
+					Return(nil).
+					Once()
+			}
+			_, err := passwordManager.RequestReset(ctx, tt.login, "10.0.0.1")
+			assert.Equal(t, tt.expectedErr, err)
+			if !tt.sent {
+				return
+			}
+			assert.Equal(t, tt.userFromDB.ID, saved.UserID)
+			assert.Equal(t, tt.userFromDB.Email, sent.To)
+			assert.Contains(t, sent.Body, "https://example.com/reset?token=")
+
+			token := sent.Body[strings.Index(sent.Body, "Reset token: ")+len("Reset token: "):]
+			token = token[:strings.Index(token, "\n")]
+			assert.Equal(t, utils.HexHash(token), saved.Hash)
+		})
+	}
+
+	t.Run("RequestReset: throttled login", func(t *testing.T) {
+		resetBefore := now.Add(-loginLockoutDuration)
+		mockLoginAttemptsRepository.EXPECT().
+			AddLoginAttempt(ctx, "reset-login:login", now, resetBefore).
+			Return(entities.LoginAttempts{Failures: 6, LastFailureAt: now}, nil).
+			Once()
+		mockLoginAttemptsRepository.EXPECT().
+			AddLoginAttempt(ctx, "reset-ip:10.0.0.1", now, resetBefore).
+			Return(entities.LoginAttempts{}, nil).
+			Once()
+		retryAfter, err := passwordManager.RequestReset(ctx, " Login ", "10.0.0.1")
+		assert.Equal(t, entities.ErrTooManyResetRequests, err)
+		assert.Equal(t, loginLockoutDuration, retryAfter)
+	})
+
+	resetPasswordTests := []struct {
+		name        string
+		token       string
+		newPassword string
+		errFromDB   error
+		expectedErr error
+	}{
+		{
+			name:        "ResetPassword: success",
+			token:       "token",
+			newPassword: "new",
+			errFromDB:   nil,
+			expectedErr: nil,
+		},
+		{
+			name:        "ResetPassword: used or expired token",
+			token:       "token",
+			newPassword: "new",
+			errFromDB:   entities.ErrInvalidResetToken,
+			expectedErr: entities.ErrInvalidResetToken,
+		},
+		{
+			name:        "ResetPassword: empty token",
+			token:       "",
+			newPassword: "new",
+			expectedErr: entities.ErrInvalidResetToken,
+		},
+	}
+	for _, tt := range resetPasswordTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.token != "" {
+				mockPasswordRepository.EXPECT().
+					ConsumePasswordResetToken(ctx, utils.HexHash(tt.token), mock.MatchedBy(func(hash string) bool {
+						match, _, err := utils.ComparePassword(hash, tt.newPassword)
+						return match && err == nil
+					})).
+					Return(tt.errFromDB).
+					Once()
+			}
+			err := passwordManager.ResetPassword(ctx, tt.token, tt.newPassword)
+			assert.Equal(t, tt.expectedErr, err)
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package usecase
+
+import (
+	"context"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+//go:generate mockery --name sessionRepository
+type sessionRepository interface {
+	ListSessions(ctx context.Context, userID string) ([]entities.Session, error)
+	TerminateSession(ctx context.Context, userID, sessionID string) error
+}
+
+type sessionManager struct {
+	repository sessionRepository
+}
+
+// List returns the active sessions of the user and marks the one the
+// request was made from.
+func (s *sessionManager) List(ctx context.Context, userID, currentSessionID string) ([]entities.Session, error) {
+	sessions, err := s.repository.ListSessions(ctx, userID)
+	if err != nil {
+		return sessions, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+	}
+	return sessions, nil
+}
+
+// Terminate signs a device out. Its refresh token stops working at once and
+// its access tokens with the next request.
+func (s *sessionManager) Terminate(ctx context.Context, userID, sessionID string) error {
+	return s.repository.TerminateSession(ctx, userID, sessionID)
+}
+
+func NewSessionManager(repository sessionRepository) *sessionManager {
+	return &sessionManager{
+		repository: repository,
+	}
+}
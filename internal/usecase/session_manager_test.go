@@ -0,0 +1,89 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+func TestSessionManager(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	mockSessionRepository := newMockSessionRepository(t)
+	sessionManager := NewSessionManager(mockSessionRepository)
+
+	listTests := []struct {
+		name             string
+		currentSession   string
+		sessionsFromDB   []entities.Session
+		errFromDB        error
+		expectedSessions []entities.Session
+		expectedErr      error
+	}{
+		{
+			name:           "List: marks current session",
+			currentSession: "s2",
+			sessionsFromDB: []entities.Session{{ID: "s1", UserAgent: "curl"}, {ID: "s2", UserAgent: "firefox"}},
+			errFromDB:      nil,
+			expectedSessions: []entities.Session{
+				{ID: "s1", UserAgent: "curl"},
+				{ID: "s2", UserAgent: "firefox", Current: true},
+			},
+			expectedErr: nil,
+		},
+		{
+			name:             "List: DB error",
+			currentSession:   "s1",
+			sessionsFromDB:   []entities.Session{},
+			errFromDB:        errors.New("database error"),
+			expectedSessions: []entities.Session{},
+			expectedErr:      errors.New("database error"),
+		},
+	}
+	for _, tt := range listTests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSessionRepository.EXPECT().
+				ListSessions(ctx, "123456").
+				Return(tt.sessionsFromDB, tt.errFromDB).
+				Once()
+			sessions, err := sessionManager.List(ctx, "123456", tt.currentSession)
+			assert.Equal(t, tt.expectedErr, err)
+			assert.Equal(t, tt.expectedSessions, sessions)
+		})
+	}
+
+	terminateTests := []struct {
+		name        string
+		sessionID   string
+		errFromDB   error
+		expectedErr error
+	}{
+		{
+			name:        "Terminate: success",
+			sessionID:   "s1",
+			errFromDB:   nil,
+			expectedErr: nil,
+		},
+		{
+			name:        "Terminate: unknown session",
+			sessionID:   "s3",
+			errFromDB:   entities.ErrSessionNotFound,
+			expectedErr: entities.ErrSessionNotFound,
+		},
+	}
+	for _, tt := range terminateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSessionRepository.EXPECT().
+				TerminateSession(ctx, "123456", tt.sessionID).
+				Return(tt.errFromDB).
+				Once()
+			err := sessionManager.Terminate(ctx, "123456", tt.sessionID)
+			assert.Equal(t, tt.expectedErr, err)
+		})
+	}
+}
@@ -2,9 +2,12 @@ package usecase
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
 
 	"github.com/Albitko/loyalty-program/internal/entities"
 	"github.com/Albitko/loyalty-program/internal/utils"
@@ -12,52 +15,289 @@ import (
 
 //go:generate mockery --name userRepository
 type userRepository interface {
-	Register(ctx context.Context, id, login, hashedPassword string) error
+	Register(ctx context.Context, id, login, hashedPassword, email string) error
 	GetCredentials(ctx context.Context, login string) (entities.User, error)
+	UpdatePassword(ctx context.Context, userID, hashedPassword string) error
+	SaveRefreshToken(ctx context.Context, token entities.RefreshToken) error
+	RotateRefreshToken(ctx context.Context, oldHash string, newToken entities.RefreshToken) (entities.User, string, error)
+	RevokeRefreshTokenFamily(ctx context.Context, userID, tokenHash string) error
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	MarkTokenUsed(ctx context.Context, jti string, expiresAt time.Time) (bool, error)
+	SetUserRole(ctx context.Context, userID string, role entities.Role) error
+	PromoteFirstAdmin(ctx context.Context, login string) (bool, error)
+	CreateSession(ctx context.Context, session entities.Session) error
+	TerminateSession(ctx context.Context, userID, sessionID string) error
+}
+
+const (
+	accessTokenTTL = time.Hour
+	// mfaTokenTTL bounds the time between the password and the second factor.
+	mfaTokenTTL = 5 * time.Minute
+)
+
+//go:generate mockery --name signingKeys
+type signingKeys interface {
+	ActiveKey() (entities.SigningKey, error)
+	VerificationKey(kid string) (entities.SigningKey, error)
 }
 
 type authenticator struct {
-	repository userRepository
-	secret     string
+	repository      userRepository
+	keys            signingKeys
+	refreshTokenTTL time.Duration
+	dummyHash       string
+}
+
+// StartSession records a new signed-in device. Tokens for it are issued with
+// the returned session ID.
+func (a *authenticator) StartSession(ctx context.Context, user entities.User, userAgent, ip string) (string, error) {
+	now := time.Now()
+	session := entities.Session{
+		ID:         uuid.New().String(),
+		UserID:     user.ID,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	err := a.repository.CreateSession(ctx, session)
+	if err != nil {
+		return "", err
+	}
+	return session.ID, nil
 }
 
-func (a *authenticator) CreateAccessToken(user entities.User) (string, error) {
+func (a *authenticator) CreateAccessToken(user entities.User, sessionID string) (string, error) {
+	role := user.Role
+	if role == "" {
+		role = entities.RoleUser
+	}
+	claims := &entities.JwtCustomClaims{
+		Name:      user.Login,
+		ID:        user.ID,
+		Role:      role,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
+		},
+	}
+	return a.signClaims(claims, entities.AccessTokenType)
+}
+
+// CreateMFAToken issues a short-lived token that only proves the password
+// was correct. It is exchanged for real tokens after the second factor.
+func (a *authenticator) CreateMFAToken(user entities.User) (string, error) {
 	claims := &entities.JwtCustomClaims{
-		Name: user.Login,
-		ID:   user.ID,
+		Name:    user.Login,
+		ID:      user.ID,
+		Role:    user.Role,
+		Purpose: entities.TokenPurposeMFA,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: &jwt.NumericDate{Time: time.Now().Add(time.Hour)},
+			ID:        uuid.New().String(),
+			Audience:  jwt.ClaimStrings{entities.MFATokenAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaTokenTTL)),
 		},
 	}
-	unsignedToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := unsignedToken.SignedString([]byte(a.secret))
+	return a.signClaims(claims, entities.MFATokenType)
+}
+
+// ParseMFAToken verifies an MFA token. It does not check whether the token
+// was already exchanged; see ConsumeMFAToken.
+func (a *authenticator) ParseMFAToken(token string) (entities.MFAToken, error) {
+	claims, err := utils.ParseToken(token, entities.MFATokenType, a.keys.VerificationKey)
+	if err != nil || claims.Purpose != entities.TokenPurposeMFA ||
+		!claims.VerifyAudience(entities.MFATokenAudience, true) || claims.ExpiresAt == nil {
+		return entities.MFAToken{}, entities.ErrInvalidMFAToken
+	}
+	return entities.MFAToken{
+		ID:        claims.RegisteredClaims.ID,
+		User:      entities.User{ID: claims.ID, Login: claims.Name, Role: claims.Role},
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, nil
+}
+
+// ConsumeMFAToken records that the token was exchanged for access tokens.
+// A token that was already used is refused with ErrInvalidMFAToken.
+func (a *authenticator) ConsumeMFAToken(ctx context.Context, token entities.MFAToken) error {
+	firstUse, err := a.repository.MarkTokenUsed(ctx, token.ID, token.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	if !firstUse {
+		return entities.ErrInvalidMFAToken
+	}
+	return nil
+}
+
+func (a *authenticator) signClaims(claims *entities.JwtCustomClaims, tokenType string) (string, error) {
+	key, err := a.keys.ActiveKey()
+	if err != nil {
+		return "", err
+	}
+	method, err := utils.SigningMethod(key)
+	if err != nil {
+		return "", err
+	}
+	signKey, err := utils.SignKey(key)
+	if err != nil {
+		return "", err
+	}
+	unsignedToken := jwt.NewWithClaims(method, claims)
+	unsignedToken.Header["kid"] = key.ID
+	unsignedToken.Header["typ"] = tokenType
+	signedToken, err := unsignedToken.SignedString(signKey)
 	if err != nil {
 		return "", err
 	}
 	return signedToken, nil
 }
 
+// CreateRefreshToken starts the refresh token family of a session. Only a
+// hash of the opaque token is stored.
+func (a *authenticator) CreateRefreshToken(ctx context.Context, user entities.User, sessionID string) (string, error) {
+	token, err := utils.GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	err = a.repository.SaveRefreshToken(ctx, entities.RefreshToken{
+		Hash:      utils.HexHash(token),
+		UserID:    user.ID,
+		FamilyID:  sessionID,
+		ExpiresAt: time.Now().Add(a.refreshTokenTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Refresh exchanges a refresh token for a new one of the same session. The
+// presented token can't be used again.
+func (a *authenticator) Refresh(
+	ctx context.Context, refreshToken string,
+) (user entities.User, sessionID string, newToken string, err error) {
+	newToken, err = utils.GenerateToken()
+	if err != nil {
+		return user, "", "", err
+	}
+	user, sessionID, err = a.repository.RotateRefreshToken(ctx, utils.HexHash(refreshToken), entities.RefreshToken{
+		Hash:      utils.HexHash(newToken),
+		ExpiresAt: time.Now().Add(a.refreshTokenTTL),
+	})
+	if err != nil {
+		return user, "", "", err
+	}
+	return user, sessionID, newToken, nil
+}
+
+// Logout ends the session of the access token the request was made with and
+// revokes the token itself. A refresh token may be given for tokens issued
+// before sessions were tracked.
+func (a *authenticator) Logout(ctx context.Context, claims entities.JwtCustomClaims, refreshToken string) error {
+	if claims.SessionID != "" {
+		err := a.repository.TerminateSession(ctx, claims.ID, claims.SessionID)
+		if err != nil && !errors.Is(err, entities.ErrSessionNotFound) {
+			return err
+		}
+	}
+	if refreshToken != "" {
+		err := a.repository.RevokeRefreshTokenFamily(ctx, claims.ID, utils.HexHash(refreshToken))
+		if err != nil {
+			return err
+		}
+	}
+	if claims.ExpiresAt == nil {
+		return nil
+	}
+	return a.repository.RevokeAccessToken(ctx, claims.RegisteredClaims.ID, claims.ExpiresAt.Time)
+}
+
 func (a *authenticator) Register(ctx context.Context, user entities.User) error {
-	err := a.repository.Register(ctx, user.ID, user.Login, utils.HexHash(user.Password))
+	user.Login = utils.NormalizeLogin(user.Login)
+	if user.Login == "" {
+		return entities.ErrInvalidLogin
+	}
+	passwordHash, err := utils.HashPassword(user.Password)
+	if err != nil {
+		return err
+	}
+	err = a.repository.Register(ctx, user.ID, user.Login, passwordHash, user.Email)
 	return err
 }
 
 func (a *authenticator) Auth(ctx context.Context, login, password string) (entities.User, error) {
-
-	passwordHash := utils.HexHash(password)
-	user, err := a.repository.GetCredentials(ctx, login)
+	user, err := a.repository.GetCredentials(ctx, utils.NormalizeLogin(login))
+	if errors.Is(err, entities.ErrInvalidCredentials) {
+		// Spend the same time as for a wrong password so response times
+		// don't reveal which logins exist.
+		_, _, _ = utils.ComparePassword(a.dummyHash, password)
+		return user, err
+	}
 	if err != nil {
 		return user, err
 	}
-	if passwordHash != user.Password {
+	// A hash in an unknown format can never match, so it is reported
+	// the same way as a wrong password.
+	match, needsRehash, err := utils.ComparePassword(user.Password, password)
+	if err != nil || !match {
 		return user, entities.ErrInvalidCredentials
 	}
+	if needsRehash {
+		a.rehashPassword(ctx, user, password)
+	}
 	return user, nil
 }
 
-func NewAuthenticator(repository userRepository, secret string) *authenticator {
-	return &authenticator{
-		repository: repository,
-		secret:     secret,
+// rehashPassword upgrades a legacy or outdated hash after a successful login.
+// Failures are only logged: the user has already been authenticated.
+func (a *authenticator) rehashPassword(ctx context.Context, user entities.User, password string) {
+	passwordHash, err := utils.HashPassword(password)
+	if err != nil {
+		utils.Logger.Error("authenticator:rehashPassword - hash password", zap.Error(err))
+		return
+	}
+	err = a.repository.UpdatePassword(ctx, user.ID, passwordHash)
+	if err != nil {
+		utils.Logger.Error("authenticator:rehashPassword - update password", zap.Error(err))
 	}
 }
+
+// SetRole changes the role of a user. All their sessions end with the
+// change, so the new role applies from their next login.
+func (a *authenticator) SetRole(ctx context.Context, userID string, role entities.Role) error {
+	if !role.Valid() {
+		return entities.ErrInvalidRole
+	}
+	return a.repository.SetUserRole(ctx, userID, role)
+}
+
+// BootstrapAdmin makes the user with the given login the first admin. It
+// does nothing once there is an admin, so it is safe to run on every start.
+func (a *authenticator) BootstrapAdmin(ctx context.Context, login string) error {
+	promoted, err := a.repository.PromoteFirstAdmin(ctx, utils.NormalizeLogin(login))
+	if err != nil {
+		return err
+	}
+	if promoted {
+		utils.Logger.Info("authenticator:BootstrapAdmin - promoted first admin", zap.String("login", login))
+	}
+	return nil
+}
+
+func NewAuthenticator(
+	repository userRepository, keys signingKeys, refreshTokenTTL time.Duration,
+) (*authenticator, error) {
+	dummyHash, err := utils.HashPassword(uuid.New().String())
+	if err != nil {
+		return nil, err
+	}
+	return &authenticator{
+		repository:      repository,
+		keys:            keys,
+		refreshTokenTTL: refreshTokenTTL,
+		dummyHash:       dummyHash,
+	}, nil
+}
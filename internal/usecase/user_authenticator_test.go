@@ -6,20 +6,45 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 
 	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
 )
 
 func TestUserAuthenticator(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
 	defer cancel()
 	mockUserRepository := newMockUserRepository(t)
-	userAuthenticator := NewAuthenticator(mockUserRepository, "secret")
+	mockSigningKeys := newMockSigningKeys(t)
+	userAuthenticator, err := NewAuthenticator(mockUserRepository, mockSigningKeys, time.Hour)
+	assert.NoError(t, err)
+
+	signingKey := entities.SigningKey{
+		ID:        "key1",
+		Secret:    []byte("secret"),
+		CreatedAt: time.Now(),
+	}
+	rsaKey := entities.SigningKey{
+		ID:        "key2",
+		Algorithm: entities.SigningAlgorithmRS256,
+		CreatedAt: time.Now(),
+	}
+	assert.NoError(t, utils.GenerateKeyMaterial(&rsaKey))
+	ed25519Key := entities.SigningKey{
+		ID:        "key3",
+		Algorithm: entities.SigningAlgorithmEdDSA,
+		CreatedAt: time.Now(),
+	}
+	assert.NoError(t, utils.GenerateKeyMaterial(&ed25519Key))
 
 	createAccessTokenTests := []struct {
 		name          string
 		user          entities.User
+		key           entities.SigningKey
+		keyErr        error
 		expectedToken string
 		expectedErr   error
 	}{
@@ -30,27 +55,167 @@ func TestUserAuthenticator(t *testing.T) {
 				Login:    "admin",
 				Password: "pass",
 			},
+			key:           signingKey,
+			keyErr:        nil,
 			expectedToken: "",
 			expectedErr:   nil,
 		},
+		{
+			name: "CreateAccessToken: RS256",
+			user: entities.User{
+				ID:       "12345",
+				Login:    "admin",
+				Password: "pass",
+			},
+			key:           rsaKey,
+			keyErr:        nil,
+			expectedToken: "",
+			expectedErr:   nil,
+		},
+		{
+			name: "CreateAccessToken: EdDSA",
+			user: entities.User{
+				ID:       "12345",
+				Login:    "admin",
+				Password: "pass",
+			},
+			key:           ed25519Key,
+			keyErr:        nil,
+			expectedToken: "",
+			expectedErr:   nil,
+		},
+		{
+			name: "CreateAccessToken: no active key",
+			user: entities.User{
+				ID:       "12345",
+				Login:    "admin",
+				Password: "pass",
+			},
+			key:           entities.SigningKey{},
+			keyErr:        entities.ErrNoActiveSigningKey,
+			expectedToken: "",
+			expectedErr:   entities.ErrNoActiveSigningKey,
+		},
 	}
 	for _, tt := range createAccessTokenTests {
 		t.Run(tt.name, func(t *testing.T) {
-			token, err := userAuthenticator.CreateAccessToken(tt.user)
+			mockSigningKeys.EXPECT().
+				ActiveKey().
+				Return(tt.key, tt.keyErr).
+				Once()
+			token, err := userAuthenticator.CreateAccessToken(tt.user, "session")
 			assert.Equal(t, tt.expectedErr, err)
+			if tt.expectedErr != nil {
+				return
+			}
 			assert.NotEqual(t, tt.expectedToken, token)
+
+			parsed, err := jwt.ParseWithClaims(token, &entities.JwtCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
+				assert.Equal(t, tt.key.ID, token.Header["kid"])
+				return utils.VerifyKey(tt.key)
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.user.ID, parsed.Claims.(*entities.JwtCustomClaims).ID)
+			assert.Equal(t, entities.RoleUser, parsed.Claims.(*entities.JwtCustomClaims).Role)
+			assert.Equal(t, "session", parsed.Claims.(*entities.JwtCustomClaims).SessionID)
+		})
+	}
+
+	registerTests := []struct {
+		name        string
+		user        entities.User
+		errFromDB   error
+		expectedErr error
+	}{
+		{
+			name: "Register: password stored as argon2id hash",
+			user: entities.User{
+				ID:       "12345",
+				Login:    "admin",
+				Password: "pass",
+			},
+			errFromDB:   nil,
+			expectedErr: nil,
+		},
+		{
+			name: "Register: login is normalized",
+			user: entities.User{
+				ID:       "12345",
+				Login:    "  Admin ",
+				Password: "pass",
+				Email:    "admin@example.com",
+			},
+			errFromDB:   nil,
+			expectedErr: nil,
+		},
+		{
+			name: "Register: empty login",
+			user: entities.User{
+				ID:       "12345",
+				Login:    "   ",
+				Password: "pass",
+			},
+			errFromDB:   nil,
+			expectedErr: entities.ErrInvalidLogin,
+		},
+		{
+			name: "Register: login already in use",
+			user: entities.User{
+				ID:       "12345",
+				Login:    "admin",
+				Password: "pass",
+			},
+			errFromDB:   entities.ErrLoginAlreadyInUse,
+			expectedErr: entities.ErrLoginAlreadyInUse,
+		},
+	}
+	for _, tt := range registerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.expectedErr != entities.ErrInvalidLogin {
+				mockUserRepository.EXPECT().
+					Register(ctx, tt.user.ID, utils.NormalizeLogin(tt.user.Login), mock.MatchedBy(func(hash string) bool {
+						match, needsRehash, err := utils.ComparePassword(hash, tt.user.Password)
+						return match && !needsRehash && err == nil
+					}), tt.user.Email).
+					Return(tt.errFromDB).
+					Once()
+			}
+			err := userAuthenticator.Register(ctx, tt.user)
+			assert.Equal(t, tt.expectedErr, err)
 		})
 	}
 
+	argon2Hash, err := utils.HashPassword("<password>")
+	assert.NoError(t, err)
+
 	AuthTests := []struct {
 		name         string
 		login        string
 		password     string
 		userFromDB   entities.User
 		errFromDB    error
+		rehash       bool
 		expectedUser entities.User
 		expectedErr  error
 	}{
+		{
+			name:     "Auth: success with argon2id hash",
+			login:    "login",
+			password: "<password>",
+			userFromDB: entities.User{
+				ID:       "123456",
+				Login:    "login",
+				Password: argon2Hash,
+			},
+			errFromDB: nil,
+			rehash:    false,
+			expectedUser: entities.User{
+				ID:       "123456",
+				Login:    "login",
+				Password: argon2Hash,
+			},
+			expectedErr: nil,
+		},
 		{
 			name:     "Auth: success",
 			login:    "login",
@@ -61,6 +226,7 @@ func TestUserAuthenticator(t *testing.T) {
 				Password: "dd81ca61fb57a4ff454c1cf89335a1f5e96afa849dfad4e0116b6ec35309fdea",
 			},
 			errFromDB: nil,
+			rehash:    true,
 			expectedUser: entities.User{
 				ID:       "123456",
 				Login:    "login",
@@ -68,6 +234,23 @@ func TestUserAuthenticator(t *testing.T) {
 			},
 			expectedErr: nil,
 		},
+		{
+			name:     "Auth: invalid credentials with argon2id hash",
+			login:    "login",
+			password: "wrong",
+			userFromDB: entities.User{
+				ID:       "123456",
+				Login:    "login",
+				Password: argon2Hash,
+			},
+			errFromDB: nil,
+			expectedUser: entities.User{
+				ID:       "123456",
+				Login:    "login",
+				Password: argon2Hash,
+			},
+			expectedErr: entities.ErrInvalidCredentials,
+		},
 		{
 			name:     "Auth: invalid credentials",
 			login:    "login",
@@ -85,6 +268,33 @@ func TestUserAuthenticator(t *testing.T) {
 			},
 			expectedErr: entities.ErrInvalidCredentials,
 		},
+		{
+			name:     "Auth: login is normalized",
+			login:    " LOGIN ",
+			password: "<password>",
+			userFromDB: entities.User{
+				ID:       "123456",
+				Login:    "login",
+				Password: argon2Hash,
+			},
+			errFromDB: nil,
+			rehash:    false,
+			expectedUser: entities.User{
+				ID:       "123456",
+				Login:    "login",
+				Password: argon2Hash,
+			},
+			expectedErr: nil,
+		},
+		{
+			name:         "Auth: unknown login",
+			login:        "unknown",
+			password:     "<password>",
+			userFromDB:   entities.User{},
+			errFromDB:    entities.ErrInvalidCredentials,
+			expectedUser: entities.User{},
+			expectedErr:  entities.ErrInvalidCredentials,
+		},
 		{
 			name:         "Auth: DB error",
 			login:        "login",
@@ -98,13 +308,275 @@ func TestUserAuthenticator(t *testing.T) {
 	for _, tt := range AuthTests {
 		t.Run(tt.name, func(t *testing.T) {
 			mockUserRepository.EXPECT().
-				GetCredentials(ctx, tt.login).
+				GetCredentials(ctx, utils.NormalizeLogin(tt.login)).
 				Return(tt.userFromDB, tt.errFromDB).
 				Once()
+			if tt.rehash {
+				mockUserRepository.EXPECT().
+					UpdatePassword(ctx, tt.userFromDB.ID, mock.MatchedBy(func(hash string) bool {
+						match, needsRehash, err := utils.ComparePassword(hash, tt.password)
+						return match && !needsRehash && err == nil
+					})).
+					Return(nil).
+					Once()
+			}
 			user, err := userAuthenticator.Auth(ctx, tt.login, tt.password)
 			assert.Equal(t, tt.expectedErr, err)
 			assert.Equal(t, tt.expectedUser, user)
 		})
 	}
 
+	createRefreshTokenTests := []struct {
+		name        string
+		user        entities.User
+		errFromDB   error
+		expectedErr error
+	}{
+		{
+			name:        "CreateRefreshToken: success",
+			user:        entities.User{ID: "123456", Login: "login"},
+			errFromDB:   nil,
+			expectedErr: nil,
+		},
+		{
+			name:        "CreateRefreshToken: DB error",
+			user:        entities.User{ID: "123456", Login: "login"},
+			errFromDB:   errors.New("database error"),
+			expectedErr: errors.New("database error"),
+		},
+	}
+	for _, tt := range createRefreshTokenTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saved entities.RefreshToken
+			mockUserRepository.EXPECT().
+				SaveRefreshToken(ctx, mock.AnythingOfType("entities.RefreshToken")).
+				Run(func(ctx context.Context, token entities.RefreshToken) { saved = token }).
+				Return(tt.errFromDB).
+				Once()
+			token, err := userAuthenticator.CreateRefreshToken(ctx, tt.user, "session")
+			assert.Equal(t, tt.expectedErr, err)
+			if tt.expectedErr != nil {
+				return
+			}
+			assert.Equal(t, utils.HexHash(token), saved.Hash)
+			assert.Equal(t, tt.user.ID, saved.UserID)
+			assert.Equal(t, "session", saved.FamilyID)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), saved.ExpiresAt, time.Minute)
+		})
+	}
+
+	refreshTests := []struct {
+		name         string
+		refreshToken string
+		userFromDB   entities.User
+		sessionID    string
+		errFromDB    error
+		expectedErr  error
+	}{
+		{
+			name:         "Refresh: success",
+			refreshToken: "token",
+			userFromDB:   entities.User{ID: "123456", Login: "login"},
+			sessionID:    "session",
+			errFromDB:    nil,
+			expectedErr:  nil,
+		},
+		{
+			name:         "Refresh: reused token",
+			refreshToken: "token",
+			userFromDB:   entities.User{},
+			sessionID:    "",
+			errFromDB:    entities.ErrRefreshTokenReused,
+			expectedErr:  entities.ErrRefreshTokenReused,
+		},
+	}
+	for _, tt := range refreshTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rotated entities.RefreshToken
+			mockUserRepository.EXPECT().
+				RotateRefreshToken(ctx, utils.HexHash(tt.refreshToken), mock.AnythingOfType("entities.RefreshToken")).
+				Run(func(ctx context.Context, oldHash string, newToken entities.RefreshToken) { rotated = newToken }).
+				Return(tt.userFromDB, tt.sessionID, tt.errFromDB).
+				Once()
+			user, sessionID, newToken, err := userAuthenticator.Refresh(ctx, tt.refreshToken)
+			assert.Equal(t, tt.expectedErr, err)
+			assert.Equal(t, tt.userFromDB, user)
+			assert.Equal(t, tt.sessionID, sessionID)
+			if tt.expectedErr != nil {
+				assert.Empty(t, newToken)
+				return
+			}
+			assert.NotEqual(t, tt.refreshToken, newToken)
+			assert.Equal(t, utils.HexHash(newToken), rotated.Hash)
+		})
+	}
+
+	expiresAt := time.Now().Add(time.Hour)
+	logoutTests := []struct {
+		name         string
+		claims       entities.JwtCustomClaims
+		refreshToken string
+		expectedErr  error
+	}{
+		{
+			name: "Logout: revoke access and refresh tokens",
+			claims: entities.JwtCustomClaims{
+				ID: "123456",
+				RegisteredClaims: jwt.RegisteredClaims{
+					ID:        "jti",
+					ExpiresAt: jwt.NewNumericDate(expiresAt),
+				},
+			},
+			refreshToken: "token",
+			expectedErr:  nil,
+		},
+		{
+			name: "Logout: revoke access token only",
+			claims: entities.JwtCustomClaims{
+				ID: "123456",
+				RegisteredClaims: jwt.RegisteredClaims{
+					ID:        "jti",
+					ExpiresAt: jwt.NewNumericDate(expiresAt),
+				},
+			},
+			refreshToken: "",
+			expectedErr:  nil,
+		},
+		{
+			name: "Logout: terminate session",
+			claims: entities.JwtCustomClaims{
+				ID:        "123456",
+				SessionID: "session",
+				RegisteredClaims: jwt.RegisteredClaims{
+					ID:        "jti",
+					ExpiresAt: jwt.NewNumericDate(expiresAt),
+				},
+			},
+			refreshToken: "",
+			expectedErr:  nil,
+		},
+	}
+	for _, tt := range logoutTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.claims.SessionID != "" {
+				mockUserRepository.EXPECT().
+					TerminateSession(ctx, tt.claims.ID, tt.claims.SessionID).
+					Return(nil).
+					Once()
+			}
+			if tt.refreshToken != "" {
+				mockUserRepository.EXPECT().
+					RevokeRefreshTokenFamily(ctx, tt.claims.ID, utils.HexHash(tt.refreshToken)).
+					Return(nil).
+					Once()
+			}
+			mockUserRepository.EXPECT().
+				RevokeAccessToken(ctx, tt.claims.RegisteredClaims.ID, tt.claims.ExpiresAt.Time).
+				Return(nil).
+				Once()
+			err := userAuthenticator.Logout(ctx, tt.claims, tt.refreshToken)
+			assert.Equal(t, tt.expectedErr, err)
+		})
+	}
+
+	t.Run("StartSession: records device", func(t *testing.T) {
+		var created entities.Session
+		mockUserRepository.EXPECT().
+			CreateSession(ctx, mock.AnythingOfType("entities.Session")).
+			Run(func(ctx context.Context, session entities.Session) { created = session }).
+			Return(nil).
+			Once()
+		sessionID, err := userAuthenticator.StartSession(ctx, entities.User{ID: "123456"}, "curl/8.0", "10.0.0.1")
+		assert.NoError(t, err)
+		assert.Equal(t, sessionID, created.ID)
+		assert.Equal(t, "123456", created.UserID)
+		assert.Equal(t, "curl/8.0", created.UserAgent)
+		assert.Equal(t, "10.0.0.1", created.IP)
+	})
+
+	setRoleTests := []struct {
+		name        string
+		userID      string
+		role        entities.Role
+		errFromDB   error
+		expectedErr error
+	}{
+		{
+			name:        "SetRole: success",
+			userID:      "123456",
+			role:        entities.RoleSupport,
+			errFromDB:   nil,
+			expectedErr: nil,
+		},
+		{
+			name:        "SetRole: unknown user",
+			userID:      "123456",
+			role:        entities.RoleAdmin,
+			errFromDB:   entities.ErrUserNotFound,
+			expectedErr: entities.ErrUserNotFound,
+		},
+		{
+			name:        "SetRole: invalid role",
+			userID:      "123456",
+			role:        entities.Role("root"),
+			errFromDB:   nil,
+			expectedErr: entities.ErrInvalidRole,
+		},
+	}
+	for _, tt := range setRoleTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.role.Valid() {
+				mockUserRepository.EXPECT().
+					SetUserRole(ctx, tt.userID, tt.role).
+					Return(tt.errFromDB).
+					Once()
+			}
+			err := userAuthenticator.SetRole(ctx, tt.userID, tt.role)
+			assert.Equal(t, tt.expectedErr, err)
+		})
+	}
+
+	t.Run("BootstrapAdmin: promotes normalized login", func(t *testing.T) {
+		mockUserRepository.EXPECT().PromoteFirstAdmin(ctx, "admin").Return(false, nil).Once()
+		err := userAuthenticator.BootstrapAdmin(ctx, " Admin ")
+		assert.NoError(t, err)
+	})
+
+	t.Run("MFA token: round trip", func(t *testing.T) {
+		mockSigningKeys.EXPECT().ActiveKey().Return(signingKey, nil).Once()
+		mockSigningKeys.EXPECT().VerificationKey(signingKey.ID).Return(signingKey, nil).Once()
+		user := entities.User{ID: "12345", Login: "admin", Role: entities.RoleUser}
+		token, err := userAuthenticator.CreateMFAToken(user)
+		assert.NoError(t, err)
+		parsed, err := userAuthenticator.ParseMFAToken(token)
+		assert.NoError(t, err)
+		assert.Equal(t, user, parsed.User)
+		assert.NotEmpty(t, parsed.ID)
+	})
+
+	t.Run("MFA token: refused as access token", func(t *testing.T) {
+		mockSigningKeys.EXPECT().ActiveKey().Return(signingKey, nil).Once()
+		mockSigningKeys.EXPECT().VerificationKey(signingKey.ID).Return(signingKey, nil).Once()
+		token, err := userAuthenticator.CreateMFAToken(entities.User{ID: "12345", Login: "admin"})
+		assert.NoError(t, err)
+		_, err = utils.ParseToken(token, entities.AccessTokenType, mockSigningKeys.VerificationKey)
+		assert.ErrorIs(t, err, entities.ErrUnexpectedTokenType)
+	})
+
+	t.Run("MFA token: used only once", func(t *testing.T) {
+		token := entities.MFAToken{ID: "jti", ExpiresAt: time.Now().Add(time.Minute)}
+		mockUserRepository.EXPECT().MarkTokenUsed(ctx, token.ID, token.ExpiresAt).Return(true, nil).Once()
+		assert.NoError(t, userAuthenticator.ConsumeMFAToken(ctx, token))
+		mockUserRepository.EXPECT().MarkTokenUsed(ctx, token.ID, token.ExpiresAt).Return(false, nil).Once()
+		assert.Equal(t, entities.ErrInvalidMFAToken, userAuthenticator.ConsumeMFAToken(ctx, token))
+	})
+
+	t.Run("MFA token: access token is refused", func(t *testing.T) {
+		mockSigningKeys.EXPECT().ActiveKey().Return(signingKey, nil).Once()
+		mockSigningKeys.EXPECT().VerificationKey(signingKey.ID).Return(signingKey, nil).Once()
+		token, err := userAuthenticator.CreateAccessToken(entities.User{ID: "12345", Login: "admin"}, "session")
+		assert.NoError(t, err)
+		_, err = userAuthenticator.ParseMFAToken(token)
+		assert.Equal(t, entities.ErrInvalidMFAToken, err)
+	})
 }
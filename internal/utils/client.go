@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"net/http"
 	"time"
 
 	"github.com/go-resty/resty/v2"
@@ -9,15 +8,10 @@ import (
 
 var RestyClient *resty.Client
 
+// InitializeRestyClient sets up the client for the accrual service. It
+// does not retry: throttling is handled by the accrual workers for all of
+// them at once.
 func InitializeRestyClient() {
-	RestyClient = resty.New()
-
-	RestyClient.
-		AddRetryCondition(
-			func(r *resty.Response, err error) bool {
-				return r.StatusCode() == http.StatusTooManyRequests
-			},
-		).
-		SetRetryMaxWaitTime(120 * time.Second)
-
+	RestyClient = resty.New().
+		SetTimeout(30 * time.Second)
 }
@@ -1,13 +1,18 @@
 package utils
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
-	"math/rand"
-	"time"
 )
 
-const secretLength = 20
+const (
+	secretLength = 32
+	keyIDLength  = 8
+	tokenLength  = 32
+)
 
 func HexHash(input string) string {
 	hash := sha256.New()
@@ -15,12 +20,34 @@ func HexHash(input string) string {
 	return hex.EncodeToString(hash.Sum(nil))
 }
 
-func GenerateSecret() string {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	letterRunes := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-	secret := make([]rune, secretLength)
-	for i := range secret {
-		secret[i] = letterRunes[r.Intn(len(letterRunes))]
+// HexHMAC returns the hex encoded HMAC-SHA256 of input under key.
+func HexHMAC(key []byte, input string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(input))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func GenerateSecret() ([]byte, error) {
+	secret := make([]byte, secretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func GenerateKeyID() (string, error) {
+	id := make([]byte, keyIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// GenerateToken returns a random URL-safe opaque token.
+func GenerateToken() (string, error) {
+	token := make([]byte, tokenLength)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
 	}
-	return string(secret)
+	return base64.RawURLEncoding.EncodeToString(token), nil
 }
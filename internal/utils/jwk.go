@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+const rsaKeyBits = 2048
+
+func SigningMethod(key entities.SigningKey) (jwt.SigningMethod, error) {
+	switch key.Algorithm {
+	case "", entities.SigningAlgorithmHS256:
+		return jwt.SigningMethodHS256, nil
+	case entities.SigningAlgorithmRS256:
+		return jwt.SigningMethodRS256, nil
+	case entities.SigningAlgorithmEdDSA:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", entities.ErrUnsupportedSigningAlgorithm, key.Algorithm)
+	}
+}
+
+// SignKey returns the key material jwt expects for signing with key.
+func SignKey(key entities.SigningKey) (interface{}, error) {
+	if key.SignMaterial != nil {
+		return key.SignMaterial, nil
+	}
+	switch key.Algorithm {
+	case "", entities.SigningAlgorithmHS256:
+		return key.Secret, nil
+	case entities.SigningAlgorithmRS256, entities.SigningAlgorithmEdDSA:
+		return x509.ParsePKCS8PrivateKey(key.PrivateKey)
+	default:
+		return nil, fmt.Errorf("%w: %s", entities.ErrUnsupportedSigningAlgorithm, key.Algorithm)
+	}
+}
+
+// VerifyKey returns the key material jwt expects for verifying tokens signed
+// with key: the secret for HS256 and the public key otherwise.
+func VerifyKey(key entities.SigningKey) (interface{}, error) {
+	if key.VerifyMaterial != nil {
+		return key.VerifyMaterial, nil
+	}
+	signKey, err := SignKey(key)
+	if err != nil {
+		return nil, err
+	}
+	switch private := signKey.(type) {
+	case *rsa.PrivateKey:
+		return &private.PublicKey, nil
+	case ed25519.PrivateKey:
+		return private.Public(), nil
+	default:
+		return signKey, nil
+	}
+}
+
+// PrepareKey parses the key material of key once, so signing and
+// verifying do not decode it again for every token.
+func PrepareKey(key *entities.SigningKey) error {
+	signKey, err := SignKey(*key)
+	if err != nil {
+		return err
+	}
+	key.SignMaterial = signKey
+	key.VerifyMaterial, err = VerifyKey(*key)
+	return err
+}
+
+// SameAlgorithm reports whether two algorithm names mean the same
+// algorithm; an empty one means HS256.
+func SameAlgorithm(a, b string) bool {
+	if a == "" {
+		a = entities.SigningAlgorithmHS256
+	}
+	if b == "" {
+		b = entities.SigningAlgorithmHS256
+	}
+	return a == b
+}
+
+// GenerateKeyMaterial fills in a fresh secret or private key for the
+// algorithm of key.
+func GenerateKeyMaterial(key *entities.SigningKey) error {
+	var private interface{}
+	var err error
+
+	switch key.Algorithm {
+	case "", entities.SigningAlgorithmHS256:
+		key.Secret, err = GenerateSecret()
+		return err
+	case entities.SigningAlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case entities.SigningAlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return fmt.Errorf("%w: %s", entities.ErrUnsupportedSigningAlgorithm, key.Algorithm)
+	}
+	if err != nil {
+		return err
+	}
+	key.PrivateKey, err = x509.MarshalPKCS8PrivateKey(private)
+	return err
+}
+
+// PublicJWK converts the public part of an asymmetric key to a JWK.
+// HMAC keys have no public part and are reported with ok == false.
+func PublicJWK(key entities.SigningKey) (jwk entities.JSONWebKey, ok bool, err error) {
+	if key.Algorithm == "" || key.Algorithm == entities.SigningAlgorithmHS256 {
+		return jwk, false, nil
+	}
+	public, err := VerifyKey(key)
+	if err != nil {
+		return jwk, false, err
+	}
+
+	jwk.Kid = key.ID
+	jwk.Alg = key.Algorithm
+	jwk.Use = "sig"
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	default:
+		return jwk, false, fmt.Errorf("%w: %T", entities.ErrUnsupportedSigningAlgorithm, public)
+	}
+	return jwk, true, nil
+}
+
+// ParseToken verifies a token of the given type signed with one of our keys.
+// The algorithm is pinned by the key found by kid, never taken from the
+// token itself.
+func ParseToken(
+	tokenString, tokenType string, verificationKey func(kid string) (entities.SigningKey, error),
+) (*entities.JwtCustomClaims, error) {
+	claims := &entities.JwtCustomClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, entities.ErrUnknownSigningKey
+		}
+		key, err := verificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		method, err := SigningMethod(key)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return VerifyKey(key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	if typ, _ := token.Header["typ"].(string); typ != tokenType {
+		return nil, fmt.Errorf("%w: %q", entities.ErrUnexpectedTokenType, typ)
+	}
+	return claims, nil
+}
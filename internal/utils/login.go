@@ -0,0 +1,11 @@
+package utils
+
+import (
+	"strings"
+)
+
+// NormalizeLogin makes logins that differ only in case or surrounding
+// whitespace refer to the same account.
+func NormalizeLogin(login string) string {
+	return strings.ToLower(strings.TrimSpace(login))
+}
@@ -1,16 +1,42 @@
 package utils
 
-func LuhnValid(number int) bool {
-	return (number%10+checksum(number/10))%10 == 0
+import (
+	"strings"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+// maxOrderNumberLength bounds order numbers well above any real one, so
+// clients can't fill the database with arbitrarily long keys.
+const maxOrderNumberLength = 64
+
+// ParseOrderNumber validates an order number as sent by a client. The number
+// is kept as a digit string of up to 64 digits, so it keeps its leading
+// zeros.
+func ParseOrderNumber(raw string) (entities.OrderNumber, error) {
+	number := strings.TrimSpace(raw)
+	if number == "" || len(number) > maxOrderNumberLength {
+		return "", entities.ErrMalformedOrderNumber
+	}
+	for _, digit := range number {
+		if digit < '0' || digit > '9' {
+			return "", entities.ErrMalformedOrderNumber
+		}
+	}
+	if !LuhnValid(number) {
+		return "", entities.ErrInvalidOrderNumber
+	}
+	return entities.OrderNumber(number), nil
 }
 
-func checksum(number int) int {
+// LuhnValid reports whether a string of decimal digits passes the Luhn check.
+func LuhnValid(number string) bool {
 	var luhn int
 
-	for i := 0; number > 0; i++ {
-		cur := number % 10
+	for i := 0; i < len(number); i++ {
+		cur := int(number[len(number)-1-i] - '0')
 
-		if i%2 == 0 { // even
+		if i%2 == 1 { // every second digit from the right
 			cur = cur * 2
 			if cur > 9 {
 				cur = cur%10 + cur/10
@@ -18,7 +44,6 @@ func checksum(number int) int {
 		}
 
 		luhn += cur
-		number = number / 10
 	}
-	return luhn % 10
+	return luhn%10 == 0
 }
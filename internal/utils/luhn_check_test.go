@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+func TestParseOrderNumber(t *testing.T) {
+	tests := []struct {
+		name           string
+		raw            string
+		expectedNumber entities.OrderNumber
+		expectedErr    error
+	}{
+		{
+			name:           "ParseOrderNumber: valid number",
+			raw:            "12345678903",
+			expectedNumber: "12345678903",
+			expectedErr:    nil,
+		},
+		{
+			name:           "ParseOrderNumber: longer than int64",
+			raw:            "123456789012345678901234567891",
+			expectedNumber: "123456789012345678901234567891",
+			expectedErr:    nil,
+		},
+		{
+			name:           "ParseOrderNumber: leading zeros kept",
+			raw:            "0012345678903",
+			expectedNumber: "0012345678903",
+			expectedErr:    nil,
+		},
+		{
+			name:           "ParseOrderNumber: surrounding whitespace",
+			raw:            " 12345678903\n",
+			expectedNumber: "12345678903",
+			expectedErr:    nil,
+		},
+		{
+			name:        "ParseOrderNumber: Luhn check fails",
+			raw:         "12345678904",
+			expectedErr: entities.ErrInvalidOrderNumber,
+		},
+		{
+			name:        "ParseOrderNumber: not digits",
+			raw:         "-12345678903",
+			expectedErr: entities.ErrMalformedOrderNumber,
+		},
+		{
+			name:           "ParseOrderNumber: longest allowed",
+			raw:            strings.Repeat("0", 53) + "12345678903",
+			expectedNumber: entities.OrderNumber(strings.Repeat("0", 53) + "12345678903"),
+			expectedErr:    nil,
+		},
+		{
+			name:        "ParseOrderNumber: too long",
+			raw:         strings.Repeat("0", 54) + "12345678903",
+			expectedErr: entities.ErrMalformedOrderNumber,
+		},
+		{
+			name:        "ParseOrderNumber: empty",
+			raw:         "",
+			expectedErr: entities.ErrMalformedOrderNumber,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			number, err := ParseOrderNumber(tt.raw)
+			assert.Equal(t, tt.expectedErr, err)
+			assert.Equal(t, tt.expectedNumber, number)
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+const (
+	BatchFormatJSON   = "json"
+	BatchFormatCSV    = "csv"
+	BatchFormatNDJSON = "ndjson"
+)
+
+// ParseOrderBatch splits a bulk upload into order numbers without validating
+// them, so a bad number only fails its own line. A JSON upload is an array,
+// CSV takes the first column with an optional "number" or "order" header and
+// NDJSON has one value per line. Numbers may be JSON strings or numbers;
+// leading zeros need a string, as JSON numbers cannot have them.
+// Only an upload that cannot be split at all is ErrMalformedBatch; one over
+// maxItems or over the limit of an http.MaxBytesReader is ErrBatchTooLarge.
+func ParseOrderBatch(format string, body io.Reader, maxItems int) ([]entities.BatchOrderItem, error) {
+	var items []entities.BatchOrderItem
+	var err error
+	switch format {
+	case BatchFormatJSON:
+		items, err = parseJSONBatch(body)
+	case BatchFormatCSV:
+		items, err = parseCSVBatch(body)
+	case BatchFormatNDJSON:
+		items, err = parseNDJSONBatch(body)
+	default:
+		return nil, fmt.Errorf("%w: unknown format %q", entities.ErrMalformedBatch, format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(items) > maxItems {
+		return nil, entities.ErrBatchTooLarge
+	}
+	return items, nil
+}
+
+func parseJSONBatch(body io.Reader) ([]entities.BatchOrderItem, error) {
+	var values []json.RawMessage
+	err := json.NewDecoder(body).Decode(&values)
+	if err != nil {
+		return nil, malformedBatch(err)
+	}
+	items := make([]entities.BatchOrderItem, 0, len(values))
+	for i, value := range values {
+		items = append(items, entities.BatchOrderItem{Line: i + 1, Raw: jsonOrderNumber(value)})
+	}
+	return items, nil
+}
+
+func parseCSVBatch(body io.Reader) ([]entities.BatchOrderItem, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var items []entities.BatchOrderItem
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return items, nil
+		}
+		if err != nil {
+			return nil, malformedBatch(err)
+		}
+		line, _ := reader.FieldPos(0)
+		header := strings.ToLower(strings.TrimSpace(record[0]))
+		if len(items) == 0 && (header == "number" || header == "order") {
+			continue
+		}
+		items = append(items, entities.BatchOrderItem{Line: line, Raw: record[0]})
+	}
+}
+
+func parseNDJSONBatch(body io.Reader) ([]entities.BatchOrderItem, error) {
+	var items []entities.BatchOrderItem
+	scanner := bufio.NewScanner(body)
+	for line := 1; scanner.Scan(); line++ {
+		value := bytes.TrimSpace(scanner.Bytes())
+		if len(value) == 0 {
+			continue
+		}
+		items = append(items, entities.BatchOrderItem{Line: line, Raw: jsonOrderNumber(value)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, malformedBatch(err)
+	}
+	return items, nil
+}
+
+// malformedBatch wraps the error that stopped splitting an upload. Hitting
+// the body size limit of an http.MaxBytesReader makes it ErrBatchTooLarge.
+func malformedBatch(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return fmt.Errorf("%w: %v", entities.ErrBatchTooLarge, err)
+	}
+	return fmt.Errorf("%w: %v", entities.ErrMalformedBatch, err)
+}
+
+// jsonOrderNumber returns the digits of a JSON string or number. Anything
+// else is returned as is and fails validation later.
+func jsonOrderNumber(value json.RawMessage) string {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return string(value)
+	}
+	switch number := decoded.(type) {
+	case string:
+		return number
+	case json.Number:
+		return number.String()
+	default:
+		return string(value)
+	}
+}
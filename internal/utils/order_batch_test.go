@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+)
+
+func TestParseOrderBatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		format        string
+		body          string
+		expectedItems []entities.BatchOrderItem
+		expectedErr   error
+	}{
+		{
+			name:   "ParseOrderBatch: JSON strings and numbers",
+			format: BatchFormatJSON,
+			body:   `["12345678903", "0012345678903", 123456789012345678901234567891, {"a": 1}]`,
+			expectedItems: []entities.BatchOrderItem{
+				{Line: 1, Raw: "12345678903"},
+				{Line: 2, Raw: "0012345678903"},
+				{Line: 3, Raw: "123456789012345678901234567891"},
+				{Line: 4, Raw: `{"a": 1}`},
+			},
+		},
+		{
+			name:   "ParseOrderBatch: CSV with header and blank line",
+			format: BatchFormatCSV,
+			body:   "number,comment\n12345678903,first\n\n0012345678903\n",
+			expectedItems: []entities.BatchOrderItem{
+				{Line: 2, Raw: "12345678903"},
+				{Line: 4, Raw: "0012345678903"},
+			},
+		},
+		{
+			name:   "ParseOrderBatch: NDJSON",
+			format: BatchFormatNDJSON,
+			body:   "\"12345678903\"\n12345678903\n\nnot json\n",
+			expectedItems: []entities.BatchOrderItem{
+				{Line: 1, Raw: "12345678903"},
+				{Line: 2, Raw: "12345678903"},
+				{Line: 4, Raw: "not json"},
+			},
+		},
+		{
+			name:        "ParseOrderBatch: JSON is not an array",
+			format:      BatchFormatJSON,
+			body:        `{"orders": []}`,
+			expectedErr: entities.ErrMalformedBatch,
+		},
+		{
+			name:        "ParseOrderBatch: too many items",
+			format:      BatchFormatNDJSON,
+			body:        "1\n2\n3\n4\n5\n",
+			expectedErr: entities.ErrBatchTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := ParseOrderBatch(tt.format, strings.NewReader(tt.body), 4)
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedItems, items)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2Time    uint32 = 3
+	argon2Memory  uint32 = 64 * 1024
+	argon2Threads uint8  = 2
+	argon2KeyLen  uint32 = 32
+	argon2SaltLen        = 16
+
+	legacyHashLength = 64
+
+	// Bounds for argon2 parameters read back from stored hashes. A zero
+	// makes argon2 panic and a huge memory cost would exhaust the server.
+	maxArgon2Time    uint32 = 16
+	maxArgon2Memory  uint32 = 256 * 1024
+	maxArgon2Threads uint8  = 16
+	minArgon2KeyLen         = 16
+	maxArgon2KeyLen         = 64
+	minArgon2SaltLen        = 8
+)
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+}
+
+var currentArgon2Params = argon2Params{
+	time:    argon2Time,
+	memory:  argon2Memory,
+	threads: argon2Threads,
+	keyLen:  argon2KeyLen,
+}
+
+// HashPassword returns an argon2id hash in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("generate salt failed: %w", err)
+	}
+	return encodeArgon2(password, salt, currentArgon2Params), nil
+}
+
+// ComparePassword checks password against an encoded hash in constant time.
+// needsRehash is set when the hash is a legacy SHA-256 one or was produced
+// with outdated argon2 parameters and should be replaced by HashPassword.
+func ComparePassword(encodedHash, password string) (match bool, needsRehash bool, err error) {
+	if isLegacyHash(encodedHash) {
+		match = subtle.ConstantTimeCompare([]byte(HexHash(password)), []byte(encodedHash)) == 1
+		return match, true, nil
+	}
+
+	params, salt, hash, err := decodeArgon2(encodedHash)
+	if err != nil {
+		return false, false, err
+	}
+	otherHash := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+	match = subtle.ConstantTimeCompare(hash, otherHash) == 1
+	return match, params != currentArgon2Params, nil
+}
+
+func encodeArgon2(password string, salt []byte, params argon2Params) string {
+	hash := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.memory, params.time, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	)
+}
+
+func decodeArgon2(encodedHash string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	var version int
+
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHashFormat
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, fmt.Errorf("%w: %v", ErrUnknownHashFormat, err)
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("%w: unsupported argon2 version %d", ErrUnknownHashFormat, version)
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("%w: %v", ErrUnknownHashFormat, err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("%w: %v", ErrUnknownHashFormat, err)
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("%w: %v", ErrUnknownHashFormat, err)
+	}
+	if params.time == 0 || params.time > maxArgon2Time ||
+		params.memory == 0 || params.memory > maxArgon2Memory ||
+		params.threads == 0 || params.threads > maxArgon2Threads {
+		return params, nil, nil, fmt.Errorf(
+			"%w: argon2 parameters out of bounds: m=%d,t=%d,p=%d",
+			ErrUnknownHashFormat, params.memory, params.time, params.threads,
+		)
+	}
+	if len(salt) < minArgon2SaltLen || len(hash) < minArgon2KeyLen || len(hash) > maxArgon2KeyLen {
+		return params, nil, nil, fmt.Errorf("%w: salt or hash length out of bounds", ErrUnknownHashFormat)
+	}
+	params.keyLen = uint32(len(hash))
+	return params, salt, hash, nil
+}
+
+func isLegacyHash(encodedHash string) bool {
+	if len(encodedHash) != legacyHashLength {
+		return false
+	}
+	for _, c := range encodedHash {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComparePassword(t *testing.T) {
+	const saltAndHash = "$c2FsdHNhbHRzYWx0c2FsdA$aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g"
+	hash, err := HashPassword("password")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		encodedHash   string
+		expectedMatch bool
+		expectedErr   error
+	}{
+		{
+			name:          "ComparePassword: current hash",
+			encodedHash:   hash,
+			expectedMatch: true,
+			expectedErr:   nil,
+		},
+		{
+			name:        "ComparePassword: zero threads",
+			encodedHash: "$argon2id$v=19$m=65536,t=3,p=0" + saltAndHash,
+			expectedErr: ErrUnknownHashFormat,
+		},
+		{
+			name:        "ComparePassword: zero time",
+			encodedHash: "$argon2id$v=19$m=65536,t=0,p=2" + saltAndHash,
+			expectedErr: ErrUnknownHashFormat,
+		},
+		{
+			name:        "ComparePassword: huge memory",
+			encodedHash: "$argon2id$v=19$m=4294967295,t=3,p=2" + saltAndHash,
+			expectedErr: ErrUnknownHashFormat,
+		},
+		{
+			name:        "ComparePassword: empty hash",
+			encodedHash: "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHRzYWx0c2FsdA$",
+			expectedErr: ErrUnknownHashFormat,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, _, err := ComparePassword(tt.encodedHash, "password")
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedMatch, match)
+		})
+	}
+}
@@ -2,26 +2,39 @@ package workers
 
 import (
 	"context"
-	"runtime"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"go.uber.org/zap"
 
 	"github.com/Albitko/loyalty-program/internal/entities"
-	"github.com/Albitko/loyalty-program/internal/repo"
+	"github.com/Albitko/loyalty-program/internal/utils"
 )
 
-type ordersQueue interface {
-	PopWait() entities.Order
-	Push(entities.Order)
-}
-
-type orderStorage interface {
-	UpdateOrder(context.Context, entities.Order) error
-}
+const (
+	// recheckDelay is how long an order the accrual service is working on
+	// waits for its next check after news about it.
+	recheckDelay = time.Second
+	// retryDelay is the first wait after the accrual service could not be
+	// asked about an order or did not know it.
+	retryDelay = 5 * time.Second
+	// maxCheckDelay caps the backoff between checks of one order.
+	maxCheckDelay = 10 * time.Minute
+)
 
 type accrualChecker struct {
-	queue   ordersQueue
+	jobs    <-chan entities.AccrualJob
 	storage orderStorage
 	getter  *accrualGetter
-	ctx     context.Context
+	// unregisteredDeadline is how long after upload an order the accrual
+	// service still does not know is given up as INVALID.
+	unregisteredDeadline time.Duration
+	// maxAttempts is how many checks in a row may bring no news before the
+	// order is dead-lettered.
+	maxAttempts int
+	ctx         context.Context
 }
 
 func (a *accrualChecker) loop() {
@@ -29,43 +42,133 @@ func (a *accrualChecker) loop() {
 		select {
 		case <-a.ctx.Done():
 			return
-		default:
-			order := a.queue.PopWait()
-			updatedOrder, err := a.getter.GetAccrual(order.OrderID)
-			if err != nil {
-				continue
-			}
-			err = a.storage.UpdateOrder(a.ctx, updatedOrder)
-			if err != nil {
-				continue
-			}
-			if updatedOrder.Status != "INVALID" && updatedOrder.Status != "PROCESSED" {
-				a.queue.Push(updatedOrder)
-			}
+		case job := <-a.jobs:
+			a.check(job)
 		}
 	}
 }
-func newAccrualChecker(
-	ctx context.Context, storage orderStorage, queue ordersQueue, getter *accrualGetter,
-) *accrualChecker {
-	return &accrualChecker{
-		ctx:     ctx,
-		queue:   queue,
-		storage: storage,
-		getter:  getter,
+
+// check asks the accrual service about one claimed order and stores the
+// answer. Every check that brings no news counts as an attempt and pushes
+// the next one further out; an order that runs out of attempts is
+// dead-lettered. Checks the accrual service puts off, because it throttles
+// or does not know the order yet, are not the order's fault: they are
+// counted apart and only stretch the wait. Orders it never learns about end
+// as INVALID at the deadline. An order claimed before a pause began is put
+// off until the pause ends rather than held past its lease.
+func (a *accrualChecker) check(job entities.AccrualJob) {
+	if until := a.getter.limiter.PausedUntil(); !until.IsZero() {
+		a.deferCheck(job.OrderID, time.Until(until))
+		return
+	}
+	attempt := job.Attempts + 1
+	updatedOrder, accrualResponse, err := a.getter.GetAccrual(a.ctx, job.OrderID)
+	switch {
+	case err == nil && (updatedOrder.Status.Final() || updatedOrder != job.Order):
+		a.update(job, updatedOrder, accrualResponse, recheckDelay)
+	case err == nil:
+		if attempt >= a.maxAttempts {
+			a.deadLetter(job, fmt.Sprintf("still %s after %d checks", updatedOrder.Status, attempt))
+			return
+		}
+		a.update(job, updatedOrder, accrualResponse, backoff(recheckDelay, attempt))
+	case errors.Is(err, entities.ErrAccrualOrderNotRegistered):
+		age := time.Since(job.UploadedAt)
+		if age >= a.unregisteredDeadline {
+			utils.Logger.Warn("accrualChecker:check - order never registered, marking INVALID",
+				zap.String("order", string(job.OrderID)), zap.Duration("age", age))
+			a.update(job, entities.Order{OrderID: job.OrderID, Status: entities.OrderStatusInvalid}, nil, 0)
+			return
+		}
+		a.deferCheck(job.OrderID, backoff(retryDelay, job.Deferrals+1))
+	case errors.Is(err, entities.ErrAccrualRateLimited):
+		a.deferCheck(job.OrderID, backoff(retryDelay, job.Deferrals+1))
+	default:
+		utils.Logger.Error("accrualChecker:check - GetAccrual", zap.String("order", string(job.OrderID)), zap.Error(err))
+		if attempt >= a.maxAttempts {
+			a.deadLetter(job, fmt.Sprintf("%d failed checks, last: %v", attempt, err))
+			return
+		}
+		a.release(job.OrderID, backoff(retryDelay, attempt))
 	}
 }
 
-func New(ctx context.Context, storage orderStorage, accrualServiceURL string) ordersQueue {
-	queue := repo.NewQueue()
-	checkers := make([]*accrualChecker, 0, runtime.NumCPU())
+// update stores the answer about a claimed order. When that fails the order
+// must not sit out its lease only to get the same answer again: an answer
+// that can never be stored dead-letters it, other errors release it like a
+// failed check.
+func (a *accrualChecker) update(
+	job entities.AccrualJob, order entities.Order, accrualResponse []byte, delay time.Duration,
+) {
+	err := a.storage.UpdateOrder(a.ctx, order, accrualResponse, time.Now().Add(delay))
+	if err == nil {
+		return
+	}
+	utils.Logger.Error("accrualChecker:update - UpdateOrder", zap.String("order", string(order.OrderID)), zap.Error(err))
+	attempt := job.Attempts + 1
+	switch {
+	case errors.Is(err, entities.ErrInvalidOrderTransition):
+		a.deadLetter(job, err.Error())
+	case attempt >= a.maxAttempts:
+		a.deadLetter(job, fmt.Sprintf("%d failed checks, last: %v", attempt, err))
+	default:
+		a.release(job.OrderID, backoff(retryDelay, attempt))
+	}
+}
+
+func (a *accrualChecker) release(number entities.OrderNumber, delay time.Duration) {
+	err := a.storage.ReleaseOrder(a.ctx, number, time.Now().Add(delay))
+	if err != nil {
+		utils.Logger.Error("accrualChecker:release - ReleaseOrder", zap.String("order", string(number)), zap.Error(err))
+	}
+}
+
+func (a *accrualChecker) deferCheck(number entities.OrderNumber, delay time.Duration) {
+	err := a.storage.DeferOrder(a.ctx, number, time.Now().Add(delay))
+	if err != nil {
+		utils.Logger.Error("accrualChecker:deferCheck - DeferOrder", zap.String("order", string(number)), zap.Error(err))
+	}
+}
 
-	for i := 0; i < runtime.NumCPU(); i++ {
-		checkers = append(checkers, newAccrualChecker(ctx, storage, queue, newAccrualGetter(accrualServiceURL)))
+func (a *accrualChecker) deadLetter(job entities.AccrualJob, reason string) {
+	utils.Logger.Warn("accrualChecker:deadLetter - giving up on order",
+		zap.String("order", string(job.OrderID)), zap.String("reason", reason))
+	err := a.storage.DeadLetterOrder(a.ctx, job.OrderID, reason)
+	if err != nil {
+		utils.Logger.Error("accrualChecker:deadLetter - DeadLetterOrder",
+			zap.String("order", string(job.OrderID)), zap.Error(err))
 	}
+}
+
+// backoff is the wait before the given attempt: base doubled for every
+// attempt before it, capped at maxCheckDelay. It is jittered to between
+// half and all of that, so orders that failed together spread out.
+func backoff(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxCheckDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxCheckDelay {
+		delay = maxCheckDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
 
-	for _, checker := range checkers {
-		go checker.loop()
+func newAccrualChecker(
+	ctx context.Context,
+	storage orderStorage,
+	jobs <-chan entities.AccrualJob,
+	getter *accrualGetter,
+	unregisteredDeadline time.Duration,
+	maxAttempts int,
+) *accrualChecker {
+	return &accrualChecker{
+		ctx:                  ctx,
+		jobs:                 jobs,
+		storage:              storage,
+		getter:               getter,
+		unregisteredDeadline: unregisteredDeadline,
+		maxAttempts:          maxAttempts,
 	}
-	return queue
 }
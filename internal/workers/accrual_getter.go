@@ -1,27 +1,77 @@
 package workers
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
 	"github.com/Albitko/loyalty-program/internal/entities"
 	"github.com/Albitko/loyalty-program/internal/utils"
 )
 
 type accrualGetter struct {
 	accrualURL string
+	limiter    *rateLimiter
 }
 
-func (s *accrualGetter) GetAccrual(orderID string) (entities.Order, error) {
-	var order entities.Order
-	_, err := utils.RestyClient.R().
-		EnableTrace().
-		SetResult(&order).
-		Get(s.accrualURL + "/api/orders/" + orderID)
+// GetAccrual asks the accrual service about an order and translates the
+// answer to our statuses. Besides the order it returns the raw response
+// body for the order's history. Answers without news about the order come
+// back as *entities.AccrualResponseError: 204 as ErrAccrualOrderNotRegistered,
+// 429 as ErrAccrualRateLimited, 5xx as ErrAccrualUnavailable. A 429 also
+// pauses every checker sharing the limiter.
+func (s *accrualGetter) GetAccrual(
+	ctx context.Context, orderID entities.OrderNumber,
+) (entities.Order, []byte, error) {
+	if err := s.limiter.Wait(ctx); err != nil {
+		return entities.Order{}, nil, err
+	}
 
+	resp, err := utils.RestyClient.R().
+		SetContext(ctx).
+		EnableTrace().
+		Get(s.accrualURL + "/api/orders/" + string(orderID))
 	if err != nil {
-		return order, err
+		return entities.Order{}, nil, err
+	}
+
+	responseErr := &entities.AccrualResponseError{Order: orderID, StatusCode: resp.StatusCode()}
+	switch {
+	case resp.StatusCode() == http.StatusOK:
+		order, err := decodeAccrualResponse(orderID, resp.Body())
+		return order, resp.Body(), err
+	case resp.StatusCode() == http.StatusNoContent:
+		responseErr.Err = entities.ErrAccrualOrderNotRegistered
+	case resp.StatusCode() == http.StatusTooManyRequests:
+		s.limiter.Throttled(resp.Header().Get("Retry-After"), resp.Body())
+		responseErr.Err = entities.ErrAccrualRateLimited
+	case resp.StatusCode() >= http.StatusInternalServerError:
+		responseErr.Err = entities.ErrAccrualUnavailable
+	default:
+		responseErr.Err = entities.ErrUnexpectedAccrualResponse
+	}
+	return entities.Order{}, nil, responseErr
+}
+
+// decodeAccrualResponse reads a 200 answer strictly: exactly one JSON
+// object with no unknown fields, describing the order that was asked for.
+func decodeAccrualResponse(orderID entities.OrderNumber, body []byte) (entities.Order, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+
+	var response entities.AccrualResponse
+	if err := decoder.Decode(&response); err != nil {
+		return entities.Order{}, fmt.Errorf("%w: %v", entities.ErrMalformedAccrualResponse, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return entities.Order{}, fmt.Errorf("%w: trailing data", entities.ErrMalformedAccrualResponse)
 	}
-	return order, nil
+	return response.OrderFor(orderID)
 }
 
-func newAccrualGetter(accrualURL string) *accrualGetter {
-	return &accrualGetter{accrualURL: accrualURL}
+func newAccrualGetter(accrualURL string, limiter *rateLimiter) *accrualGetter {
+	return &accrualGetter{accrualURL: accrualURL, limiter: limiter}
 }
@@ -0,0 +1,127 @@
+package workers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+func TestAccrualGetter(t *testing.T) {
+	utils.InitializeRestyClient()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+
+	tests := []struct {
+		name          string
+		statusCode    int
+		body          string
+		expectedOrder entities.Order
+		expectedErr   error
+	}{
+		{
+			name:       "GetAccrual: processed",
+			statusCode: http.StatusOK,
+			body:       `{"order":"12345678903","status":"PROCESSED","accrual":500}`,
+			expectedOrder: entities.Order{
+				OrderID: "12345678903",
+				Status:  entities.OrderStatusProcessed,
+				Accrual: 500,
+			},
+		},
+		{
+			name:          "GetAccrual: registered counts as processing",
+			statusCode:    http.StatusOK,
+			body:          `{"order":"12345678903","status":"REGISTERED"}`,
+			expectedOrder: entities.Order{OrderID: "12345678903", Status: entities.OrderStatusProcessing},
+		},
+		{
+			name:        "GetAccrual: not registered",
+			statusCode:  http.StatusNoContent,
+			expectedErr: entities.ErrAccrualOrderNotRegistered,
+		},
+		{
+			name:        "GetAccrual: server error",
+			statusCode:  http.StatusBadGateway,
+			body:        "upstream failed",
+			expectedErr: entities.ErrAccrualUnavailable,
+		},
+		{
+			name:        "GetAccrual: unexpected status code",
+			statusCode:  http.StatusNotFound,
+			expectedErr: entities.ErrUnexpectedAccrualResponse,
+		},
+		{
+			name:        "GetAccrual: garbage body",
+			statusCode:  http.StatusOK,
+			body:        "<html>maintenance</html>",
+			expectedErr: entities.ErrMalformedAccrualResponse,
+		},
+		{
+			name:        "GetAccrual: empty body",
+			statusCode:  http.StatusOK,
+			expectedErr: entities.ErrMalformedAccrualResponse,
+		},
+		{
+			name:        "GetAccrual: unknown field",
+			statusCode:  http.StatusOK,
+			body:        `{"order":"12345678903","status":"PROCESSED","accrual":500,"bonus":1}`,
+			expectedErr: entities.ErrMalformedAccrualResponse,
+		},
+		{
+			name:        "GetAccrual: trailing data",
+			statusCode:  http.StatusOK,
+			body:        `{"order":"12345678903","status":"PROCESSING"}{}`,
+			expectedErr: entities.ErrMalformedAccrualResponse,
+		},
+		{
+			name:        "GetAccrual: unknown status",
+			statusCode:  http.StatusOK,
+			body:        `{"order":"12345678903","status":"DONE"}`,
+			expectedErr: entities.ErrUnknownAccrualStatus,
+		},
+		{
+			name:        "GetAccrual: unknown status is malformed",
+			statusCode:  http.StatusOK,
+			body:        `{"order":"12345678903","status":"DONE"}`,
+			expectedErr: entities.ErrMalformedAccrualResponse,
+		},
+		{
+			name:        "GetAccrual: answer about another order",
+			statusCode:  http.StatusOK,
+			body:        `{"order":"79927398713","status":"PROCESSED","accrual":500}`,
+			expectedErr: entities.ErrMalformedAccrualResponse,
+		},
+		{
+			name:        "GetAccrual: negative accrual",
+			statusCode:  http.StatusOK,
+			body:        `{"order":"12345678903","status":"PROCESSED","accrual":-1}`,
+			expectedErr: entities.ErrMalformedAccrualResponse,
+		},
+		{
+			name:        "GetAccrual: accrual before processing is done",
+			statusCode:  http.StatusOK,
+			body:        `{"order":"12345678903","status":"PROCESSING","accrual":500}`,
+			expectedErr: entities.ErrMalformedAccrualResponse,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accrual := newAccrualStub(t, func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/orders/12345678903", r.URL.Path)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.statusCode)
+				_, _ = w.Write([]byte(tt.body))
+			})
+
+			order, _, err := newAccrualGetter(accrual.URL, newRateLimiter()).GetAccrual(ctx, "12345678903")
+			assert.ErrorIs(t, err, tt.expectedErr)
+			assert.Equal(t, tt.expectedOrder, order)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+const (
+	// claimLease is how long a claimed order is kept from other workers and
+	// replicas. It has to outlast one accrual request.
+	claimLease = 2 * time.Minute
+	// pollInterval is how often the database is checked for due orders when
+	// nothing wakes the dispatcher earlier.
+	pollInterval = time.Second
+)
+
+type orderStorage interface {
+	ClaimDueOrders(ctx context.Context, limit int, lease time.Duration) ([]entities.AccrualJob, error)
+	ClaimOrders(ctx context.Context, numbers []entities.OrderNumber, lease time.Duration) ([]entities.AccrualJob, error)
+	UpdateOrder(ctx context.Context, order entities.Order, accrualResponse []byte, nextCheckAt time.Time) error
+	ReleaseOrder(ctx context.Context, number entities.OrderNumber, nextCheckAt time.Time) error
+	DeferOrder(ctx context.Context, number entities.OrderNumber, nextCheckAt time.Time) error
+	DeadLetterOrder(ctx context.Context, number entities.OrderNumber, reason string) error
+}
+
+// dispatcher hands orders due for an accrual check to the checkers. The
+// orders table is the queue: orders are claimed from it with a lease, so
+// unfinished orders survive restarts and replicas share the work. New
+// orders pushed through the intake are claimed ahead of the poll. Nothing
+// is claimed while the accrual service has paused the checkers, so leases
+// don't run out on orders that wait for the pause to end.
+type dispatcher struct {
+	storage  orderStorage
+	limiter  *rateLimiter
+	jobs     chan entities.AccrualJob
+	intake   chan entities.OrderNumber
+	overflow string
+	batch    int
+	ctx      context.Context
+}
+
+// Push tells the dispatcher that a new order is due. The order is already
+// stored, so Push never blocks: when the intake is full it drops the newest
+// or the oldest order from it as configured, and the poll finds that order
+// instead.
+func (d *dispatcher) Push(order entities.Order) {
+	select {
+	case d.intake <- order.OrderID:
+		return
+	default:
+	}
+	if d.overflow != entities.QueueOverflowDropOldest {
+		return
+	}
+	select {
+	case <-d.intake:
+	default:
+	}
+	select {
+	case d.intake <- order.OrderID:
+	default:
+	}
+}
+
+func (d *dispatcher) loop() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	var pushed []entities.OrderNumber
+	for {
+		if err := d.limiter.WaitPause(d.ctx); err != nil {
+			return
+		}
+		pushed = d.drainIntake(pushed)
+		if len(pushed) > 0 {
+			orders, err := d.storage.ClaimOrders(d.ctx, pushed, claimLease)
+			if err != nil {
+				utils.Logger.Error("dispatcher:loop - ClaimOrders", zap.Error(err))
+			}
+			pushed = pushed[:0]
+			if !d.dispatch(orders) {
+				return
+			}
+		}
+
+		orders, err := d.storage.ClaimDueOrders(d.ctx, d.batch, claimLease)
+		if err != nil {
+			utils.Logger.Error("dispatcher:loop - ClaimDueOrders", zap.Error(err))
+		}
+		if !d.dispatch(orders) {
+			return
+		}
+		// A full batch means more orders may be due right away.
+		if len(orders) == d.batch {
+			continue
+		}
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		case number := <-d.intake:
+			pushed = append(pushed, number)
+		}
+	}
+}
+
+// drainIntake takes what was pushed, up to a batch, without waiting.
+func (d *dispatcher) drainIntake(pushed []entities.OrderNumber) []entities.OrderNumber {
+	for len(pushed) < d.batch {
+		select {
+		case number := <-d.intake:
+			pushed = append(pushed, number)
+		default:
+			return pushed
+		}
+	}
+	return pushed
+}
+
+// dispatch hands claimed orders to the checkers. It reports false once ctx
+// is done.
+func (d *dispatcher) dispatch(orders []entities.AccrualJob) bool {
+	for _, job := range orders {
+		select {
+		case d.jobs <- job:
+		case <-d.ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// New starts the accrual checkers and the dispatcher feeding them; they stop
+// when ctx is done. cfg sets the accrual service address, the number of
+// checkers (one per CPU by default), the intake size and overflow mode.
+// Orders the accrual service still does not know AccrualUnregisteredDeadline
+// after upload are marked INVALID; orders that get no news in
+// AccrualMaxAttempts checks in a row are dead-lettered; it must be positive.
+func New(ctx context.Context, storage orderStorage, cfg entities.Config) (*dispatcher, error) {
+	if cfg.AccrualMaxAttempts <= 0 {
+		return nil, fmt.Errorf("%w: %d", entities.ErrInvalidMaxAttempts, cfg.AccrualMaxAttempts)
+	}
+	if cfg.AccrualQueueOverflow != entities.QueueOverflowDropNewest &&
+		cfg.AccrualQueueOverflow != entities.QueueOverflowDropOldest {
+		return nil, fmt.Errorf("%w: %q", entities.ErrInvalidQueueOverflow, cfg.AccrualQueueOverflow)
+	}
+	queueSize := cfg.AccrualQueueSize
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	workers := cfg.AccrualWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	// The accrual service limits requests per client, so all checkers share
+	// one limiter.
+	limiter := newRateLimiter()
+	d := &dispatcher{
+		storage:  storage,
+		limiter:  limiter,
+		jobs:     make(chan entities.AccrualJob, workers),
+		intake:   make(chan entities.OrderNumber, queueSize),
+		overflow: cfg.AccrualQueueOverflow,
+		batch:    workers,
+		ctx:      ctx,
+	}
+	for i := 0; i < workers; i++ {
+		getter := newAccrualGetter(cfg.AccrualSystemAddress, limiter)
+		checker := newAccrualChecker(ctx, storage, d.jobs, getter, cfg.AccrualUnregisteredDeadline, cfg.AccrualMaxAttempts)
+		go checker.loop()
+	}
+	go d.loop()
+	return d, nil
+}
@@ -0,0 +1,493 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+// memoryStorage is an orders queue kept in memory. Orders in pending are
+// due and not claimed.
+type memoryStorage struct {
+	mu       sync.Mutex
+	pending  []entities.AccrualJob
+	updated  []entities.Order
+	released []entities.OrderNumber
+	deferred []entities.OrderNumber
+	dead     []entities.OrderNumber
+	// updateErr fails every UpdateOrder.
+	updateErr error
+}
+
+func (m *memoryStorage) ClaimDueOrders(
+	ctx context.Context, limit int, lease time.Duration,
+) ([]entities.AccrualJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if limit > len(m.pending) {
+		limit = len(m.pending)
+	}
+	claimed := m.pending[:limit]
+	m.pending = m.pending[limit:]
+	return claimed, nil
+}
+
+func (m *memoryStorage) ClaimOrders(
+	ctx context.Context, numbers []entities.OrderNumber, lease time.Duration,
+) ([]entities.AccrualJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var claimed, rest []entities.AccrualJob
+	for _, job := range m.pending {
+		if containsOrder(numbers, job.OrderID) {
+			claimed = append(claimed, job)
+		} else {
+			rest = append(rest, job)
+		}
+	}
+	m.pending = rest
+	return claimed, nil
+}
+
+func containsOrder(numbers []entities.OrderNumber, number entities.OrderNumber) bool {
+	for _, n := range numbers {
+		if n == number {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryStorage) UpdateOrder(
+	ctx context.Context, order entities.Order, accrualResponse []byte, nextCheckAt time.Time,
+) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.updateErr != nil {
+		return m.updateErr
+	}
+	m.updated = append(m.updated, order)
+	return nil
+}
+
+func (m *memoryStorage) ReleaseOrder(ctx context.Context, number entities.OrderNumber, nextCheckAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.released = append(m.released, number)
+	return nil
+}
+
+func (m *memoryStorage) DeferOrder(ctx context.Context, number entities.OrderNumber, nextCheckAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deferred = append(m.deferred, number)
+	return nil
+}
+
+func (m *memoryStorage) DeadLetterOrder(ctx context.Context, number entities.OrderNumber, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dead = append(m.dead, number)
+	return nil
+}
+
+func (m *memoryStorage) deferredOrders() []entities.OrderNumber {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]entities.OrderNumber(nil), m.deferred...)
+}
+
+func (m *memoryStorage) deadLettered() []entities.OrderNumber {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]entities.OrderNumber(nil), m.dead...)
+}
+
+func (m *memoryStorage) results() ([]entities.Order, []entities.OrderNumber) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]entities.Order(nil), m.updated...), append([]entities.OrderNumber(nil), m.released...)
+}
+
+func newJob(number entities.OrderNumber, uploadedAt time.Time) entities.AccrualJob {
+	return entities.AccrualJob{
+		Order:      entities.Order{OrderID: number, Status: entities.OrderStatusNew},
+		UploadedAt: uploadedAt,
+	}
+}
+
+func newTestConfig(accrualURL string) entities.Config {
+	return entities.Config{
+		AccrualSystemAddress:        accrualURL,
+		AccrualUnregisteredDeadline: time.Hour,
+		AccrualMaxAttempts:          3,
+		AccrualWorkers:              2,
+		AccrualQueueSize:            10,
+		AccrualQueueOverflow:        entities.QueueOverflowDropNewest,
+	}
+}
+
+func newAccrualStub(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDispatcher(t *testing.T) {
+	utils.Logger = zap.NewNop()
+	utils.InitializeRestyClient()
+
+	accrual := newAccrualStub(t, func(w http.ResponseWriter, r *http.Request) {
+		number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		switch number {
+		case "79927398713":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case "4561261212345467":
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case "5062821234567892":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(entities.AccrualResponse{
+				Order:  entities.OrderNumber(number),
+				Status: entities.AccrualStatusProcessing,
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(entities.AccrualResponse{
+			Order:   entities.OrderNumber(number),
+			Status:  entities.AccrualStatusProcessed,
+			Accrual: 500,
+		})
+	})
+
+	t.Run("Dispatcher: picks up orders left from before a restart", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		storage := &memoryStorage{pending: []entities.AccrualJob{newJob("12345678903", time.Now())}}
+
+		_, err := New(ctx, storage, newTestConfig(accrual.URL))
+		assert.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			updated, _ := storage.results()
+			return len(updated) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		updated, _ := storage.results()
+		assert.Equal(t, entities.Order{
+			OrderID: "12345678903",
+			Status:  entities.OrderStatusProcessed,
+			Accrual: 500,
+		}, updated[0])
+	})
+
+	t.Run("Dispatcher: push wakes it before the next poll", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		storage := &memoryStorage{}
+		queue, err := New(ctx, storage, newTestConfig(accrual.URL))
+		assert.NoError(t, err)
+
+		// Let the first poll find nothing, then store and push an order.
+		time.Sleep(50 * time.Millisecond)
+		storage.mu.Lock()
+		storage.pending = append(storage.pending, newJob("12345678903", time.Now()))
+		storage.mu.Unlock()
+		queue.Push(entities.Order{OrderID: "12345678903"})
+
+		assert.Eventually(t, func() bool {
+			updated, _ := storage.results()
+			return len(updated) == 1
+		}, pollInterval/2, 10*time.Millisecond)
+	})
+
+	t.Run("Dispatcher: failed check releases the order", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		storage := &memoryStorage{pending: []entities.AccrualJob{newJob("79927398713", time.Now())}}
+
+		_, err := New(ctx, storage, newTestConfig(accrual.URL))
+		assert.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			_, released := storage.results()
+			return len(released) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		updated, released := storage.results()
+		assert.Empty(t, updated)
+		assert.Equal(t, []entities.OrderNumber{"79927398713"}, released)
+	})
+	updateErrorTests := []struct {
+		name             string
+		updateErr        error
+		expectedReleased []entities.OrderNumber
+		expectedDead     []entities.OrderNumber
+	}{
+		{
+			name:             "Dispatcher: order is released when the update fails",
+			updateErr:        errors.New("database error"),
+			expectedReleased: []entities.OrderNumber{"12345678903"},
+		},
+		{
+			name: "Dispatcher: order is dead-lettered when the update is an invalid transition",
+			updateErr: &entities.OrderTransitionError{
+				Order: "12345678903", From: entities.OrderStatusInvalid, To: entities.OrderStatusProcessed,
+			},
+			expectedDead: []entities.OrderNumber{"12345678903"},
+		},
+	}
+	for _, tt := range updateErrorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			storage := &memoryStorage{
+				pending:   []entities.AccrualJob{newJob("12345678903", time.Now())},
+				updateErr: tt.updateErr,
+			}
+
+			_, err := New(ctx, storage, newTestConfig(accrual.URL))
+			assert.NoError(t, err)
+
+			assert.Eventually(t, func() bool {
+				_, released := storage.results()
+				return len(released)+len(storage.deadLettered()) == 1
+			}, 5*time.Second, 10*time.Millisecond)
+			updated, released := storage.results()
+			assert.Empty(t, updated)
+			assert.Equal(t, tt.expectedReleased, released)
+			assert.Equal(t, tt.expectedDead, storage.deadLettered())
+		})
+	}
+
+	unregisteredTests := []struct {
+		name             string
+		uploadedAt       time.Time
+		expectedUpdated  []entities.Order
+		expectedDeferred []entities.OrderNumber
+	}{
+		{
+			name:             "Dispatcher: unregistered order is retried",
+			uploadedAt:       time.Now(),
+			expectedDeferred: []entities.OrderNumber{"4561261212345467"},
+		},
+		{
+			name:       "Dispatcher: order unregistered past the deadline is invalid",
+			uploadedAt: time.Now().Add(-2 * time.Hour),
+			expectedUpdated: []entities.Order{
+				{OrderID: "4561261212345467", Status: entities.OrderStatusInvalid},
+			},
+		},
+	}
+	for _, tt := range unregisteredTests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			storage := &memoryStorage{pending: []entities.AccrualJob{newJob("4561261212345467", tt.uploadedAt)}}
+
+			_, err := New(ctx, storage, newTestConfig(accrual.URL))
+			assert.NoError(t, err)
+
+			assert.Eventually(t, func() bool {
+				updated, _ := storage.results()
+				return len(updated)+len(storage.deferredOrders()) == 1
+			}, 5*time.Second, 10*time.Millisecond)
+			updated, released := storage.results()
+			assert.Equal(t, tt.expectedUpdated, updated)
+			assert.Empty(t, released)
+			assert.Equal(t, tt.expectedDeferred, storage.deferredOrders())
+		})
+	}
+
+	deadLetterTests := []struct {
+		name             string
+		order            entities.OrderNumber
+		status           entities.OrderStatus
+		attempts         int
+		expectedUpdated  int
+		expectedDeferred int
+		expectedDead     []entities.OrderNumber
+	}{
+		{
+			name:            "Dispatcher: stuck order is checked again while it has attempts",
+			order:           "5062821234567892",
+			status:          entities.OrderStatusProcessing,
+			attempts:        1,
+			expectedUpdated: 1,
+		},
+		{
+			name:         "Dispatcher: stuck order is dead-lettered on the last attempt",
+			order:        "5062821234567892",
+			status:       entities.OrderStatusProcessing,
+			attempts:     2,
+			expectedDead: []entities.OrderNumber{"5062821234567892"},
+		},
+		{
+			name:         "Dispatcher: failing order is dead-lettered on the last attempt",
+			order:        "79927398713",
+			status:       entities.OrderStatusNew,
+			attempts:     2,
+			expectedDead: []entities.OrderNumber{"79927398713"},
+		},
+		{
+			name:             "Dispatcher: unregistered order is not dead-lettered",
+			order:            "4561261212345467",
+			status:           entities.OrderStatusNew,
+			attempts:         2,
+			expectedDeferred: 1,
+		},
+	}
+	for _, tt := range deadLetterTests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			job := newJob(tt.order, time.Now())
+			job.Status = tt.status
+			job.Attempts = tt.attempts
+			storage := &memoryStorage{pending: []entities.AccrualJob{job}}
+
+			_, err := New(ctx, storage, newTestConfig(accrual.URL))
+			assert.NoError(t, err)
+
+			assert.Eventually(t, func() bool {
+				updated, released := storage.results()
+				return len(updated)+len(released)+len(storage.deferredOrders())+len(storage.deadLettered()) == 1
+			}, 5*time.Second, 10*time.Millisecond)
+			updated, released := storage.results()
+			assert.Len(t, updated, tt.expectedUpdated)
+			assert.Empty(t, released)
+			assert.Len(t, storage.deferredOrders(), tt.expectedDeferred)
+			assert.Equal(t, tt.expectedDead, storage.deadLettered())
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		attempt int
+		max     time.Duration
+	}{
+		{name: "backoff: first attempt", attempt: 1, max: retryDelay},
+		{name: "backoff: doubles per attempt", attempt: 4, max: 8 * retryDelay},
+		{name: "backoff: capped", attempt: 60, max: maxCheckDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := backoff(retryDelay, tt.attempt)
+				assert.GreaterOrEqual(t, delay, tt.max/2)
+				assert.LessOrEqual(t, delay, tt.max)
+			}
+		})
+	}
+}
+
+func TestDispatcherPush(t *testing.T) {
+	pushTests := []struct {
+		name     string
+		overflow string
+		expected []entities.OrderNumber
+	}{
+		{
+			name:     "Push: full intake drops the newest order",
+			overflow: entities.QueueOverflowDropNewest,
+			expected: []entities.OrderNumber{"1", "2"},
+		},
+		{
+			name:     "Push: full intake drops the oldest order",
+			overflow: entities.QueueOverflowDropOldest,
+			expected: []entities.OrderNumber{"2", "3"},
+		},
+	}
+	for _, tt := range pushTests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Nothing reads the intake, so Push would hang if it could block.
+			d := &dispatcher{intake: make(chan entities.OrderNumber, 2), overflow: tt.overflow}
+			for _, number := range []entities.OrderNumber{"1", "2", "3"} {
+				d.Push(entities.Order{OrderID: number})
+			}
+			close(d.intake)
+			var intake []entities.OrderNumber
+			for number := range d.intake {
+				intake = append(intake, number)
+			}
+			assert.Equal(t, tt.expected, intake)
+		})
+	}
+
+	t.Run("New: unknown overflow mode", func(t *testing.T) {
+		cfg := newTestConfig("http://accrual")
+		cfg.AccrualQueueOverflow = "block"
+		_, err := New(context.Background(), &memoryStorage{}, cfg)
+		assert.ErrorIs(t, err, entities.ErrInvalidQueueOverflow)
+	})
+
+	t.Run("New: max attempts not positive", func(t *testing.T) {
+		cfg := newTestConfig("http://accrual")
+		cfg.AccrualMaxAttempts = 0
+		_, err := New(context.Background(), &memoryStorage{}, cfg)
+		assert.ErrorIs(t, err, entities.ErrInvalidMaxAttempts)
+	})
+}
+
+func TestDispatcherPause(t *testing.T) {
+	utils.Logger = zap.NewNop()
+	utils.InitializeRestyClient()
+
+	t.Run("Dispatcher: claims nothing while paused", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		storage := &memoryStorage{pending: []entities.AccrualJob{newJob("12345678903", time.Now())}}
+		limiter := newRateLimiter()
+		pausedUntil := time.Now().Add(300 * time.Millisecond)
+		limiter.Pause(pausedUntil)
+		d := &dispatcher{
+			storage: storage,
+			limiter: limiter,
+			jobs:    make(chan entities.AccrualJob, 1),
+			intake:  make(chan entities.OrderNumber, 1),
+			batch:   1,
+			ctx:     ctx,
+		}
+		go d.loop()
+
+		select {
+		case job := <-d.jobs:
+			assert.Equal(t, entities.OrderNumber("12345678903"), job.OrderID)
+			assert.False(t, time.Now().Before(pausedUntil), "claimed during the pause")
+		case <-time.After(5 * time.Second):
+			t.Fatal("order not claimed after the pause")
+		}
+	})
+
+	t.Run("Checker: order claimed before a pause is put off", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		accrual := newAccrualStub(t, func(w http.ResponseWriter, r *http.Request) {
+			t.Error("accrual service asked during a pause")
+		})
+		storage := &memoryStorage{}
+		limiter := newRateLimiter()
+		limiter.Pause(time.Now().Add(time.Minute))
+		checker := newAccrualChecker(ctx, storage, nil, newAccrualGetter(accrual.URL, limiter), time.Hour, 3)
+
+		checker.check(newJob("12345678903", time.Now()))
+		updated, released := storage.results()
+		assert.Empty(t, updated)
+		assert.Empty(t, released)
+		assert.Equal(t, []entities.OrderNumber{"12345678903"}, storage.deferredOrders())
+	})
+}
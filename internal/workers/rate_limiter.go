@@ -0,0 +1,140 @@
+package workers
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRetryAfter is the pause after a 429 without a usable Retry-After.
+const defaultRetryAfter = time.Minute
+
+var rateLimitBody = regexp.MustCompile(`(\d+) requests per minute`)
+
+// rateLimiter paces the requests of all checkers to the accrual service.
+// A 429 answered to any checker pauses all of them, and the limit the
+// service names in its answer spaces out the requests from then on.
+type rateLimiter struct {
+	mu          sync.Mutex
+	pausedUntil time.Time
+	interval    time.Duration
+	next        time.Time
+}
+
+// Wait blocks until a request may be sent or ctx is done.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	reserved := false
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		var wait time.Duration
+		if now.Before(l.pausedUntil) {
+			wait = l.pausedUntil.Sub(now)
+		} else if !reserved && l.interval > 0 {
+			slot := l.next
+			if slot.Before(now) {
+				slot = now
+			}
+			l.next = slot.Add(l.interval)
+			reserved = true
+			wait = slot.Sub(now)
+		}
+		l.mu.Unlock()
+
+		if wait <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// PausedUntil returns when the current pause ends, or the zero time if
+// requests are not paused.
+func (l *rateLimiter) PausedUntil() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Now().Before(l.pausedUntil) {
+		return l.pausedUntil
+	}
+	return time.Time{}
+}
+
+// WaitPause blocks until no pause holds back requests or ctx is done. Unlike
+// Wait it takes no slot from the per-minute limit.
+func (l *rateLimiter) WaitPause(ctx context.Context) error {
+	for {
+		until := l.PausedUntil()
+		if until.IsZero() {
+			return nil
+		}
+		timer := time.NewTimer(time.Until(until))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Pause holds back all requests until the given time.
+func (l *rateLimiter) Pause(until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// SetLimit spaces requests out to at most perMinute a minute.
+func (l *rateLimiter) SetLimit(perMinute int) {
+	if perMinute <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interval = time.Minute / time.Duration(perMinute)
+}
+
+// Throttled takes in a 429 answer: it pauses for its Retry-After and adopts
+// the per-minute limit from its body, if it names one.
+func (l *rateLimiter) Throttled(retryAfter string, body []byte) time.Time {
+	until := time.Now().Add(parseRetryAfter(retryAfter))
+	l.Pause(until)
+	if match := rateLimitBody.FindSubmatch(body); match != nil {
+		if perMinute, err := strconv.Atoi(string(match[1])); err == nil {
+			l.SetLimit(perMinute)
+		}
+	}
+	return until
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an
+// HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{}
+}
@@ -0,0 +1,126 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/Albitko/loyalty-program/internal/entities"
+	"github.com/Albitko/loyalty-program/internal/utils"
+)
+
+func TestRateLimiter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+
+	t.Run("Wait: blocks while paused", func(t *testing.T) {
+		limiter := newRateLimiter()
+		limiter.Pause(time.Now().Add(200 * time.Millisecond))
+		start := time.Now()
+		assert.NoError(t, limiter.Wait(ctx))
+		assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	})
+
+	t.Run("Wait: spaces requests by the limit", func(t *testing.T) {
+		limiter := newRateLimiter()
+		limiter.SetLimit(600)
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, limiter.Wait(ctx))
+		}
+		assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	})
+
+	t.Run("Wait: gives up with the context", func(t *testing.T) {
+		limiter := newRateLimiter()
+		limiter.Pause(time.Now().Add(time.Minute))
+		waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer waitCancel()
+		assert.ErrorIs(t, limiter.Wait(waitCtx), context.DeadlineExceeded)
+	})
+
+	t.Run("Pause: an earlier pause does not shorten a later one", func(t *testing.T) {
+		limiter := newRateLimiter()
+		later := time.Now().Add(time.Minute)
+		limiter.Pause(later)
+		limiter.Pause(time.Now().Add(time.Second))
+		assert.Equal(t, later, limiter.pausedUntil)
+	})
+
+	retryAfterTests := []struct {
+		name     string
+		value    string
+		expected time.Duration
+	}{
+		{name: "parseRetryAfter: seconds", value: "30", expected: 30 * time.Second},
+		{name: "parseRetryAfter: date in the past", value: "Wed, 21 Oct 2015 07:28:00 GMT", expected: 0},
+		{name: "parseRetryAfter: missing", value: "", expected: defaultRetryAfter},
+		{name: "parseRetryAfter: garbage", value: "soon", expected: defaultRetryAfter},
+	}
+	for _, tt := range retryAfterTests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseRetryAfter(tt.value))
+		})
+	}
+}
+
+func TestAccrualGetterThrottling(t *testing.T) {
+	utils.Logger = zap.NewNop()
+	utils.InitializeRestyClient()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		requests []time.Time
+	)
+	accrual := newAccrualStub(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, time.Now())
+		first := len(requests) == 1
+		mu.Unlock()
+		if first {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte("No more than 120 requests per minute allowed"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(entities.AccrualResponse{
+			Order:  entities.OrderNumber(strings.TrimPrefix(r.URL.Path, "/api/orders/")),
+			Status: entities.AccrualStatusProcessing,
+		})
+	})
+
+	limiter := newRateLimiter()
+	_, _, err := newAccrualGetter(accrual.URL, limiter).GetAccrual(ctx, "12345678903")
+	assert.ErrorIs(t, err, entities.ErrAccrualRateLimited)
+	throttledAt := time.Now()
+
+	// Two more checkers sharing the limiter have to wait out the pause and
+	// then keep to 120 requests a minute.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			order, _, err := newAccrualGetter(accrual.URL, limiter).GetAccrual(ctx, "12345678903")
+			assert.NoError(t, err)
+			assert.Equal(t, entities.OrderStatusProcessing, order.Status)
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, requests, 3)
+	assert.GreaterOrEqual(t, requests[1].Sub(throttledAt), 900*time.Millisecond)
+	assert.GreaterOrEqual(t, requests[2].Sub(requests[1]), 450*time.Millisecond)
+}